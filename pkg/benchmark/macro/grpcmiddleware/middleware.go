@@ -0,0 +1,150 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package grpcmiddleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Middleware auto instruments gRPC servers.
+type Middleware interface {
+	// UnaryServerInterceptor returns interceptor instrumenting unary RPCs.
+	UnaryServerInterceptor() grpc.UnaryServerInterceptor
+	// StreamServerInterceptor returns interceptor instrumenting streaming RPCs.
+	StreamServerInterceptor() grpc.StreamServerInterceptor
+}
+
+type nopMiddleware struct{}
+
+func (nopMiddleware) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(ctx, req)
+	}
+}
+
+func (nopMiddleware) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, ss)
+	}
+}
+
+// NewNopMiddleware provides a Middleware which does nothing.
+func NewNopMiddleware() Middleware {
+	return nopMiddleware{}
+}
+
+type middleware struct {
+	requestDuration *prometheus.HistogramVec
+	requestSize     *prometheus.SummaryVec
+	requestsTotal   *prometheus.CounterVec
+	responseSize    *prometheus.SummaryVec
+}
+
+// NewMiddleware provides gRPC metric Middleware. It registers four metric collectors, the gRPC counterparts of the
+// httpmidleware ones: grpc_requests_total (CounterVec), grpc_request_duration_seconds (Histogram),
+// grpc_request_size_bytes (Summary), grpc_response_size_bytes (Summary). Each is partitioned by the full RPC method
+// name (label name "handler") and gRPC status code (label name "code"). Sizes of streaming RPCs are sums of all
+// messages sent or received within the RPC.
+// Passing nil as buckets uses the default buckets.
+func NewMiddleware(reg prometheus.Registerer, buckets []float64) Middleware {
+	if buckets == nil {
+		buckets = []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120, 240, 360, 720}
+	}
+
+	return &middleware{
+		requestDuration: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "grpc_request_duration_seconds",
+				Help:    "Tracks the latencies for gRPC requests.",
+				Buckets: buckets,
+			},
+			[]string{"handler", "code"},
+		),
+		requestSize: promauto.With(reg).NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name: "grpc_request_size_bytes",
+				Help: "Tracks the size of gRPC requests.",
+			},
+			[]string{"handler", "code"},
+		),
+		requestsTotal: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "grpc_requests_total",
+				Help: "Tracks the number of gRPC requests.",
+			}, []string{"handler", "code"},
+		),
+		responseSize: promauto.With(reg).NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name: "grpc_response_size_bytes",
+				Help: "Tracks the size of gRPC responses.",
+			},
+			[]string{"handler", "code"},
+		),
+	}
+}
+
+func (ins *middleware) observe(handler string, start time.Time, err error, reqSize, resSize int) {
+	code := status.Code(err).String()
+	ins.requestDuration.WithLabelValues(handler, code).Observe(time.Since(start).Seconds())
+	ins.requestSize.WithLabelValues(handler, code).Observe(float64(reqSize))
+	ins.requestsTotal.WithLabelValues(handler, code).Inc()
+	ins.responseSize.WithLabelValues(handler, code).Observe(float64(resSize))
+}
+
+func (ins *middleware) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		ins.observe(info.FullMethod, start, err, size(req), size(res))
+		return res, err
+	}
+}
+
+func (ins *middleware) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		s := &sizedServerStream{ServerStream: ss}
+		err := handler(srv, s)
+		ins.observe(info.FullMethod, start, err, s.received, s.sent)
+		return err
+	}
+}
+
+// sizedServerStream counts bytes of messages sent and received.
+type sizedServerStream struct {
+	grpc.ServerStream
+
+	sent, received int
+}
+
+func (s *sizedServerStream) SendMsg(m interface{}) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	s.sent += size(m)
+	return nil
+}
+
+func (s *sizedServerStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	s.received += size(m)
+	return nil
+}
+
+// size returns the wire size of m, or 0 if it's not a protobuf message, e.g. nil response of failed RPC.
+func size(m interface{}) int {
+	if pm, ok := m.(proto.Message); ok {
+		return proto.Size(pm)
+	}
+	return 0
+}
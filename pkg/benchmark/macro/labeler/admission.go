@@ -0,0 +1,135 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+)
+
+// tooManyRequestsError means labeling was not admitted, so client should retry later.
+type tooManyRequestsError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *tooManyRequestsError) Error() string { return "too many requests: " + e.reason }
+
+// setRetryAfter sets Retry-After header and returns true if err is tooManyRequestsError.
+func setRetryAfter(w http.ResponseWriter, err error) bool {
+	var tmr *tooManyRequestsError
+	if !errors.As(err, &tmr) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(tmr.retryAfter.Seconds()))))
+	return true
+}
+
+// admission runs labelObject4 on a fixed set of labelers, each reusing its own buffer, so memory used for buffers is
+// bounded by the number of workers. Requests above that wait in the bounded queue until a labeler is free, the
+// request is canceled or maxWait passes. Requests above the queue size are rejected immediately.
+type admission struct {
+	free       chan *labeler
+	queue      chan struct{}
+	maxWait    time.Duration
+	retryAfter time.Duration
+
+	queueDepth prometheus.Gauge
+	waitTime   prometheus.Histogram
+	rejected   *prometheus.CounterVec
+}
+
+func newAdmission(reg prometheus.Registerer, bkt objstore.BucketReader, budget *memoryBudget, workers, queueSize int, maxWait, retryAfter time.Duration) (*admission, error) {
+	if workers < 1 {
+		return nil, errors.Newf("number of workers has to be positive, got %v", workers)
+	}
+	if queueSize < 0 {
+		return nil, errors.Newf("queue size can't be negative, got %v", queueSize)
+	}
+	if maxWait <= 0 {
+		return nil, errors.Newf("maximum wait has to be positive, got %v", maxWait)
+	}
+	a := &admission{
+		free:       make(chan *labeler, workers),
+		queue:      make(chan struct{}, queueSize),
+		maxWait:    maxWait,
+		retryAfter: retryAfter,
+
+		queueDepth: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "labeler_admission_queue_depth",
+			Help: "Tracks the number of requests waiting for a free labeler.",
+		}),
+		waitTime: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "labeler_admission_wait_seconds",
+			Help:    "Tracks the time admitted requests waited for a free labeler.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		rejected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "labeler_admission_rejected_total",
+			Help: "Tracks the number of requests not admitted by the reason: queue_full or timeout.",
+		}, []string{"reason"}),
+	}
+	for i := 0; i < workers; i++ {
+		a.free <- &labeler{bkt: bkt, budget: budget}
+	}
+	return a, nil
+}
+
+// acquire returns free labeler, waiting for it in the queue if needed. Labeler has to be released after use.
+func (a *admission) acquire(ctx context.Context) (*labeler, error) {
+	start := time.Now()
+	select {
+	case l := <-a.free:
+		a.waitTime.Observe(0)
+		return l, nil
+	default:
+	}
+
+	select {
+	case a.queue <- struct{}{}:
+	default:
+		a.rejected.WithLabelValues("queue_full").Inc()
+		return nil, &tooManyRequestsError{reason: "admission queue is full", retryAfter: a.retryAfter}
+	}
+	a.queueDepth.Inc()
+	defer func() {
+		<-a.queue
+		a.queueDepth.Dec()
+	}()
+
+	timer := time.NewTimer(a.maxWait)
+	defer timer.Stop()
+
+	// Waiting receivers are served in order, so queued requests are admitted first come, first served.
+	select {
+	case l := <-a.free:
+		a.waitTime.Observe(time.Since(start).Seconds())
+		return l, nil
+	case <-timer.C:
+		a.rejected.WithLabelValues("timeout").Inc()
+		return nil, &tooManyRequestsError{reason: "no free labeler within " + a.maxWait.String(), retryAfter: a.retryAfter}
+	case <-ctx.Done():
+		return nil, errors.Wrap(ctx.Err(), "wait for free labeler")
+	}
+}
+
+func (a *admission) release(l *labeler) { a.free <- l }
+
+func (a *admission) labelObject(ctx context.Context, objID string) (label, error) {
+	l, err := a.acquire(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	defer a.release(l)
+
+	return l.labelObject4(ctx, objID)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+func TestAdmission(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+
+	a, err := newAdmission(prometheus.NewRegistry(), bkt, nil, 2, 1, time.Minute, 1500*time.Millisecond)
+	testutil.Ok(t, err)
+
+	lbl, err := a.labelObject(ctx, "a.txt")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(3), lbl.Sum)
+
+	l1, err := a.acquire(ctx)
+	testutil.Ok(t, err)
+	l2, err := a.acquire(ctx)
+	testutil.Ok(t, err)
+	testutil.Assert(t, l1 != l2)
+
+	// Third waits in the queue.
+	acquired := make(chan *labeler)
+	go func() {
+		l, err := a.acquire(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- l
+	}()
+	deadline := time.Now().Add(1 * time.Minute)
+	for promtestutil.ToFloat64(a.queueDepth) < 1 && time.Now().Before(deadline) {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// Fourth does not fit into the queue.
+	_, err = a.acquire(ctx)
+	testutil.NotOk(t, err)
+	w := httptest.NewRecorder()
+	testutil.Assert(t, setRetryAfter(w, errors.Wrap(err, "label")))
+	testutil.Equals(t, "2", w.Header().Get("Retry-After"))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(a.rejected.WithLabelValues("queue_full")))
+
+	// Released labeler goes to the queued request.
+	a.release(l1)
+	testutil.Equals(t, l1, <-acquired)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(a.queueDepth))
+
+	// Canceled request leaves the queue without labeler.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = a.acquire(cctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, !setRetryAfter(httptest.NewRecorder(), err))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(a.queueDepth))
+}
+
+func TestAdmission_Timeout(t *testing.T) {
+	a, err := newAdmission(prometheus.NewRegistry(), objstore.NewInMemBucket(), nil, 1, 10, 10*time.Millisecond, time.Second)
+	testutil.Ok(t, err)
+
+	l, err := a.acquire(context.Background())
+	testutil.Ok(t, err)
+	_, err = a.acquire(context.Background())
+	testutil.NotOk(t, err)
+	testutil.Assert(t, setRetryAfter(httptest.NewRecorder(), err))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(a.rejected.WithLabelValues("timeout")))
+
+	a.release(l)
+	_, err = a.acquire(context.Background())
+	testutil.Ok(t, err)
+}
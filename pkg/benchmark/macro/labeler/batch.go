@@ -0,0 +1,200 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/thanos-io/objstore"
+)
+
+// batchResult is a single line of the /label_objects response. It's the same as /label_object response, or
+// object_id with error and its code if labeling of this object failed.
+type batchResult struct {
+	*label
+	ObjID string    `json:"object_id,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Code  errorCode `json:"code,omitempty"`
+}
+
+// labelBatch labels objects from objIDs channel with up to concurrency labelFn calls at once and calls emit with
+// each result as soon as it completes, so in the completion order. Errors of labelFn are passed to emit, not returned.
+// Emit is never called concurrently and its error stops the batch.
+func labelBatch(ctx context.Context, labelFn labelFunc, objIDs <-chan string, concurrency int, emit func(batchResult) error) error {
+	if concurrency < 1 {
+		return errors.Newf("concurrency has to be positive, got %v", concurrency)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan batchResult)
+	wg := sync.WaitGroup{}
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			for {
+				var objID string
+				select {
+				case id, ok := <-objIDs:
+					if !ok {
+						return
+					}
+					objID = id
+				case <-ctx.Done():
+					return
+				}
+
+				res := batchResult{ObjID: objID}
+				if lbl, err := labelFn(ctx, objID); err != nil {
+					res.Error, res.Code = err.Error(), codeOf(err)
+				} else {
+					res.label = &lbl
+				}
+
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var emitErr error
+	for res := range results {
+		if emitErr != nil {
+			continue
+		}
+		if emitErr = emit(res); emitErr != nil {
+			// Stop workers, but wait for them, so labelFn is not called after we return.
+			cancel()
+		}
+	}
+	return emitErr
+}
+
+// listObjects sends IDs of all objects with the given prefix to objIDs while iterating, so labeling can start
+// before listing ends. Prefix does not need to end with a directory delimiter. Sidecars are skipped, as they are labels
+// written back by the labeler, not data.
+func listObjects(ctx context.Context, bkt objstore.BucketReader, prefix string, objIDs chan<- string) error {
+	dir := ""
+	if i := strings.LastIndex(prefix, objstore.DirDelim); i >= 0 {
+		dir = prefix[:i+1]
+	}
+	return bkt.Iter(ctx, dir, func(name string) error {
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, sidecarSuffix) {
+			return nil
+		}
+		select {
+		case objIDs <- name:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, objstore.WithRecursiveIter)
+}
+
+// labelObjectsWithPrefix labels objects given by ids and all objects with prefix, if not nil, with labelBatch. Listing
+// error is passed to emit as the last result, without object ID. Only emit error is returned.
+func labelObjectsWithPrefix(ctx context.Context, bkt objstore.BucketReader, labelFn labelFunc, ids []string, prefix *string, concurrency int, emit func(batchResult) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objIDs := make(chan string)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objIDs)
+
+		for _, id := range ids {
+			select {
+			case objIDs <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if prefix != nil {
+			listErr <- listObjects(ctx, bkt, *prefix, objIDs)
+		}
+	}()
+
+	if err := labelBatch(ctx, labelFn, objIDs, concurrency, emit); err != nil {
+		return err
+	}
+	if prefix == nil || ctx.Err() != nil {
+		return nil
+	}
+	// Workers finished without cancellation, so listing is done too.
+	if err := <-listErr; err != nil {
+		err = errors.Wrapf(bucketErr(bkt, err), "list prefix %q", *prefix)
+		return emit(batchResult{Error: err.Error(), Code: codeOf(err)})
+	}
+	return nil
+}
+
+// newBatchHandler returns handler of /label_objects. It labels objects given by `object_id` parameters and all objects
+// with `prefix` parameter, if given, using labelFn with bounded concurrency and stages selected by `stage` parameters.
+// `range_concurrency` parameter is like in newLabelHandler. Results are streamed back as NDJSON (one batchResult per
+// line) as each object completes. Errors of single objects, including listing error, are reported inline, without
+// failing the whole batch.
+func newBatchHandler(bkt objstore.BucketReader, labelFn labelFunc, concurrency int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
+		}
+
+		ids := r.Form["object_id"]
+		prefixes := r.Form["prefix"]
+		if len(ids) == 0 && len(prefixes) == 0 {
+			httpErrHandle(w, r, withCode(codeInvalidInput, errors.New("object_id or prefix parameter is required")))
+			return
+		}
+		if len(prefixes) > 1 {
+			httpErrHandle(w, r, withCode(codeInvalidInput, errors.New("only one prefix parameter is allowed")))
+			return
+		}
+		stageNames, err := parseStages(r.Form["stage"])
+		if err != nil {
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
+		}
+		ranges, err := parseRangeConcurrency(r.Form["range_concurrency"])
+		if err != nil {
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+
+		enc := json.NewEncoder(w)
+		var prefix *string
+		if len(prefixes) == 1 {
+			prefix = &prefixes[0]
+		}
+		// Error means client is gone or connection broken, nothing more to report.
+		_ = labelObjectsWithPrefix(withRangeConcurrency(withStages(r.Context(), stageNames), ranges), bkt, labelFn, ids, prefix, concurrency, func(res batchResult) error {
+			if err := enc.Encode(&res); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,219 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/objstore"
+)
+
+// batchResponseLine is a batchResult as seen by clients.
+type batchResponseLine struct {
+	ObjID      string                     `json:"object_id"`
+	Sum        int64                      `json:"sum"`
+	Attributes map[string]json.RawMessage `json:"attributes"`
+	Error      string                     `json:"error"`
+	Code       errorCode                  `json:"code"`
+}
+
+func labelObjects(t *testing.T, srvURL string, params url.Values) []batchResponseLine {
+	t.Helper()
+
+	res, err := http.PostForm(srvURL+"/label_objects", params)
+	testutil.Ok(t, err)
+	defer func() { _ = res.Body.Close() }()
+	testutil.Equals(t, http.StatusOK, res.StatusCode)
+	testutil.Equals(t, "application/x-ndjson; charset=utf-8", res.Header.Get("Content-Type"))
+
+	var results []batchResponseLine
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		r := batchResponseLine{}
+		testutil.Ok(t, json.Unmarshal(s.Bytes(), &r), s.Text())
+		results = append(results, r)
+	}
+	testutil.Ok(t, s.Err())
+
+	sort.Slice(results, func(i, j int) bool { return results[i].ObjID < results[j].ObjID })
+	return results
+}
+
+func TestLabelObjects(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	for name, content := range map[string]string{
+		"a/1.txt":     "1\n2\n",
+		"a/2.txt":     "3\n4\n",
+		"a/20.txt":    "5\n",
+		"a/bad.txt":   "6\n",
+		"a/b/3.txt":   "-7\n",
+		"b/4.txt":     "8\n",
+		"other/5.txt": "9\n",
+	} {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader(content)))
+	}
+
+	l := &labeler{bkt: bkt}
+	labelFn := func(ctx context.Context, objID string) (label, error) {
+		if objID == "a/bad.txt" {
+			return label{}, errors.New("injected error")
+		}
+		return l.labelObject1(ctx, objID)
+	}
+	srv := httptest.NewServer(newBatchHandler(bkt, labelFn, 2))
+	t.Cleanup(srv.Close)
+
+	t.Run("object IDs", func(t *testing.T) {
+		testutil.Equals(t, []batchResponseLine{
+			{ObjID: "a/1.txt", Sum: 3},
+			{ObjID: "a/missing.txt", Error: "inmem: object not found", Code: codeNotFound},
+			{ObjID: "b/4.txt", Sum: 8},
+		}, labelObjects(t, srv.URL, url.Values{"object_id": {"b/4.txt", "a/missing.txt", "a/1.txt"}}))
+	})
+	t.Run("prefix", func(t *testing.T) {
+		testutil.Equals(t, []batchResponseLine{
+			{ObjID: "a/1.txt", Sum: 3},
+			{ObjID: "a/2.txt", Sum: 7},
+			{ObjID: "a/20.txt", Sum: 5},
+			{ObjID: "a/b/3.txt", Sum: -7},
+			{ObjID: "a/bad.txt", Error: "injected error", Code: codeInternal},
+		}, labelObjects(t, srv.URL, url.Values{"prefix": {"a/"}}))
+
+		// Prefix does not have to be a directory.
+		testutil.Equals(t, []batchResponseLine{
+			{ObjID: "a/2.txt", Sum: 7},
+			{ObjID: "a/20.txt", Sum: 5},
+			{ObjID: "b/4.txt", Sum: 8},
+		}, labelObjects(t, srv.URL, url.Values{"prefix": {"a/2"}, "object_id": {"b/4.txt"}}))
+
+		testutil.Equals(t, 0, len(labelObjects(t, srv.URL, url.Values{"prefix": {"c/"}})))
+	})
+	t.Run("invalid request", func(t *testing.T) {
+		for _, params := range []url.Values{{}, {"prefix": {"a/", "b/"}}} {
+			res, err := http.PostForm(srv.URL+"/label_objects", params)
+			testutil.Ok(t, err)
+			testutil.Ok(t, res.Body.Close())
+			testutil.Equals(t, http.StatusBadRequest, res.StatusCode)
+		}
+	})
+}
+
+func TestLabelObjects_Sidecars(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a/1.txt", strings.NewReader("1\n2\n")))
+	testutil.Ok(t, bkt.Upload(ctx, "a/2.txt", strings.NewReader("3\n")))
+
+	l := &labeler{bkt: bkt}
+	labelFn := newSidecars(log.NewNopLogger(), prometheus.NewRegistry(), bkt).wrap(l.labelObject1)
+	srv := httptest.NewServer(newBatchHandler(bkt, labelFn, 2))
+	t.Cleanup(srv.Close)
+
+	// Sidecars written back by the first request are not listed as objects by the next ones.
+	for i := 0; i < 2; i++ {
+		testutil.Equals(t, []batchResponseLine{
+			{ObjID: "a/1.txt", Sum: 3},
+			{ObjID: "a/2.txt", Sum: 3},
+		}, labelObjects(t, srv.URL, url.Values{"prefix": {"a/"}}))
+	}
+	exists, err := bkt.Exists(ctx, "a/1.txt"+sidecarSuffix)
+	testutil.Ok(t, err)
+	testutil.Assert(t, exists)
+
+	// Only listing skips sidecars, explicit object IDs are labeled (JSON is not a valid sum input) like any object.
+	res := labelObjects(t, srv.URL, url.Values{"object_id": {"a/1.txt" + sidecarSuffix}})
+	testutil.Equals(t, 1, len(res))
+	testutil.Equals(t, "a/1.txt"+sidecarSuffix, res[0].ObjID)
+	testutil.Equals(t, codeParseError, res[0].Code)
+}
+
+func TestLabelBatch(t *testing.T) {
+	const concurrency = 3
+
+	var (
+		mtx                   sync.Mutex
+		inFlight, maxInFlight int
+		release               = make(chan struct{})
+	)
+	labelFn := func(ctx context.Context, objID string) (label, error) {
+		mtx.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mtx.Unlock()
+		defer func() {
+			mtx.Lock()
+			inFlight--
+			mtx.Unlock()
+		}()
+
+		if objID == "slow" {
+			select {
+			case <-release:
+			case <-time.After(1 * time.Minute):
+				return label{}, errors.New("not released")
+			}
+		}
+		return label{ObjID: objID, Sum: 1}, nil
+	}
+
+	objIDs := make(chan string)
+	go func() {
+		defer close(objIDs)
+		objIDs <- "slow"
+		for i := 0; i < 100; i++ {
+			objIDs <- "fast"
+		}
+	}()
+
+	var emitted int
+	testutil.Ok(t, labelBatch(context.Background(), labelFn, objIDs, concurrency, func(res batchResult) error {
+		testutil.Equals(t, "", res.Error)
+		if emitted++; emitted == 100 {
+			// All fast objects are streamed while the slow one is still in progress.
+			testutil.Equals(t, "fast", res.ObjID)
+			close(release)
+		}
+		return nil
+	}))
+	testutil.Equals(t, 101, emitted)
+	testutil.Assert(t, maxInFlight <= concurrency, "expected at most %v labelFn calls at once, got %v", concurrency, maxInFlight)
+
+	t.Run("emit error stops the batch", func(t *testing.T) {
+		objIDs := make(chan string)
+		go func() {
+			defer close(objIDs)
+			for i := 0; i < 100; i++ {
+				select {
+				case objIDs <- "fast":
+				case <-time.After(100 * time.Millisecond):
+					// Workers are not reading anymore.
+					return
+				}
+			}
+		}()
+
+		err := labelBatch(context.Background(), labelFn, objIDs, concurrency, func(batchResult) error {
+			return errors.New("client gone")
+		})
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "client gone", err.Error())
+	})
+}
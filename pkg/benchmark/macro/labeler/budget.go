@@ -0,0 +1,129 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// minBufferSize is the smallest buffer memoryBudget shrinks reservations to. Pipeline works with any buffer size, but
+// smaller buffers mean more reads.
+const minBufferSize = 4 * 1024
+
+// memoryBudget limits the total size of buffers used by all labeling requests at once. Requests get the buffer size
+// they want if it fits into the budget, otherwise smaller one which fits, or they wait until at least minBufferSize
+// is free.
+type memoryBudget struct {
+	limit int
+
+	mtx  sync.Mutex
+	used int
+	// released is closed and replaced on each release, waking up waiting requests.
+	released chan struct{}
+
+	usedBytes prometheus.Gauge
+	waiting   prometheus.Gauge
+}
+
+func newMemoryBudget(reg prometheus.Registerer, limit int) (*memoryBudget, error) {
+	if limit < minBufferSize {
+		return nil, errors.Newf("memory budget has to be at least %v bytes, got %v", minBufferSize, limit)
+	}
+	b := &memoryBudget{
+		limit:    limit,
+		released: make(chan struct{}),
+
+		usedBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "labeler_memory_budget_used_bytes",
+			Help: "Tracks the number of bytes of labeling buffers currently in use.",
+		}),
+		waiting: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "labeler_memory_budget_waiting_requests",
+			Help: "Tracks the number of requests waiting for the memory budget.",
+		}),
+	}
+	promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Name: "labeler_memory_budget_limit_bytes",
+		Help: "Maximum number of bytes of labeling buffers in use at once.",
+	}).Set(float64(limit))
+	return b, nil
+}
+
+// reserve returns up to want bytes reserved for the buffer, at least minBufferSize, unless want is smaller. It waits
+// until enough is free or ctx is done. Reservation has to be released with release.
+func (b *memoryBudget) reserve(ctx context.Context, want int) (int, error) {
+	needed := want
+	if needed > minBufferSize {
+		needed = minBufferSize
+	}
+
+	b.mtx.Lock()
+	for waiting := false; ; {
+		if free := b.limit - b.used; free >= needed {
+			n := want
+			if n > free {
+				n = free
+			}
+			b.used += n
+			b.usedBytes.Set(float64(b.used))
+			b.mtx.Unlock()
+
+			if waiting {
+				b.waiting.Dec()
+			}
+			return n, nil
+		}
+		released := b.released
+		b.mtx.Unlock()
+
+		if !waiting {
+			waiting = true
+			b.waiting.Inc()
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			b.waiting.Dec()
+			return 0, errors.Wrap(ctx.Err(), "wait for memory budget")
+		}
+		b.mtx.Lock()
+	}
+}
+
+func (b *memoryBudget) release(n int) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.used -= n
+	b.usedBytes.Set(float64(b.used))
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// reserve returns buffer size up to want, within the memory budget if set, see memoryBudget.reserve. Returned
+// function releases the reservation, once buffer is not used.
+func (l *labeler) reserve(ctx context.Context, want int) (size int, release func(), _ error) {
+	if l.budget == nil {
+		return want, func() {}, nil
+	}
+	n, err := l.budget.reserve(ctx, want)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, func() { l.budget.release(n) }, nil
+}
+
+// fitBuffer returns buf sliced to size, or new buffer if buf is too small. If budget shrank the size below wanted,
+// bigger (e.g. pooled) buf is not used either, so memory held by requests stays within the budget.
+func fitBuffer(buf []byte, size, wanted int) []byte {
+	if cap(buf) < size || (size < wanted && cap(buf) > size) {
+		return make([]byte, size)
+	}
+	return buf[:size]
+}
@@ -0,0 +1,209 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/efficientgo/examples/pkg/sum/sumtestutil"
+	"github.com/gobwas/pool/pbytes"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	ctx := context.Background()
+	b, err := newMemoryBudget(prometheus.NewRegistry(), 16*1024)
+	testutil.Ok(t, err)
+
+	n1, err := b.reserve(ctx, 10*1024)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 10*1024, n1)
+
+	// Shrinks to fit.
+	n2, err := b.reserve(ctx, 10*1024)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 6*1024, n2)
+	testutil.Equals(t, 16*1024.0, promtestutil.ToFloat64(b.usedBytes))
+
+	// Nothing left, waits until canceled.
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = b.reserve(tctx, 10*1024)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(b.waiting))
+
+	// Less than minBufferSize is left, it's enough only for small buffers.
+	b.release(n2)
+	n3, err := b.reserve(ctx, 3*1024)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3*1024, n3)
+
+	// ...others wait until enough is released.
+	reserved := make(chan int)
+	go func() {
+		n, err := b.reserve(ctx, 10*1024)
+		if err != nil {
+			t.Error(err)
+		}
+		reserved <- n
+	}()
+	deadline := time.Now().Add(1 * time.Minute)
+	for promtestutil.ToFloat64(b.waiting) < 1 && time.Now().Before(deadline) {
+		time.Sleep(1 * time.Millisecond)
+	}
+	b.release(n1)
+	testutil.Equals(t, 10*1024, <-reserved)
+	testutil.Equals(t, 13*1024.0, promtestutil.ToFloat64(b.usedBytes))
+
+	_, err = newMemoryBudget(prometheus.NewRegistry(), minBufferSize-1)
+	testutil.NotOk(t, err)
+}
+
+func TestLabeler_MemoryBudget(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	buf := bytes.Buffer{}
+	exp, err := sumtestutil.CreateTestInputWithExpectedResult(&buf, 2e6)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, "2M.txt", &buf))
+
+	// Budget smaller than buffers any strategy wants.
+	budget, err := newMemoryBudget(prometheus.NewRegistry(), minBufferSize)
+	testutil.Ok(t, err)
+	l := &labeler{bkt: bkt, budget: budget, tmpDir: t.TempDir(), ranges: 4}
+	l.pool.New = func() any { return []byte(nil) }
+	l.bucketedPool = pbytes.New(1e3, 10e6)
+
+	for name, labelFn := range map[string]labelFunc{
+		"labelObjectNaive": l.labelObjectNaive,
+		"labelObject1":     l.labelObject1,
+		"labelObject2":     l.labelObject2,
+		"labelObject3":     l.labelObject3,
+		"labelObject4":     l.labelObject4,
+		"labelObject5":     l.labelObject5,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ret, err := labelFn(ctx, "2M.txt")
+			testutil.Ok(t, err)
+			testutil.Equals(t, exp, ret.Sum)
+			testutil.Equals(t, 0.0, promtestutil.ToFloat64(budget.usedBytes))
+		})
+	}
+	// Buffer released from the budget is not held by the labeler either.
+	testutil.Equals(t, 0, cap(l.buf))
+}
+
+// generatedBucket has objects of the given size with content generated while reading, so big objects do not take
+// memory.
+type generatedBucket struct {
+	objstore.Bucket
+	size int64
+}
+
+func (b generatedBucket) Attributes(context.Context, string) (objstore.ObjectAttributes, error) {
+	return objstore.ObjectAttributes{Size: b.size, LastModified: time.Now()}, nil
+}
+
+func (b generatedBucket) Get(context.Context, string) (io.ReadCloser, error) {
+	return io.NopCloser(io.LimitReader(repeatedReader("1234567\n"), b.size)), nil
+}
+
+type repeatedReader string
+
+func (r repeatedReader) Read(p []byte) (int, error) {
+	for i := 0; i < len(p); i += copy(p[i:], r) {
+	}
+	return len(p), nil
+}
+
+// rss returns resident set size of the process in bytes.
+func rss() (int, error) {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	pages, err := strconv.Atoi(strings.Fields(string(b))[1])
+	if err != nil {
+		return 0, err
+	}
+	return pages * os.Getpagesize(), nil
+}
+
+func TestMemoryBudget_ParallelLoad(t *testing.T) {
+	const (
+		requests = 64
+		// Each request wants 1MiB buffer, so 64MiB in total without the budget.
+		objSize = 64 * 1024 * 1024
+		limit   = 4 * 1024 * 1024
+	)
+
+	budget, err := newMemoryBudget(prometheus.NewRegistry(), limit)
+	testutil.Ok(t, err)
+	l := &labeler{bkt: generatedBucket{Bucket: objstore.NewInMemBucket(), size: objSize}, budget: budget}
+	// Fast stage, so the test is about buffers, not parsing.
+	ctx := withStages(context.Background(), []string{"crc32c"})
+
+	runtime.GC()
+	debug.FreeOSMemory()
+	baseline, err := rss()
+	if err != nil {
+		t.Skip("RSS not available on this platform:", err)
+	}
+
+	var (
+		maxRSS, maxUsed int
+		done            = make(chan struct{})
+		sampled         = make(chan struct{})
+	)
+	go func() {
+		defer close(sampled)
+		for {
+			if r, _ := rss(); r > maxRSS {
+				maxRSS = r
+			}
+			if u := int(promtestutil.ToFloat64(budget.usedBytes)); u > maxUsed {
+				maxUsed = u
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(1 * time.Millisecond):
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	wg.Add(requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			defer wg.Done()
+
+			if _, err := l.labelObject1(ctx, "obj"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-sampled
+
+	t.Logf("baseline RSS %v, max RSS %v, max budget used %v", baseline, maxRSS, maxUsed)
+	testutil.Assert(t, maxUsed <= limit, "budget used %v above limit %v", maxUsed, limit)
+	// Buffers are garbage collected, so RSS can have few budgets worth of them, but not all 64MiB.
+	testutil.Assert(t, maxRSS-baseline < 8*limit, "RSS grew by %v", maxRSS-baseline)
+}
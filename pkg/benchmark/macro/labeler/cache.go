@@ -0,0 +1,394 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/sync/singleflight"
+)
+
+// labelCacheKey identifies the content of the object: the object ID with its size and modification time, and the
+// stages computing the label. Change of the object changes the key, so cached labels are never stale. Labels of old
+// versions are evicted eventually.
+func labelCacheKey(objID string, a objstore.ObjectAttributes, stages []string) string {
+	return objID + "\x00" + strconv.FormatInt(a.Size, 10) + "\x00" + strconv.FormatInt(a.LastModified.UnixNano(), 10) +
+		"\x00" + strings.Join(stages, ",")
+}
+
+// labelStore stores cached labels. labelCache decides what and when to store or remove, so stores do not evict
+// anything on their own.
+type labelStore interface {
+	load(key string) (label, bool, error)
+	store(key string, lbl label) error
+	remove(key string) error
+}
+
+// memLabelStore keeps labels on the heap.
+type memLabelStore struct {
+	mtx    sync.RWMutex
+	labels map[string]label
+}
+
+func newMemLabelStore() *memLabelStore { return &memLabelStore{labels: map[string]label{}} }
+
+func (s *memLabelStore) load(key string) (label, bool, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	lbl, ok := s.labels[key]
+	return lbl, ok, nil
+}
+
+func (s *memLabelStore) store(key string, lbl label) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.labels[key] = lbl
+	return nil
+}
+
+func (s *memLabelStore) remove(key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.labels, key)
+	return nil
+}
+
+// diskLabelStore keeps each label in a JSON file in the directory, so cache survives restarts and can be bigger
+// than memory.
+type diskLabelStore struct {
+	dir string
+}
+
+type diskLabel struct {
+	Key   string `json:"key"`
+	Label label  `json:"label"`
+}
+
+func newDiskLabelStore(dir string) (*diskLabelStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &diskLabelStore{dir: dir}, nil
+}
+
+func (s *diskLabelStore) path(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(h[:])+".json")
+}
+
+func (s *diskLabelStore) load(key string) (label, bool, error) {
+	b, err := os.ReadFile(s.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return label{}, false, nil
+		}
+		return label{}, false, err
+	}
+	d := diskLabel{}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return label{}, false, errors.Wrapf(err, "parse cached label %v", s.path(key))
+	}
+	if d.Key != key {
+		// Hash collision.
+		return label{}, false, nil
+	}
+	return d.Label, true, nil
+}
+
+func (s *diskLabelStore) store(key string, lbl label) error {
+	b, err := json.Marshal(diskLabel{Key: key, Label: lbl})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.dir, s.path(key), b)
+}
+
+// writeFileAtomically writes b to the temporary file in dir and renames it to path, so concurrent reads never see
+// partial file.
+func writeFileAtomically(dir, path string, b []byte) (err error) {
+	tmp, err := os.CreateTemp(dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(b); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *diskLabelStore) remove(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// stored returns keys of all labels in the directory with their modification times, from the oldest. Leftovers of
+// interrupted writes are removed.
+func (s *diskLabelStore) stored() (keys []string, modified []time.Time, _ error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type stored struct {
+		key      string
+		modified time.Time
+	}
+	var all []stored
+	for _, e := range entries {
+		p := filepath.Join(s.dir, e.Name())
+		if strings.HasPrefix(e.Name(), "tmp-") {
+			_ = os.Remove(p)
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		d := diskLabel{}
+		if err := json.Unmarshal(b, &d); err != nil {
+			// Not ours or corrupted, it's only a cache.
+			_ = os.Remove(p)
+			continue
+		}
+		all = append(all, stored{key: d.Key, modified: info.ModTime()})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].modified.Before(all[j].modified) })
+	for _, st := range all {
+		keys = append(keys, st.key)
+		modified = append(modified, st.modified)
+	}
+	return keys, modified, nil
+}
+
+// labelCache is LRU cache of labels with TTL in front of labelFunc. Concurrent requests for the same object are
+// deduplicated, so it's labeled only once.
+type labelCache struct {
+	logger log.Logger
+	store  labelStore
+	size   int
+	ttl    time.Duration
+	now    func() time.Time
+
+	mtx sync.Mutex
+	// lru has the most recently used entry at the front.
+	lru     *list.List
+	entries map[string]*list.Element
+
+	group singleflight.Group
+
+	hits, misses, deduplicated, storeFailures prometheus.Counter
+	evictions                                 *prometheus.CounterVec
+}
+
+type labelCacheEntry struct {
+	key     string
+	expires time.Time
+}
+
+// newLabelCache returns cache of up to size labels, each cached up to ttl. Labels already in diskLabelStore are
+// cached again with TTL counted from their modification time.
+func newLabelCache(logger log.Logger, reg prometheus.Registerer, store labelStore, size int, ttl time.Duration) (*labelCache, error) {
+	if size < 1 {
+		return nil, errors.Newf("cache size has to be positive, got %v", size)
+	}
+	if ttl <= 0 {
+		return nil, errors.Newf("cache TTL has to be positive, got %v", ttl)
+	}
+	c := &labelCache{
+		logger:  logger,
+		store:   store,
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+
+		hits: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_cache_hits_total",
+			Help: "Tracks the number of labels served from the cache.",
+		}),
+		misses: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_cache_misses_total",
+			Help: "Tracks the number of labels computed, because they were not in the cache.",
+		}),
+		deduplicated: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_cache_deduplicated_total",
+			Help: "Tracks the number of requests which waited for the same object labeled by another request.",
+		}),
+		storeFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_cache_store_failures_total",
+			Help: "Tracks the number of computed labels which failed to be cached. They are still returned.",
+		}),
+		evictions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "labeler_cache_evictions_total",
+			Help: "Tracks the number of labels removed from the cache by the reason: size or ttl.",
+		}, []string{"reason"}),
+	}
+
+	if d, ok := store.(*diskLabelStore); ok {
+		keys, modified, err := d.stored()
+		if err != nil {
+			return nil, errors.Wrap(err, "load cached labels")
+		}
+		for i, key := range keys {
+			if err := c.add(key, modified[i].Add(ttl)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// add tracks key in the LRU, evicting the least recently used entries above the size.
+func (c *labelCache) add(key string, expires time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*labelCacheEntry).expires = expires
+		c.lru.MoveToFront(el)
+		return nil
+	}
+	c.entries[key] = c.lru.PushFront(&labelCacheEntry{key: key, expires: expires})
+
+	for c.lru.Len() > c.size {
+		if err := c.removeLocked(c.lru.Back(), "size"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *labelCache) removeLocked(el *list.Element, reason string) error {
+	e := c.lru.Remove(el).(*labelCacheEntry)
+	delete(c.entries, e.key)
+	c.evictions.WithLabelValues(reason).Inc()
+	return c.store.remove(e.key)
+}
+
+func (c *labelCache) get(key string) (label, bool, error) {
+	c.mtx.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mtx.Unlock()
+		return label{}, false, nil
+	}
+	if c.now().After(el.Value.(*labelCacheEntry).expires) {
+		err := c.removeLocked(el, "ttl")
+		c.mtx.Unlock()
+		return label{}, false, err
+	}
+	c.lru.MoveToFront(el)
+	c.mtx.Unlock()
+
+	return c.store.load(key)
+}
+
+func (c *labelCache) set(key string, lbl label) error {
+	if err := c.store.store(key, lbl); err != nil {
+		return err
+	}
+	return c.add(key, c.now().Add(c.ttl))
+}
+
+// detachedContext has values of the parent context, but it's never canceled, so work shared by many requests does
+// not fail when the request which started it is canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// wrap returns labelFn which labels objects only if they are not in the cache. Errors are not cached. Requests
+// waiting for the same object share the result of the first one. It's labeled with the context detached from the
+// first request, so it's not canceled with it, while each request stops waiting once its own context is done.
+func (c *labelCache) wrap(bkt objstore.BucketReader, labelFn labelFunc) labelFunc {
+	return func(ctx context.Context, objID string) (label, error) {
+		a, err := bkt.Attributes(ctx, objID)
+		if err != nil {
+			return label{}, bucketErr(bkt, err)
+		}
+		key := labelCacheKey(objID, a, stagesFromContext(ctx))
+
+		if lbl, ok, err := c.get(key); err != nil {
+			return label{}, errors.Wrap(err, "get cached label")
+		} else if ok {
+			c.hits.Inc()
+			return lbl, nil
+		}
+
+		// Set only if this request's function is called, which happens before its result is received.
+		leader := false
+		ch := c.group.DoChan(key, func() (interface{}, error) {
+			leader = true
+			// Another request could label it between get and DoChan.
+			if lbl, ok, err := c.get(key); err == nil && ok {
+				c.hits.Inc()
+				return lbl, nil
+			}
+
+			c.misses.Inc()
+			lbl, err := labelFn(detachedContext{parent: ctx}, objID)
+			if err != nil {
+				return label{}, err
+			}
+			if err := c.set(key, lbl); err != nil {
+				// Label is correct, only the next request will have to label it again.
+				c.storeFailures.Inc()
+				level.Warn(c.logger).Log("msg", "failed to cache label", "object_id", objID, "err", err)
+			}
+			return lbl, nil
+		})
+		select {
+		case <-ctx.Done():
+			return label{}, ctx.Err()
+		case res := <-ch:
+			if res.Shared && !leader {
+				c.deduplicated.Inc()
+			}
+			return res.Val.(label), res.Err
+		}
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+func testLabelStores(t *testing.T) map[string]func() labelStore {
+	dir := t.TempDir()
+	return map[string]func() labelStore{
+		"memory": func() labelStore { return newMemLabelStore() },
+		"disk": func() labelStore {
+			s, err := newDiskLabelStore(dir)
+			testutil.Ok(t, err)
+			return s
+		},
+	}
+}
+
+func TestLabelCache_Evictions(t *testing.T) {
+	for name, newStore := range testLabelStores(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			c, err := newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), newStore(), 2, time.Minute)
+			testutil.Ok(t, err)
+			c.now = func() time.Time { return now }
+
+			for _, key := range []string{"a", "b", "c"} {
+				testutil.Ok(t, c.set(key, label{ObjID: key}))
+				if key == "b" {
+					// Touch a, so b is the least recently used.
+					_, ok, err := c.get("a")
+					testutil.Ok(t, err)
+					testutil.Assert(t, ok)
+				}
+			}
+			for key, exp := range map[string]bool{"a": true, "b": false, "c": true} {
+				lbl, ok, err := c.get(key)
+				testutil.Ok(t, err)
+				testutil.Equals(t, exp, ok, key)
+				if exp {
+					testutil.Equals(t, key, lbl.ObjID)
+				}
+				// Removed from the store too.
+				_, ok, err = c.store.load(key)
+				testutil.Ok(t, err)
+				testutil.Equals(t, exp, ok, key)
+			}
+			testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.evictions.WithLabelValues("size")))
+
+			now = now.Add(2 * time.Minute)
+			_, ok, err := c.get("a")
+			testutil.Ok(t, err)
+			testutil.Assert(t, !ok)
+			testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.evictions.WithLabelValues("ttl")))
+			_, ok, err = c.store.load("a")
+			testutil.Ok(t, err)
+			testutil.Assert(t, !ok)
+		})
+	}
+}
+
+func TestLabelCache_DiskRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newDiskLabelStore(dir)
+	testutil.Ok(t, err)
+	c, err := newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), s, 10, time.Hour)
+	testutil.Ok(t, err)
+
+	for i, key := range []string{"a", "b", "c"} {
+		testutil.Ok(t, c.set(key, label{ObjID: key, Sum: int64(i)}))
+		// Modification time orders LRU after restart.
+		mtime := time.Now().Add(time.Duration(i-10) * time.Second)
+		testutil.Ok(t, os.Chtimes(s.path(key), mtime, mtime))
+	}
+	// Leftover of interrupted write.
+	testutil.Ok(t, os.WriteFile(dir+"/tmp-123", []byte("{"), os.ModePerm))
+
+	// Smaller cache after restart keeps the most recent labels.
+	c, err = newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), s, 2, time.Hour)
+	testutil.Ok(t, err)
+	for key, exp := range map[string]bool{"a": false, "b": true, "c": true} {
+		lbl, ok, err := c.get(key)
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, ok, key)
+		if exp {
+			testutil.Equals(t, key, lbl.ObjID)
+		}
+	}
+	files, err := os.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(files))
+}
+
+func TestLabelCache_Wrap(t *testing.T) {
+	ctx := context.Background()
+
+	for name, newStore := range testLabelStores(t) {
+		t.Run(name, func(t *testing.T) {
+			bkt := objstore.NewInMemBucket()
+			testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+			testutil.Ok(t, bkt.Upload(ctx, "b.txt", strings.NewReader("3\n")))
+
+			var calls atomic.Int64
+			failNext := atomic.Bool{}
+			l := &labeler{bkt: bkt}
+			c, err := newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), newStore(), 10, time.Hour)
+			testutil.Ok(t, err)
+			labelFn := c.wrap(bkt, func(ctx context.Context, objID string) (label, error) {
+				calls.Add(1)
+				if failNext.CompareAndSwap(true, false) {
+					return label{}, errors.New("injected error")
+				}
+				return l.labelObject1(ctx, objID)
+			})
+
+			for i := 0; i < 3; i++ {
+				lbl, err := labelFn(ctx, "a.txt")
+				testutil.Ok(t, err)
+				testutil.Equals(t, int64(3), lbl.Sum)
+			}
+			testutil.Equals(t, int64(1), calls.Load())
+			testutil.Equals(t, 2.0, promtestutil.ToFloat64(c.hits))
+			testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.misses))
+
+			// Errors are not cached.
+			failNext.Store(true)
+			_, err = labelFn(ctx, "b.txt")
+			testutil.NotOk(t, err)
+			lbl, err := labelFn(ctx, "b.txt")
+			testutil.Ok(t, err)
+			testutil.Equals(t, int64(3), lbl.Sum)
+			testutil.Equals(t, int64(3), calls.Load())
+
+			// Changed object is labeled again.
+			testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n3\n")))
+			lbl, err = labelFn(ctx, "a.txt")
+			testutil.Ok(t, err)
+			testutil.Equals(t, int64(6), lbl.Sum)
+			testutil.Equals(t, int64(4), calls.Load())
+
+			_, err = labelFn(ctx, "missing.txt")
+			testutil.NotOk(t, err)
+			testutil.Equals(t, int64(4), calls.Load())
+		})
+	}
+}
+
+func TestLabelCache_Singleflight(t *testing.T) {
+	const requests = 10
+
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+
+	c, err := newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), newMemLabelStore(), 10, time.Hour)
+	testutil.Ok(t, err)
+
+	var calls atomic.Int64
+	release := make(chan struct{})
+	labelFn := c.wrap(bkt, func(ctx context.Context, objID string) (label, error) {
+		calls.Add(1)
+		<-release
+		return label{ObjID: objID, Sum: 3}, nil
+	})
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lbl, err := labelFn(ctx, "a.txt")
+			if err == nil && lbl.Sum != 3 {
+				err = errors.Newf("unexpected sum %v", lbl.Sum)
+			}
+			errs <- err
+		}()
+	}
+
+	// Wait for all requests to be in flight, either labeling or waiting for the labeling one.
+	deadline := time.Now().Add(1 * time.Minute)
+	for promtestutil.ToFloat64(c.misses) < 1 && time.Now().Before(deadline) {
+		time.Sleep(1 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, int64(1), calls.Load())
+	testutil.Equals(t, float64(requests), promtestutil.ToFloat64(c.hits)+promtestutil.ToFloat64(c.misses)+promtestutil.ToFloat64(c.deduplicated))
+}
+
+func TestLabelCache_CanceledRequest(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+
+	c, err := newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), newMemLabelStore(), 10, time.Hour)
+	testutil.Ok(t, err)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	labelFn := c.wrap(bkt, func(ctx context.Context, objID string) (label, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			return label{}, ctx.Err()
+		case <-release:
+		}
+		return label{ObjID: objID, Sum: 3}, nil
+	})
+
+	// Request which started labeling is canceled, but the waiting one still gets the label.
+	cctx, cancel := context.WithCancel(ctx)
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := labelFn(cctx, "a.txt")
+		canceled <- err
+	}()
+	<-started
+
+	waiting := make(chan error, 1)
+	go func() {
+		lbl, err := labelFn(ctx, "a.txt")
+		if err == nil && lbl.Sum != 3 {
+			err = errors.Newf("unexpected sum %v", lbl.Sum)
+		}
+		waiting <- err
+	}()
+
+	cancel()
+	testutil.Assert(t, errors.Is(<-canceled, context.Canceled))
+	close(release)
+	testutil.Ok(t, <-waiting)
+
+	// Waiting request stops waiting once its own context is done.
+	wctx, wcancel := context.WithCancel(ctx)
+	wcancel()
+	_, err = c.wrap(bkt, func(ctx context.Context, objID string) (label, error) {
+		<-ctx.Done()
+		return label{}, ctx.Err()
+	})(wctx, "b.txt")
+	testutil.NotOk(t, err)
+}
+
+// failingLabelStore fails to store labels.
+type failingLabelStore struct{ *memLabelStore }
+
+func (failingLabelStore) store(string, label) error { return errors.New("injected error") }
+
+func TestLabelCache_StoreFailure(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+
+	c, err := newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), failingLabelStore{newMemLabelStore()}, 10, time.Hour)
+	testutil.Ok(t, err)
+	l := &labeler{bkt: bkt}
+	labelFn := c.wrap(bkt, l.labelObject1)
+
+	// Label is returned, just not cached.
+	for i := 0; i < 2; i++ {
+		lbl, err := labelFn(ctx, "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(3), lbl.Sum)
+	}
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(c.storeFailures))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(c.misses))
+}
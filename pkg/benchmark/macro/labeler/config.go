@@ -0,0 +1,203 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the labeler configuration. Values from flags are defaults, overridden by the -config.file YAML, if set.
+// Everything except listen addresses, TLS enablement and crawling can be changed by reload.
+type config struct {
+	ListenAddress string `yaml:"listen_address"`
+	// GRPCListenAddress is the address of the gRPC API, it's disabled if empty.
+	GRPCListenAddress string `yaml:"grpc_listen_address"`
+	// Objstore is the bucket configuration, see github.com/thanos-io/objstore/client.BucketConfig.
+	Objstore  yaml.Node       `yaml:"objstore"`
+	Function  string          `yaml:"function"`
+	Stages    []string        `yaml:"stages"`
+	Pools     poolsConfig     `yaml:"pools"`
+	Batch     batchConfig     `yaml:"batch"`
+	Ranges    rangesConfig    `yaml:"ranges"`
+	Resume    resumeConfig    `yaml:"resume"`
+	Admission admissionConfig `yaml:"admission"`
+	// MemoryBudget is the maximum number of bytes of buffers used by all labeling requests at once, 0 means no limit.
+	MemoryBudget int         `yaml:"memory_budget"`
+	Cache        cacheConfig `yaml:"cache"`
+	// WriteBack enables upload of labels as <objID>.label.json sidecars next to objects, served instead of labeling
+	// again while valid.
+	WriteBack bool         `yaml:"write_back"`
+	Upload    uploadConfig `yaml:"upload"`
+	Crawl     crawlConfig  `yaml:"crawl"`
+	TLS       tlsConfig    `yaml:"tls"`
+	// ShutdownTimeout is the maximum time in-flight requests are waited for on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type poolsConfig struct {
+	// Bucketed pool of labelObject3 has buckets of buffers from min to max size.
+	BucketedMinSize int `yaml:"bucketed_min_size"`
+	BucketedMaxSize int `yaml:"bucketed_max_size"`
+}
+
+type batchConfig struct {
+	Concurrency int `yaml:"concurrency"`
+}
+
+type rangesConfig struct {
+	// Concurrency is the number of ranges labelObject5 sums at once, unless request selects it.
+	Concurrency    int `yaml:"concurrency"`
+	MaxConcurrency int `yaml:"max_concurrency"`
+}
+
+type resumeConfig struct {
+	// CheckpointInterval is the number of bytes labelObject6 labels between checkpoints.
+	CheckpointInterval int64 `yaml:"checkpoint_interval"`
+	// Dir persists checkpoints, if not empty.
+	Dir        string        `yaml:"dir"`
+	MaxRetries int           `yaml:"max_retries"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+type admissionConfig struct {
+	Workers    int           `yaml:"workers"`
+	QueueSize  int           `yaml:"queue_size"`
+	MaxWait    time.Duration `yaml:"max_wait"`
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+type uploadConfig struct {
+	// MaxBodySize is the maximum size of /label request body in bytes.
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// Prefix of keys of persisted bodies, followed by the content hash.
+	Prefix string `yaml:"prefix"`
+}
+
+type cacheConfig struct {
+	Backend string        `yaml:"backend"`
+	Size    int           `yaml:"size"`
+	TTL     time.Duration `yaml:"ttl"`
+	Dir     string        `yaml:"dir"`
+}
+
+type crawlConfig struct {
+	Prefixes    []string      `yaml:"prefixes"`
+	Interval    time.Duration `yaml:"interval"`
+	Concurrency int           `yaml:"concurrency"`
+	IndexPath   string        `yaml:"index_path"`
+}
+
+type tlsConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+func (c tlsConfig) enabled() bool { return c.CertFile != "" }
+
+// loadConfig returns defaults overridden by the YAML file, if path is not empty. Unknown fields are errors, so
+// typos are not silently ignored.
+func loadConfig(defaults config, path string) (config, error) {
+	cfg := defaults
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return config{}, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+			return config{}, errors.Wrapf(err, "parse %v", path)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return config{}, errors.Wrap(err, "invalid config")
+	}
+	return cfg, nil
+}
+
+func (c config) validate() error {
+	if c.ListenAddress == "" {
+		return errors.New("listen_address is required")
+	}
+	if c.Objstore.IsZero() {
+		return errors.New("objstore is required, set it in the config file or with -objstore.config flag")
+	}
+	switch c.Function {
+	case "labelObjectNaive", labelObject1, labelObject2, labelObject3, labelObject4, labelObject5, labelObject6:
+	default:
+		return errors.Newf("unknown function %v", c.Function)
+	}
+	if stages, err := parseStages(c.Stages); err != nil {
+		return err
+	} else if len(stages) == 0 {
+		return errors.New("stages has to select at least one stage")
+	}
+	if c.Pools.BucketedMinSize < 1 || c.Pools.BucketedMaxSize < c.Pools.BucketedMinSize {
+		return errors.Newf("pools bucketed sizes have to be positive with max not smaller than min, got %v and %v", c.Pools.BucketedMinSize, c.Pools.BucketedMaxSize)
+	}
+	if c.Batch.Concurrency < 1 {
+		return errors.Newf("batch concurrency has to be positive, got %v", c.Batch.Concurrency)
+	}
+	if c.Ranges.Concurrency < 1 || c.Ranges.MaxConcurrency < c.Ranges.Concurrency {
+		return errors.Newf("ranges concurrency has to be positive, with max not smaller, got %v and %v", c.Ranges.Concurrency, c.Ranges.MaxConcurrency)
+	}
+	if c.Resume.CheckpointInterval < 1 || c.Resume.MaxRetries < 0 || c.Resume.MinBackoff <= 0 || c.Resume.MaxBackoff < c.Resume.MinBackoff {
+		return errors.Newf("resume has to have positive checkpoint interval and backoff with max not smaller than min, and not negative retries, got %+v", c.Resume)
+	}
+	if c.Admission.Workers < 1 || c.Admission.QueueSize < 0 || c.Admission.MaxWait <= 0 {
+		return errors.Newf("admission has to have positive workers and max wait, and not negative queue size, got %+v", c.Admission)
+	}
+	if c.MemoryBudget != 0 && c.MemoryBudget < minBufferSize {
+		return errors.Newf("memory budget has to be 0 or at least %v bytes, got %v", minBufferSize, c.MemoryBudget)
+	}
+	switch c.Cache.Backend {
+	case "none":
+	case "memory", "disk":
+		if c.Cache.Size < 1 || c.Cache.TTL <= 0 {
+			return errors.Newf("cache has to have positive size and TTL, got %v and %v", c.Cache.Size, c.Cache.TTL)
+		}
+	default:
+		return errors.Newf("unknown cache backend %v", c.Cache.Backend)
+	}
+	if c.Upload.MaxBodySize < 1 {
+		return errors.Newf("upload max body size has to be positive, got %v", c.Upload.MaxBodySize)
+	}
+	if len(c.Crawl.Prefixes) > 0 && (c.Crawl.Concurrency < 1 || c.Crawl.Interval <= 0) {
+		return errors.Newf("crawl has to have positive concurrency and interval, got %v and %v", c.Crawl.Concurrency, c.Crawl.Interval)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls requires both cert_file and key_file")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.Newf("shutdown timeout has to be positive, got %v", c.ShutdownTimeout)
+	}
+	return nil
+}
+
+// validateReload returns error if next config changes what can't be changed without restart.
+func (c config) validateReload(next config) error {
+	if c.ListenAddress != next.ListenAddress || c.GRPCListenAddress != next.GRPCListenAddress {
+		return errors.New("listen addresses can't be changed without restart")
+	}
+	if c.TLS.enabled() != next.TLS.enabled() {
+		return errors.New("tls can't be enabled or disabled without restart")
+	}
+	if strings.Join(c.Crawl.Prefixes, "\x00") != strings.Join(next.Crawl.Prefixes, "\x00") ||
+		c.Crawl.Interval != next.Crawl.Interval || c.Crawl.Concurrency != next.Crawl.Concurrency ||
+		c.Crawl.IndexPath != next.Crawl.IndexPath {
+		return errors.New("crawl can't be changed without restart")
+	}
+	if c.MemoryBudget != next.MemoryBudget {
+		return errors.New("memory_budget can't be changed without restart, as it's shared by in-flight requests of the old config")
+	}
+	return nil
+}
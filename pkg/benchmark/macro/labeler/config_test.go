@@ -0,0 +1,95 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defaults, _, err := parseFlags(nil)
+	testutil.Ok(t, err)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "labeler.yaml")
+
+	// Objstore is required.
+	_, err = loadConfig(defaults, "")
+	testutil.NotOk(t, err)
+
+	testutil.Ok(t, os.WriteFile(path, []byte(`
+objstore:
+  type: FILESYSTEM
+  config:
+    directory: `+dir+`
+function: labelObject4
+stages: [sum, lines]
+admission:
+  workers: 8
+  max_wait: 1m
+cache:
+  backend: memory
+`), os.ModePerm))
+	cfg, err := loadConfig(defaults, path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, labelObject4, cfg.Function)
+	testutil.Equals(t, []string{"sum", "lines"}, cfg.Stages)
+	testutil.Equals(t, admissionConfig{Workers: 8, QueueSize: 16, MaxWait: time.Minute, RetryAfter: time.Second}, cfg.Admission)
+	testutil.Equals(t, cacheConfig{Backend: "memory", Size: 10000, TTL: time.Hour, Dir: "./cache"}, cfg.Cache)
+	// Not in the file, so from flags.
+	testutil.Equals(t, ":8080", cfg.ListenAddress)
+	testutil.Equals(t, 4, cfg.Batch.Concurrency)
+
+	for name, content := range map[string]string{
+		"unknown field":    "objstore: {type: FILESYSTEM}\nfunctoin: labelObject1\n",
+		"unknown function": "objstore: {type: FILESYSTEM}\nfunction: labelObject7\n",
+		"unknown stage":    "objstore: {type: FILESYSTEM}\nstages: [sum, nope]\n",
+		"wrong duration":   "objstore: {type: FILESYSTEM}\ncache: {ttl: 5}\n",
+		"small budget":     "objstore: {type: FILESYSTEM}\nmemory_budget: 10\n",
+		"cert without key": "objstore: {type: FILESYSTEM}\ntls: {cert_file: cert.pem}\n",
+	} {
+		testutil.Ok(t, os.WriteFile(path, []byte(content), os.ModePerm))
+		_, err := loadConfig(defaults, path)
+		testutil.NotOk(t, err, name)
+	}
+}
+
+func TestConfig_ValidateReload(t *testing.T) {
+	cfg := config{ListenAddress: ":8080", Crawl: crawlConfig{Prefixes: []string{"a/"}, Interval: time.Minute}}
+
+	next := cfg
+	next.Function = labelObject1
+	next.Cache.Backend = "disk"
+	testutil.Ok(t, cfg.validateReload(next))
+
+	for name, change := range map[string]func(c *config){
+		"listen address": func(c *config) { c.ListenAddress = ":8081" },
+		"enable tls":     func(c *config) { c.TLS = tlsConfig{CertFile: "cert.pem", KeyFile: "key.pem"} },
+		"crawl prefixes": func(c *config) { c.Crawl.Prefixes = []string{"a/", "b/"} },
+		"crawl interval": func(c *config) { c.Crawl.Interval = time.Hour },
+	} {
+		next := cfg
+		change(&next)
+		testutil.NotOk(t, cfg.validateReload(next), name)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	cfg, configFile, err := parseFlags([]string{"-config.file=labeler.yaml", "-crawl.prefix=a/", "-crawl.prefix=b/", "-objstore.config=type: FILESYSTEM"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "labeler.yaml", configFile)
+	testutil.Equals(t, []string{"a/", "b/"}, cfg.Crawl.Prefixes)
+	testutil.Assert(t, !cfg.Objstore.IsZero())
+
+	// Values of previous calls are not kept.
+	cfg, configFile, err = parseFlags([]string{"-crawl.prefix=c/"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", configFile)
+	testutil.Equals(t, []string{"c/"}, cfg.Crawl.Prefixes)
+	testutil.Assert(t, cfg.Objstore.IsZero())
+}
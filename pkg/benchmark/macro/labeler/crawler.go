@@ -0,0 +1,239 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+)
+
+// crawler labels all objects with configured prefixes in the background and persists labels in the index. Objects
+// are labeled again only if their size or modification time changed. Objects deleted from the bucket are removed
+// from the index.
+type crawler struct {
+	bkt         objstore.BucketReader
+	labelFn     labelFunc
+	index       *labelIndex
+	prefixes    []string
+	interval    time.Duration
+	concurrency int
+	logger      log.Logger
+
+	objects      *prometheus.CounterVec
+	passDuration prometheus.Histogram
+}
+
+func newCrawler(logger log.Logger, reg prometheus.Registerer, bkt objstore.BucketReader, labelFn labelFunc, index *labelIndex, prefixes []string, interval time.Duration, concurrency int) *crawler {
+	return &crawler{
+		bkt:         bkt,
+		labelFn:     labelFn,
+		index:       index,
+		prefixes:    prefixes,
+		interval:    interval,
+		concurrency: concurrency,
+		logger:      logger,
+
+		objects: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "labeler_crawl_objects_total",
+			Help: "Tracks the number of objects seen by the crawler by the result: labeled, unchanged, deleted or failed.",
+		}, []string{"result"}),
+		passDuration: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "labeler_crawl_pass_duration_seconds",
+			Help:    "Tracks the duration of crawling all configured prefixes.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+		}),
+	}
+}
+
+// run crawls all prefixes every interval until ctx is canceled. Errors of single pass are logged, not returned.
+func (c *crawler) run(ctx context.Context) error {
+	for {
+		if err := c.crawl(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			level.Error(c.logger).Log("msg", "crawl failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// crawl does a single pass over all prefixes. Errors of single objects are logged and they are retried in the next
+// pass.
+func (c *crawler) crawl(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() { c.passDuration.Observe(time.Since(start).Seconds()) }()
+
+	for _, prefix := range c.prefixes {
+		if err := c.crawlPrefix(ctx, prefix); err != nil {
+			return errors.Wrapf(err, "crawl prefix %q", prefix)
+		}
+	}
+	return c.index.sync()
+}
+
+func (c *crawler) crawlPrefix(ctx context.Context, prefix string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objIDs := make(chan string)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(objIDs)
+		listErr <- listObjects(ctx, c.bkt, prefix, objIDs)
+	}()
+
+	var (
+		mtx    sync.Mutex
+		seen   = map[string]struct{}{}
+		putErr error
+	)
+	wg := sync.WaitGroup{}
+	wg.Add(c.concurrency)
+	for i := 0; i < c.concurrency; i++ {
+		go func() {
+			defer wg.Done()
+
+			for objID := range objIDs {
+				mtx.Lock()
+				seen[objID] = struct{}{}
+				mtx.Unlock()
+
+				e, result, err := c.labelIfChanged(ctx, objID)
+				if err != nil {
+					if ctx.Err() == nil {
+						level.Warn(c.logger).Log("msg", "failed to label object", "object_id", objID, "err", err)
+					}
+				} else if e != nil {
+					if err := c.index.put(*e); err != nil {
+						mtx.Lock()
+						putErr = err
+						mtx.Unlock()
+						cancel()
+						continue
+					}
+				}
+				c.objects.WithLabelValues(result).Inc()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if putErr != nil {
+		return putErr
+	}
+	if err := <-listErr; err != nil {
+		return err
+	}
+
+	// Listing is complete, so anything else in the index is gone from the bucket.
+	for _, e := range c.index.list(prefix) {
+		if _, ok := seen[e.ObjID]; ok {
+			continue
+		}
+		if err := c.index.delete(e.ObjID); err != nil {
+			return err
+		}
+		c.objects.WithLabelValues("deleted").Inc()
+	}
+	return nil
+}
+
+// labelIfChanged returns new index entry of the object, or nil if it's already indexed with the same attributes.
+func (c *crawler) labelIfChanged(ctx context.Context, objID string) (_ *indexEntry, result string, _ error) {
+	a, err := c.bkt.Attributes(ctx, objID)
+	if err != nil {
+		return nil, "failed", errors.Wrap(err, "attributes")
+	}
+	if e, ok := c.index.get(objID); ok && e.Size == a.Size && e.LastModified.Equal(a.LastModified) {
+		return nil, "unchanged", nil
+	}
+
+	lbl, err := c.labelFn(ctx, objID)
+	if err != nil {
+		return nil, "failed", err
+	}
+	// Attributes are from before labeling, so if object changed meanwhile, it's labeled again in the next pass.
+	return &indexEntry{label: lbl, Size: a.Size, LastModified: a.LastModified, LabeledAt: time.Now()}, "labeled", nil
+}
+
+// selectEntries returns index entries of objects given by ids and with prefix, if not nil, or all entries if neither is
+// given, sorted by object ID. Objects which are not in the index are skipped.
+func selectEntries(index *labelIndex, ids []string, prefix *string) []indexEntry {
+	switch {
+	case len(ids) == 0 && prefix == nil:
+		return index.list("")
+	case len(ids) == 0:
+		return index.list(*prefix)
+	}
+
+	byID := map[string]indexEntry{}
+	for _, id := range ids {
+		if e, ok := index.get(id); ok {
+			byID[id] = e
+		}
+	}
+	if prefix != nil {
+		for _, e := range index.list(*prefix) {
+			byID[e.ObjID] = e
+		}
+	}
+	entries := make([]indexEntry, 0, len(byID))
+	for _, e := range byID {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ObjID < entries[j].ObjID })
+	return entries
+}
+
+// newLabelsHandler returns handler of /labels. It serves labels from the index, without reading objects: entries
+// of all objects given by `object_id` parameters and with the `prefix` parameter, or all entries if none is given.
+// Results are streamed as NDJSON (one indexEntry per line), sorted by object ID. Objects which are not in the index
+// are skipped.
+func newLabelsHandler(index *labelIndex) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
+		}
+
+		ids := r.Form["object_id"]
+		prefixes := r.Form["prefix"]
+		if len(prefixes) > 1 {
+			httpErrHandle(w, r, withCode(codeInvalidInput, errors.New("only one prefix parameter is allowed")))
+			return
+		}
+
+		var prefix *string
+		if len(prefixes) == 1 {
+			prefix = &prefixes[0]
+		}
+		entries := selectEntries(index, ids, prefix)
+
+		w.Header().Add("Content-Type", "application/x-ndjson; charset=utf-8")
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if err := enc.Encode(&e); err != nil {
+				// Client is gone or connection broken, nothing more to report.
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+func indexedSums(i *labelIndex, prefix string) map[string]int64 {
+	ret := map[string]int64{}
+	for _, e := range i.list(prefix) {
+		ret[e.ObjID] = e.Sum
+	}
+	return ret
+}
+
+func TestCrawler(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	for name, content := range map[string]string{
+		"a/1.txt":     "1\n2\n",
+		"a/2.txt":     "3\n4\n",
+		"a/b/3.txt":   "-7\n",
+		"a/bad.txt":   "6\n",
+		"b/4.txt":     "8\n",
+		"other/5.txt": "9\n",
+		// Sidecars are not crawled.
+		"b/4.txt" + sidecarSuffix: `{"sum":8}`,
+	} {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader(content)))
+	}
+
+	var (
+		mtx     sync.Mutex
+		labeled []string
+	)
+	l := &labeler{bkt: bkt}
+	labelFn := func(ctx context.Context, objID string) (label, error) {
+		mtx.Lock()
+		labeled = append(labeled, objID)
+		mtx.Unlock()
+
+		if objID == "a/bad.txt" {
+			return label{}, errors.New("injected error")
+		}
+		return l.labelObject1(ctx, objID)
+	}
+
+	path := filepath.Join(t.TempDir(), "labels.ndjson")
+	index, err := openLabelIndex(path)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	c := newCrawler(log.NewNopLogger(), reg, bkt, labelFn, index, []string{"a/", "b/"}, time.Minute, 2)
+
+	testutil.Ok(t, c.crawl(ctx))
+	exp := map[string]int64{"a/1.txt": 3, "a/2.txt": 7, "a/b/3.txt": -7, "b/4.txt": 8}
+	testutil.Equals(t, exp, indexedSums(index, ""))
+	testutil.Equals(t, 5, len(labeled))
+	testutil.Equals(t, 4.0, promtestutil.ToFloat64(c.objects.WithLabelValues("labeled")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.objects.WithLabelValues("failed")))
+
+	// Nothing changed, only failed object is labeled again.
+	labeled = nil
+	testutil.Ok(t, c.crawl(ctx))
+	testutil.Equals(t, []string{"a/bad.txt"}, labeled)
+	testutil.Equals(t, 4.0, promtestutil.ToFloat64(c.objects.WithLabelValues("unchanged")))
+
+	// Changed, new and deleted objects.
+	testutil.Ok(t, bkt.Upload(ctx, "a/2.txt", strings.NewReader("3\n4\n5\n")))
+	testutil.Ok(t, bkt.Upload(ctx, "b/new.txt", strings.NewReader("100\n")))
+	testutil.Ok(t, bkt.Delete(ctx, "a/b/3.txt"))
+	testutil.Ok(t, bkt.Delete(ctx, "a/bad.txt"))
+	labeled = nil
+	testutil.Ok(t, c.crawl(ctx))
+	testutil.ContainsStringSlice(t, labeled, []string{"a/2.txt", "b/new.txt"})
+	testutil.Equals(t, 2, len(labeled))
+	exp = map[string]int64{"a/1.txt": 3, "a/2.txt": 12, "b/4.txt": 8, "b/new.txt": 100}
+	testutil.Equals(t, exp, indexedSums(index, ""))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(c.objects.WithLabelValues("deleted")))
+
+	// Labels survive restart.
+	testutil.Ok(t, index.Close())
+	index, err = openLabelIndex(path)
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, index.Close()) })
+	testutil.Equals(t, exp, indexedSums(index, ""))
+
+	c = newCrawler(log.NewNopLogger(), prometheus.NewRegistry(), bkt, labelFn, index, []string{"a/", "b/"}, time.Minute, 2)
+	labeled = nil
+	testutil.Ok(t, c.crawl(ctx))
+	testutil.Equals(t, 0, len(labeled))
+
+	t.Run("/labels", func(t *testing.T) {
+		srv := httptest.NewServer(newLabelsHandler(index))
+		t.Cleanup(srv.Close)
+
+		for _, tcase := range []struct {
+			params url.Values
+			exp    []string
+		}{
+			{params: url.Values{}, exp: []string{"a/1.txt", "a/2.txt", "b/4.txt", "b/new.txt"}},
+			{params: url.Values{"prefix": {"b/"}}, exp: []string{"b/4.txt", "b/new.txt"}},
+			{params: url.Values{"object_id": {"b/4.txt", "a/1.txt", "missing"}}, exp: []string{"a/1.txt", "b/4.txt"}},
+			{params: url.Values{"object_id": {"a/1.txt", "b/4.txt"}, "prefix": {"b/"}}, exp: []string{"a/1.txt", "b/4.txt", "b/new.txt"}},
+			{params: url.Values{"prefix": {"c/"}}},
+		} {
+			res, err := http.Get(srv.URL + "/labels?" + tcase.params.Encode())
+			testutil.Ok(t, err)
+			testutil.Equals(t, http.StatusOK, res.StatusCode)
+
+			var got []string
+			s := bufio.NewScanner(res.Body)
+			for s.Scan() {
+				e := struct {
+					ObjID string `json:"object_id"`
+					Sum   int64  `json:"sum"`
+					Size  int64  `json:"size"`
+				}{}
+				testutil.Ok(t, json.Unmarshal(s.Bytes(), &e))
+				testutil.Equals(t, exp[e.ObjID], e.Sum)
+				testutil.Assert(t, e.Size > 0)
+				got = append(got, e.ObjID)
+			}
+			testutil.Ok(t, s.Err())
+			testutil.Ok(t, res.Body.Close())
+			testutil.Equals(t, tcase.exp, got, "%v", tcase.params)
+		}
+	})
+}
+
+func TestCrawler_Run(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(context.Background(), "a/1.txt", strings.NewReader("1\n")))
+
+	index, err := openLabelIndex(filepath.Join(t.TempDir(), "labels.ndjson"))
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, index.Close()) })
+
+	l := &labeler{bkt: bkt}
+	c := newCrawler(log.NewNopLogger(), prometheus.NewRegistry(), bkt, l.labelObject1, index, []string{""}, 10*time.Millisecond, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.run(ctx) }()
+
+	// New objects are picked up by next passes.
+	testutil.Ok(t, bkt.Upload(context.Background(), "b/2.txt", strings.NewReader("2\n")))
+	deadline := time.Now().Add(1 * time.Minute)
+	for len(index.list("")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.Equals(t, map[string]int64{"a/1.txt": 1, "b/2.txt": 2}, indexedSums(index, ""))
+
+	cancel()
+	testutil.Ok(t, <-done)
+}
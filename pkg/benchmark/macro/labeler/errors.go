@@ -0,0 +1,120 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/thanos-io/objstore"
+)
+
+// errorCode is the type of failure reported to API clients, so they can tell e.g. missing object from a bug without
+// parsing messages. It decides the HTTP status code.
+type errorCode string
+
+const (
+	codeNotFound            errorCode = "not_found"
+	codeInvalidInput        errorCode = "invalid_input"
+	codeParseError          errorCode = "parse_error"
+	codeTooLarge            errorCode = "too_large"
+	codeUpstreamUnavailable errorCode = "upstream_unavailable"
+	codeTooManyRequests     errorCode = "too_many_requests"
+	codeUnavailable         errorCode = "unavailable"
+	codeMethodNotAllowed    errorCode = "method_not_allowed"
+	codeInternal            errorCode = "internal"
+)
+
+var codeStatus = map[errorCode]int{
+	codeNotFound:            http.StatusNotFound,
+	codeInvalidInput:        http.StatusBadRequest,
+	codeParseError:          http.StatusUnprocessableEntity,
+	codeTooLarge:            http.StatusRequestEntityTooLarge,
+	codeUpstreamUnavailable: http.StatusBadGateway,
+	codeTooManyRequests:     http.StatusTooManyRequests,
+	codeUnavailable:         http.StatusServiceUnavailable,
+	codeMethodNotAllowed:    http.StatusMethodNotAllowed,
+	codeInternal:            http.StatusInternalServerError,
+}
+
+// codeError is error with errorCode. Message is the one of the wrapped error.
+type codeError struct {
+	code errorCode
+	err  error
+}
+
+func (e *codeError) Error() string { return e.err.Error() }
+
+func (e *codeError) Unwrap() error { return e.err }
+
+// withCode returns err with the given code, or nil if err is nil.
+func withCode(code errorCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codeError{code: code, err: err}
+}
+
+// codeOf returns the code of the outermost codeError in err chain. Errors without code are internal.
+func codeOf(err error) errorCode {
+	var ce *codeError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	var tmr *tooManyRequestsError
+	if errors.As(err, &tmr) {
+		return codeTooManyRequests
+	}
+	return codeInternal
+}
+
+// bucketErr returns err of the bucket operation with code: not found if object does not exist, otherwise upstream
+// unavailable, as labeler can't do anything about bucket failures.
+func bucketErr(bkt objstore.BucketReader, err error) error {
+	if err == nil {
+		return nil
+	}
+	if bkt.IsObjNotFoundErr(err) {
+		return withCode(codeNotFound, err)
+	}
+	return withCode(codeUpstreamUnavailable, err)
+}
+
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns ID of the request from its X-Request-ID header or a new random one, and sets it on the response,
+// so clients can refer to the failed request.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		b := make([]byte, 8)
+		_, _ = rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// errorResponse is the JSON body of failed requests.
+type errorResponse struct {
+	Code      errorCode `json:"code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id"`
+}
+
+// httpErrHandle responds with status code and JSON body given by the code of err.
+func httpErrHandle(w http.ResponseWriter, r *http.Request, err error) {
+	code := codeOf(err)
+	b, merr := json.Marshal(errorResponse{Code: code, Message: err.Error(), RequestID: requestID(w, r)})
+	if merr != nil {
+		// Not possible with strings only, but if it happens client still gets the status.
+		b = []byte(`{"code":"internal"}`)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(codeStatus[code])
+	_, _ = w.Write(append(b, '\n'))
+}
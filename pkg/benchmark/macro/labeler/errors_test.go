@@ -0,0 +1,118 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+// truncatingBucket streams only the first byte of objects, like connection closed before the whole response.
+type truncatingBucket struct {
+	objstore.Bucket
+}
+
+func (b truncatingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{Reader: io.LimitReader(rc, 1), Closer: rc}, nil
+}
+
+func TestLabelHandler_Errors(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "ok.txt", strings.NewReader("1\n2\n")))
+	testutil.Ok(t, bkt.Upload(ctx, "not-numbers.txt", strings.NewReader("1\n\"two\"\n")))
+	testutil.Ok(t, bkt.Upload(ctx, "long-line.txt", strings.NewReader(strings.Repeat("1", 2*maxLineLen))))
+
+	l := &labeler{bkt: bkt}
+	unreachable := &labeler{bkt: unreachableBucket{Bucket: bkt}}
+	truncated := &labeler{bkt: truncatingBucket{Bucket: bkt}}
+	labelFn := func(ctx context.Context, objID string) (label, error) {
+		switch objID {
+		case "unreachable.txt":
+			return unreachable.labelObject1(ctx, objID)
+		case "truncated.txt":
+			return truncated.labelObject1(ctx, "ok.txt")
+		case "busy.txt":
+			return label{}, &tooManyRequestsError{reason: "busy", retryAfter: 2 * time.Second}
+		case "bug.txt":
+			return label{}, errors.New("unexpected")
+		}
+		return l.labelObject1(ctx, objID)
+	}
+	h := newLabelHandler(labelFn)
+
+	for _, tcase := range []struct {
+		query          string
+		expectedStatus int
+		expectedCode   errorCode
+	}{
+		{query: "object_id=missing.txt", expectedStatus: http.StatusNotFound, expectedCode: codeNotFound},
+		{query: "", expectedStatus: http.StatusBadRequest, expectedCode: codeInvalidInput},
+		{query: "object_id=ok.txt&stage=nope", expectedStatus: http.StatusBadRequest, expectedCode: codeInvalidInput},
+		{query: "object_id=ok.txt&object_id=%zz", expectedStatus: http.StatusBadRequest, expectedCode: codeInvalidInput},
+		{query: "object_id=not-numbers.txt", expectedStatus: http.StatusUnprocessableEntity, expectedCode: codeParseError},
+		{query: "object_id=long-line.txt", expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: codeTooLarge},
+		{query: "object_id=unreachable.txt", expectedStatus: http.StatusBadGateway, expectedCode: codeUpstreamUnavailable},
+		{query: "object_id=truncated.txt", expectedStatus: http.StatusBadGateway, expectedCode: codeUpstreamUnavailable},
+		{query: "object_id=busy.txt", expectedStatus: http.StatusTooManyRequests, expectedCode: codeTooManyRequests},
+		{query: "object_id=bug.txt", expectedStatus: http.StatusInternalServerError, expectedCode: codeInternal},
+	} {
+		t.Run(tcase.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/label_object?"+tcase.query, nil))
+			testutil.Equals(t, tcase.expectedStatus, w.Code)
+			testutil.Equals(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+			var res errorResponse
+			testutil.Ok(t, json.Unmarshal(w.Body.Bytes(), &res), w.Body.String())
+			testutil.Equals(t, tcase.expectedCode, res.Code)
+			testutil.Assert(t, res.Message != "")
+			testutil.Assert(t, res.RequestID != "")
+			testutil.Equals(t, res.RequestID, w.Header().Get(requestIDHeader))
+		})
+	}
+
+	t.Run("retry after", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/label_object?object_id=busy.txt", nil))
+		testutil.Equals(t, "2", w.Header().Get("Retry-After"))
+	})
+}
+
+func TestHTTPErrHandle(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/label_object", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+
+	w := httptest.NewRecorder()
+	// Quotes used to break the JSON.
+	httpErrHandle(w, r, withCode(codeNotFound, errors.Wrap(errors.New(`object "a.txt" not found`), "label")))
+	testutil.Equals(t, http.StatusNotFound, w.Code)
+
+	var res errorResponse
+	testutil.Ok(t, json.Unmarshal(w.Body.Bytes(), &res))
+	testutil.Equals(t, errorResponse{Code: codeNotFound, Message: `label: object "a.txt" not found`, RequestID: "req-1"}, res)
+	testutil.Equals(t, "req-1", w.Header().Get(requestIDHeader))
+
+	// The outermost code wins.
+	testutil.Equals(t, codeUnavailable, codeOf(withCode(codeUnavailable, errors.Wrap(withCode(codeNotFound, errors.New("a")), "b"))))
+	testutil.Equals(t, codeParseError, codeOf(errors.Wrap(withCode(codeParseError, errors.New("a")), "b")))
+	testutil.Equals(t, codeInternal, codeOf(errors.New("a")))
+}
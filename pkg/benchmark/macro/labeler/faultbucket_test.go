@@ -0,0 +1,224 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/thanos-io/objstore"
+)
+
+// faultOp is the bucket operation faultyBucket injects faults into.
+type faultOp string
+
+const (
+	faultAttributes faultOp = "attributes"
+	// faultGet is opening the stream with Get or GetRange.
+	faultGet   faultOp = "get"
+	faultRead  faultOp = "read"
+	faultClose faultOp = "close"
+)
+
+// fault is injected into a single bucket operation. Zero fault does not change the operation.
+type fault struct {
+	// Latency delays the operation, or each read of the stream for faultRead, unless the context is done first.
+	Latency time.Duration
+	// Err fails the operation. Streams fail after After bytes.
+	Err error
+	// After is the number of bytes stream returns before it fails with Err or ends with Truncate.
+	After int64
+	// Truncate ends the stream with io.EOF after After bytes, like connection closed before the whole response.
+	Truncate bool
+	// ChunkSize limits the number of bytes each read of the stream returns, like slow reader.
+	ChunkSize int
+}
+
+// faultPolicy decides fault injected into the operation on the object.
+type faultPolicy interface {
+	fault(op faultOp, name string) fault
+}
+
+// scriptedFaults injects faults in the given order, separately for each operation. Operations after the script are
+// not faulted.
+type scriptedFaults struct {
+	mtx    sync.Mutex
+	script map[faultOp][]fault
+}
+
+func newScriptedFaults(script map[faultOp][]fault) *scriptedFaults {
+	return &scriptedFaults{script: script}
+}
+
+func (s *scriptedFaults) fault(op faultOp, _ string) fault {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.script[op]) == 0 {
+		return fault{}
+	}
+	f := s.script[op][0]
+	s.script[op] = s.script[op][1:]
+	return f
+}
+
+// randomFaults injects one of the faults of the operation with probability p. Streams fail or end after random
+// number of bytes, up to fault After. Random source is seeded, so faults are the same in each run with the same order
+// of operations.
+type randomFaults struct {
+	mtx    sync.Mutex
+	rnd    *rand.Rand
+	p      float64
+	faults map[faultOp][]fault
+}
+
+func newRandomFaults(seed int64, p float64, faults map[faultOp][]fault) *randomFaults {
+	return &randomFaults{rnd: rand.New(rand.NewSource(seed)), p: p, faults: faults}
+}
+
+func (r *randomFaults) fault(op faultOp, _ string) fault {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if len(r.faults[op]) == 0 || r.rnd.Float64() >= r.p {
+		return fault{}
+	}
+	f := r.faults[op][r.rnd.Intn(len(r.faults[op]))]
+	if f.After > 0 {
+		f.After = r.rnd.Int63n(f.After + 1)
+	}
+	return f
+}
+
+// faultyBucket is the bucket test double which injects faults decided by the policy into Attributes, Get and GetRange,
+// and into reads and Close of their streams.
+type faultyBucket struct {
+	objstore.Bucket
+	policy faultPolicy
+
+	mtx sync.Mutex
+	// offsets are of all streams opened with Get or GetRange.
+	offsets []int64
+}
+
+func newFaultyBucket(bkt objstore.Bucket, policy faultPolicy) *faultyBucket {
+	return &faultyBucket{Bucket: bkt, policy: policy}
+}
+
+// inject delays and fails the operation as decided by the policy.
+func (b *faultyBucket) inject(ctx context.Context, op faultOp, name string) error {
+	f := b.policy.fault(op, name)
+	if err := sleep(ctx, f.Latency); err != nil {
+		return err
+	}
+	return f.Err
+}
+
+func (b *faultyBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.inject(ctx, faultAttributes, name); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return b.Bucket.Attributes(ctx, name)
+}
+
+func (b *faultyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.inject(ctx, faultGet, name); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return b.stream(ctx, rc, name, 0), nil
+}
+
+func (b *faultyBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.inject(ctx, faultGet, name); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return b.stream(ctx, rc, name, off), nil
+}
+
+func (b *faultyBucket) stream(ctx context.Context, rc io.ReadCloser, name string, off int64) io.ReadCloser {
+	b.mtx.Lock()
+	b.offsets = append(b.offsets, off)
+	b.mtx.Unlock()
+
+	return &faultyReader{ctx: ctx, rc: rc, f: b.policy.fault(faultRead, name), close: func() error {
+		return b.inject(ctx, faultClose, name)
+	}}
+}
+
+// streamOffsets returns offsets of streams opened since the last call.
+func (b *faultyBucket) streamOffsets() []int64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	ret := b.offsets
+	b.offsets = nil
+	return ret
+}
+
+type faultyReader struct {
+	ctx   context.Context
+	rc    io.ReadCloser
+	f     fault
+	read  int64
+	close func() error
+}
+
+func (r *faultyReader) Read(p []byte) (int, error) {
+	if err := sleep(r.ctx, r.f.Latency); err != nil {
+		return 0, err
+	}
+	if r.f.ChunkSize > 0 && len(p) > r.f.ChunkSize {
+		p = p[:r.f.ChunkSize]
+	}
+	if r.f.Err != nil || r.f.Truncate {
+		left := r.f.After - r.read
+		if left <= 0 {
+			if r.f.Truncate {
+				return 0, io.EOF
+			}
+			return 0, r.f.Err
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := r.rc.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *faultyReader) Close() error {
+	err := r.rc.Close()
+	if cerr := r.close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"go-advanced/pkg/benchmark/macro/labeler/labelerpb"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var codeGRPC = map[errorCode]codes.Code{
+	codeNotFound:            codes.NotFound,
+	codeInvalidInput:        codes.InvalidArgument,
+	codeParseError:          codes.FailedPrecondition,
+	codeTooLarge:            codes.ResourceExhausted,
+	codeUpstreamUnavailable: codes.Unavailable,
+	codeTooManyRequests:     codes.ResourceExhausted,
+	codeUnavailable:         codes.Unavailable,
+	codeMethodNotAllowed:    codes.Unimplemented,
+	codeInternal:            codes.Internal,
+}
+
+// grpcErr returns gRPC status error with code given by the code of err. The code itself is in the ErrorInfo reason,
+// as gRPC codes are less specific.
+func grpcErr(err error) error {
+	code := codeOf(err)
+	st := status.New(codeGRPC[code], err.Error())
+	if withInfo, derr := st.WithDetails(&errdetails.ErrorInfo{Reason: string(code), Domain: "labeler"}); derr == nil {
+		st = withInfo
+	}
+	return st.Err()
+}
+
+// grpcServer serves labelerpb.LabelerServer with the service of acquire, like the HTTP handlers.
+type grpcServer struct {
+	labelerpb.UnimplementedLabelerServer
+
+	acquire func() (*service, func())
+	// index is nil if crawling is disabled.
+	index *labelIndex
+}
+
+func labelToProto(lbl label) *labelerpb.Label {
+	ret := &labelerpb.Label{ObjectId: lbl.ObjID, Sum: lbl.Sum, Checksum: lbl.CheckSum}
+	if len(lbl.Attributes) > 0 {
+		ret.Attributes = make(map[string][]byte, len(lbl.Attributes))
+		for name, v := range lbl.Attributes {
+			ret.Attributes[name] = v
+		}
+	}
+	return ret
+}
+
+func (s *grpcServer) LabelObject(ctx context.Context, req *labelerpb.LabelObjectRequest) (*labelerpb.Label, error) {
+	if req.ObjectId == "" {
+		return nil, grpcErr(withCode(codeInvalidInput, errors.New("object_id is required")))
+	}
+	stageNames, err := parseStages(req.Stages)
+	if err != nil {
+		return nil, grpcErr(withCode(codeInvalidInput, err))
+	}
+
+	svc, release := s.acquire()
+	defer release()
+
+	lbl, err := svc.labelFn(withStages(ctx, stageNames), req.ObjectId)
+	if err != nil {
+		return nil, grpcErr(err)
+	}
+	return labelToProto(lbl), nil
+}
+
+func (s *grpcServer) LabelObjects(req *labelerpb.LabelObjectsRequest, srv labelerpb.Labeler_LabelObjectsServer) error {
+	if len(req.ObjectIds) == 0 && req.Prefix == nil {
+		return grpcErr(withCode(codeInvalidInput, errors.New("object_ids or prefix is required")))
+	}
+	stageNames, err := parseStages(req.Stages)
+	if err != nil {
+		return grpcErr(withCode(codeInvalidInput, err))
+	}
+
+	svc, release := s.acquire()
+	defer release()
+
+	return labelObjectsWithPrefix(withStages(srv.Context(), stageNames), svc.bkt, svc.labelFn, req.ObjectIds, req.Prefix, svc.cfg.Batch.Concurrency, func(res batchResult) error {
+		r := &labelerpb.LabelObjectsResponse{ObjectId: res.ObjID}
+		if res.label != nil {
+			r.Label = labelToProto(*res.label)
+		} else {
+			r.Error = &labelerpb.Error{Code: string(res.Code), Message: res.Error}
+		}
+		return srv.Send(r)
+	})
+}
+
+func (s *grpcServer) ListLabels(req *labelerpb.ListLabelsRequest, srv labelerpb.Labeler_ListLabelsServer) error {
+	if s.index == nil {
+		// Like /labels, which is not registered then.
+		return status.Error(codes.Unimplemented, "crawling is disabled, set crawl prefixes to serve labels")
+	}
+	for _, e := range selectEntries(s.index, req.ObjectIds, req.Prefix) {
+		if err := srv.Send(&labelerpb.IndexEntry{
+			Label:        labelToProto(e.label),
+			Size:         e.Size,
+			LastModified: timestamppb.New(e.LastModified),
+			LabeledAt:    timestamppb.New(e.LabeledAt),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopGRPC stops srv gracefully: it stops accepting RPCs and waits up to timeout for in-flight ones, which are cut off
+// after timeout.
+func stopGRPC(srv *grpc.Server, timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		srv.Stop()
+		<-done
+		return errors.Newf("in-flight RPCs did not finish within %v", timeout)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"go-advanced/pkg/benchmark/macro/grpcmiddleware"
+	"go-advanced/pkg/benchmark/macro/labeler/labelerpb"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// startGRPC serves s on in-process listener with middleware interceptors and returns client connected to it.
+func startGRPC(t *testing.T, s *grpcServer, mw grpcmiddleware.Middleware) (*grpc.Server, labelerpb.LabelerClient) {
+	t.Helper()
+
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(mw.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(mw.StreamServerInterceptor()),
+	)
+	labelerpb.RegisterLabelerServer(srv, s)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	testutil.Ok(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return srv, labelerpb.NewLabelerClient(conn)
+}
+
+func staticService(svc *service) func() (*service, func()) {
+	return func() (*service, func()) { return svc, func() {} }
+}
+
+// errReason returns code and the labeler error code of gRPC error.
+func errReason(t *testing.T, err error) (codes.Code, string) {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	testutil.Assert(t, ok, "not a status error: %v", err)
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return st.Code(), info.Reason
+		}
+	}
+	return st.Code(), ""
+}
+
+func TestGRPCServer(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	for name, content := range map[string]string{
+		"a/1.txt":   "1\n2\n",
+		"a/2.txt":   "3\n",
+		"a/bad.txt": "x\n",
+	} {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader(content)))
+	}
+
+	index, err := openLabelIndex(filepath.Join(t.TempDir(), "labels.ndjson"))
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, index.Close()) })
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testutil.Ok(t, index.put(indexEntry{label: label{ObjID: "a/1.txt", Sum: 3}, Size: 4, LastModified: modified, LabeledAt: modified}))
+	testutil.Ok(t, index.put(indexEntry{label: label{ObjID: "b/3.txt", Sum: 5}, Size: 2, LastModified: modified, LabeledAt: modified}))
+
+	svc := &service{
+		cfg:     config{Batch: batchConfig{Concurrency: 2}},
+		bkt:     bkt,
+		labelFn: (&labeler{bkt: bkt}).labelObject1,
+	}
+	reg := prometheus.NewRegistry()
+	_, c := startGRPC(t, &grpcServer{acquire: staticService(svc), index: index}, grpcmiddleware.NewMiddleware(reg, nil))
+
+	t.Run("LabelObject", func(t *testing.T) {
+		lbl, err := c.LabelObject(ctx, &labelerpb.LabelObjectRequest{ObjectId: "a/1.txt"})
+		testutil.Ok(t, err)
+		testutil.Equals(t, "a/1.txt", lbl.ObjectId)
+		testutil.Equals(t, int64(3), lbl.Sum)
+		testutil.Equals(t, 0, len(lbl.Attributes))
+
+		lbl, err = c.LabelObject(ctx, &labelerpb.LabelObjectRequest{ObjectId: "a/1.txt", Stages: []string{"lines"}})
+		testutil.Ok(t, err)
+		testutil.Equals(t, "2", string(lbl.Attributes["lines"]))
+
+		_, err = c.LabelObject(ctx, &labelerpb.LabelObjectRequest{ObjectId: "a/missing.txt"})
+		code, reason := errReason(t, err)
+		testutil.Equals(t, codes.NotFound, code)
+		testutil.Equals(t, string(codeNotFound), reason)
+
+		_, err = c.LabelObject(ctx, &labelerpb.LabelObjectRequest{ObjectId: "a/1.txt", Stages: []string{"nope"}})
+		code, reason = errReason(t, err)
+		testutil.Equals(t, codes.InvalidArgument, code)
+		testutil.Equals(t, string(codeInvalidInput), reason)
+	})
+	t.Run("LabelObjects", func(t *testing.T) {
+		stream, err := c.LabelObjects(ctx, &labelerpb.LabelObjectsRequest{ObjectIds: []string{"a/missing.txt"}, Prefix: proto.String("a/")})
+		testutil.Ok(t, err)
+
+		var results []*labelerpb.LabelObjectsResponse
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			testutil.Ok(t, err)
+			results = append(results, res)
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].ObjectId < results[j].ObjectId })
+
+		testutil.Equals(t, 4, len(results))
+		testutil.Equals(t, int64(3), results[0].Label.GetSum())
+		testutil.Equals(t, int64(3), results[1].Label.GetSum())
+		testutil.Equals(t, "a/bad.txt", results[2].ObjectId)
+		testutil.Equals(t, string(codeParseError), results[2].Error.GetCode())
+		testutil.Equals(t, "a/missing.txt", results[3].ObjectId)
+		testutil.Equals(t, string(codeNotFound), results[3].Error.GetCode())
+
+		// Object IDs or prefix is required.
+		stream, err = c.LabelObjects(ctx, &labelerpb.LabelObjectsRequest{})
+		testutil.Ok(t, err)
+		_, err = stream.Recv()
+		code, _ := errReason(t, err)
+		testutil.Equals(t, codes.InvalidArgument, code)
+	})
+	t.Run("ListLabels", func(t *testing.T) {
+		stream, err := c.ListLabels(ctx, &labelerpb.ListLabelsRequest{Prefix: proto.String("a/"), ObjectIds: []string{"b/3.txt", "c/missing.txt"}})
+		testutil.Ok(t, err)
+
+		var ids []string
+		for {
+			e, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, modified, e.LastModified.AsTime())
+			ids = append(ids, e.Label.ObjectId)
+		}
+		testutil.Equals(t, []string{"a/1.txt", "b/3.txt"}, ids)
+
+		// Labels are served only with crawling.
+		_, noIndex := startGRPC(t, &grpcServer{acquire: staticService(svc)}, grpcmiddleware.NewNopMiddleware())
+		stream, err = noIndex.ListLabels(ctx, &labelerpb.ListLabelsRequest{})
+		testutil.Ok(t, err)
+		_, err = stream.Recv()
+		testutil.Equals(t, codes.Unimplemented, status.Code(err))
+	})
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP grpc_requests_total Tracks the number of gRPC requests.
+# TYPE grpc_requests_total counter
+grpc_requests_total{code="InvalidArgument",handler="/labeler.Labeler/LabelObject"} 1
+grpc_requests_total{code="InvalidArgument",handler="/labeler.Labeler/LabelObjects"} 1
+grpc_requests_total{code="NotFound",handler="/labeler.Labeler/LabelObject"} 1
+grpc_requests_total{code="OK",handler="/labeler.Labeler/LabelObject"} 2
+grpc_requests_total{code="OK",handler="/labeler.Labeler/LabelObjects"} 1
+grpc_requests_total{code="OK",handler="/labeler.Labeler/ListLabels"} 1
+`), "grpc_requests_total"))
+	testutil.Equals(t, 6, promtestutil.CollectAndCount(reg, "grpc_response_size_bytes"))
+}
+
+func TestStopGRPC(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+	svc := &service{labelFn: func(ctx context.Context, objID string) (label, error) {
+		close(started)
+		<-unblock
+		return label{ObjID: objID, Sum: 3}, nil
+	}}
+	srv, c := startGRPC(t, &grpcServer{acquire: staticService(svc)}, grpcmiddleware.NewNopMiddleware())
+
+	res := make(chan error, 1)
+	go func() {
+		lbl, err := c.LabelObject(context.Background(), &labelerpb.LabelObjectRequest{ObjectId: "a.txt"})
+		if err == nil && lbl.Sum != 3 {
+			err = status.Errorf(codes.Internal, "unexpected sum %v", lbl.Sum)
+		}
+		res <- err
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- stopGRPC(srv, 1*time.Minute) }()
+	select {
+	case err := <-stopped:
+		t.Fatal("stopped with in-flight RPC", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(unblock)
+	testutil.Ok(t, <-res)
+	testutil.Ok(t, <-stopped)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/thanos-io/objstore"
+)
+
+const (
+	// readyCheckObject is the object readiness checks existence of. It does not need to exist, the check is whether
+	// bucket responds.
+	readyCheckObject  = "labeler-ready-check"
+	readyCheckTimeout = 5 * time.Second
+)
+
+// probe tells if labeler is alive and ready to serve, and rejects requests once shutdown started.
+type probe struct {
+	bkt          objstore.BucketReader
+	shuttingDown atomic.Bool
+}
+
+func newProbe(bkt objstore.BucketReader) *probe {
+	return &probe{bkt: bkt}
+}
+
+var errShuttingDown = withCode(codeUnavailable, errors.New("labeler is shutting down"))
+
+// newHealthyHandler returns handler of /-/healthy. Labeler is healthy if it can respond at all, also while shutting
+// down, so it's not restarted while in-flight requests drain.
+func (p *probe) newHealthyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Healthy.\n"))
+	})
+}
+
+// newReadyHandler returns handler of /-/ready. Labeler is ready if it's not shutting down and the bucket responds.
+func (p *probe) newReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.shuttingDown.Load() {
+			httpErrHandle(w, r, errShuttingDown)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+		defer cancel()
+		if _, err := p.bkt.Exists(ctx, readyCheckObject); err != nil {
+			httpErrHandle(w, r, withCode(codeUnavailable, errors.Wrap(err, "bucket is not reachable")))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("Ready.\n"))
+	})
+}
+
+// rejectWhenShuttingDown returns handler responding with 503 once shutdown started, so requests coming on already
+// open connections are not started when server waits for the in-flight ones.
+func (p *probe) rejectWhenShuttingDown(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.shuttingDown.Load() {
+			w.Header().Set("Connection", "close")
+			httpErrHandle(w, r, errShuttingDown)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// shutdown marks labeler as shutting down and stops srv gracefully: it stops accepting connections and waits up to
+// timeout for in-flight requests. Requests still running after timeout are cut off.
+func (p *probe) shutdown(srv *http.Server, timeout time.Duration) error {
+	p.shuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		_ = srv.Close()
+		return errors.Wrapf(err, "in-flight requests did not finish within %v", timeout)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+// unreachableBucket fails all existence checks and attribute reads.
+type unreachableBucket struct {
+	objstore.Bucket
+}
+
+func (unreachableBucket) Exists(context.Context, string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func (unreachableBucket) Attributes(context.Context, string) (objstore.ObjectAttributes, error) {
+	return objstore.ObjectAttributes{}, errors.New("connection refused")
+}
+
+func TestProbe_Ready(t *testing.T) {
+	for _, tcase := range []struct {
+		bkt          objstore.BucketReader
+		shuttingDown bool
+		expected     int
+	}{
+		{bkt: objstore.NewInMemBucket(), expected: http.StatusOK},
+		{bkt: unreachableBucket{Bucket: objstore.NewInMemBucket()}, expected: http.StatusServiceUnavailable},
+		{bkt: objstore.NewInMemBucket(), shuttingDown: true, expected: http.StatusServiceUnavailable},
+	} {
+		p := newProbe(tcase.bkt)
+		p.shuttingDown.Store(tcase.shuttingDown)
+
+		w := httptest.NewRecorder()
+		p.newReadyHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+		testutil.Equals(t, tcase.expected, w.Code)
+
+		// Healthy regardless of the bucket and shutdown.
+		w = httptest.NewRecorder()
+		p.newHealthyHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/-/healthy", nil))
+		testutil.Equals(t, http.StatusOK, w.Code)
+	}
+}
+
+// startBlockingServer serves /label_object with labelFunc blocked until unblock is closed. Each started labeling is
+// sent to started.
+func startBlockingServer(t *testing.T, p *probe) (srv *http.Server, addr string, started chan struct{}, unblock chan struct{}, served chan error) {
+	t.Helper()
+
+	started, unblock, served = make(chan struct{}, 1), make(chan struct{}), make(chan error, 1)
+	labelFn := func(ctx context.Context, objID string) (label, error) {
+		started <- struct{}{}
+		<-unblock
+		return label{ObjID: objID, Sum: 3}, nil
+	}
+	m := http.NewServeMux()
+	m.Handle("/label_object", p.rejectWhenShuttingDown(newLabelHandler(labelFn)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	srv = &http.Server{Handler: m}
+	go func() { served <- srv.Serve(l) }()
+	return srv, l.Addr().String(), started, unblock, served
+}
+
+func TestProbe_Shutdown(t *testing.T) {
+	p := newProbe(objstore.NewInMemBucket())
+	srv, addr, started, unblock, served := startBlockingServer(t, p)
+
+	type result struct {
+		code int
+		lbl  label
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		r, err := http.Get("http://" + addr + "/label_object?object_id=obj.txt")
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer r.Body.Close()
+
+		var lbl label
+		err = json.NewDecoder(r.Body).Decode(&lbl)
+		res <- result{code: r.StatusCode, lbl: lbl, err: err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.shutdown(srv, 1*time.Minute) }()
+	for !p.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New requests are rejected, while the in-flight one is waited for.
+	w := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/label_object?object_id=obj.txt", nil))
+	testutil.Equals(t, http.StatusServiceUnavailable, w.Code)
+	select {
+	case err := <-shutdown:
+		t.Fatal("shutdown finished with in-flight request", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(unblock)
+	r := <-res
+	testutil.Ok(t, r.err)
+	testutil.Equals(t, http.StatusOK, r.code)
+	testutil.Equals(t, label{ObjID: "obj.txt", Sum: 3}, r.lbl)
+	testutil.Ok(t, <-shutdown)
+	testutil.Equals(t, http.ErrServerClosed, <-served)
+}
+
+func TestProbe_ShutdownTimeout(t *testing.T) {
+	p := newProbe(objstore.NewInMemBucket())
+	srv, addr, started, unblock, served := startBlockingServer(t, p)
+	t.Cleanup(func() { close(unblock) })
+
+	res := make(chan error, 1)
+	go func() {
+		r, err := http.Get("http://" + addr + "/label_object?object_id=obj.txt")
+		if err == nil {
+			_, err = io.ReadAll(r.Body)
+			_ = r.Body.Close()
+		}
+		res <- err
+	}()
+	<-started
+
+	// Request not finished within the timeout is cut off.
+	testutil.NotOk(t, p.shutdown(srv, 10*time.Millisecond))
+	testutil.NotOk(t, <-res)
+	testutil.Equals(t, http.ErrServerClosed, <-served)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// indexEntry is a label of the object persisted in labelIndex, with object attributes it was computed for.
+type indexEntry struct {
+	label
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	LabeledAt    time.Time `json:"labeled_at"`
+
+	// Deleted marks the record removing object from the index.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// labelIndex is a map of object labels persisted in a local file. The file is a log of JSON records (indexEntry),
+// one per line, where the last record of the object wins. Puts only append to the file, so they are cheap and a
+// crash can only lose the last, partially written record. Records overwritten by later ones are dropped by compact.
+type labelIndex struct {
+	path string
+
+	mtx     sync.RWMutex
+	f       *os.File
+	entries map[string]indexEntry
+	// stale is the number of records in the file which are overwritten by later records.
+	stale int
+}
+
+// openLabelIndex opens index from the file in path, creating it if it does not exist.
+func openLabelIndex(path string) (_ *labelIndex, err error) {
+	i := &labelIndex{path: path, entries: map[string]indexEntry{}}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for n, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		e := indexEntry{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			if n == bytes.Count(b, []byte("\n")) {
+				// Last record without newline was not fully written before crash, compact drops it.
+				i.stale++
+				break
+			}
+			return nil, errors.Wrapf(err, "parse index %v record %v", path, n+1)
+		}
+		i.apply(e)
+	}
+
+	if i.stale > 0 {
+		// Start with a clean file, so it does not grow across restarts.
+		if err := i.compact(); err != nil {
+			return nil, err
+		}
+		return i, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if i.f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *labelIndex) apply(e indexEntry) {
+	if _, ok := i.entries[e.ObjID]; ok {
+		i.stale++
+	}
+	if e.Deleted {
+		delete(i.entries, e.ObjID)
+		// Tombstone itself is stale too.
+		i.stale++
+		return
+	}
+	i.entries[e.ObjID] = e
+}
+
+func (i *labelIndex) get(objID string) (indexEntry, bool) {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+
+	e, ok := i.entries[objID]
+	return e, ok
+}
+
+// put persists entry, replacing the previous one of the same object.
+func (i *labelIndex) put(e indexEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.f == nil {
+		return errors.New("index is closed")
+	}
+	if _, err := i.f.Write(append(b, '\n')); err != nil {
+		return errors.Wrapf(err, "write index %v", i.path)
+	}
+	i.apply(e)
+	return nil
+}
+
+// delete removes object from the index. It's a no-op if object is not indexed.
+func (i *labelIndex) delete(objID string) error {
+	if _, ok := i.get(objID); !ok {
+		return nil
+	}
+	return i.put(indexEntry{label: label{ObjID: objID}, Deleted: true})
+}
+
+// list returns entries of objects with the given prefix, sorted by object ID.
+func (i *labelIndex) list(prefix string) []indexEntry {
+	i.mtx.RLock()
+	ret := make([]indexEntry, 0, len(i.entries))
+	for id, e := range i.entries {
+		if strings.HasPrefix(id, prefix) {
+			ret = append(ret, e)
+		}
+	}
+	i.mtx.RUnlock()
+
+	sort.Slice(ret, func(a, b int) bool { return ret[a].ObjID < ret[b].ObjID })
+	return ret
+}
+
+// sync flushes index file to the disk and compacts it, if more than half of the records are stale.
+func (i *labelIndex) sync() error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.f == nil {
+		return errors.New("index is closed")
+	}
+	if i.stale > len(i.entries) {
+		return i.compact()
+	}
+	return i.f.Sync()
+}
+
+// compact rewrites the file with only the current entries. It has to be called with mtx locked or before index is used.
+func (i *labelIndex) compact() (err error) {
+	if err := os.MkdirAll(filepath.Dir(i.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(i.path), filepath.Base(i.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range i.entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), i.path); err != nil {
+		return errors.Wrapf(err, "compact index %v", i.path)
+	}
+
+	// Temporary file is now the index, keep appending to it.
+	if i.f != nil {
+		_ = i.f.Close()
+	}
+	i.f = tmp
+	i.stale = 0
+	return nil
+}
+
+func (i *labelIndex) Close() error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.f == nil {
+		return nil
+	}
+	err := i.f.Sync()
+	if cerr := i.f.Close(); err == nil {
+		err = cerr
+	}
+	i.f = nil
+	return err
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestLabelIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index", "labels.ndjson")
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	i, err := openLabelIndex(path)
+	testutil.Ok(t, err)
+
+	for _, e := range []indexEntry{
+		{label: label{ObjID: "a/1.txt", Sum: 1}, Size: 2, LastModified: modified},
+		{label: label{ObjID: "a/2.txt", Sum: 2, CheckSum: []byte{1, 2}}, Size: 2, LastModified: modified},
+		{label: label{ObjID: "b/3.txt", Sum: 3}, Size: 2, LastModified: modified},
+		{label: label{ObjID: "a/1.txt", Sum: 10}, Size: 3, LastModified: modified.Add(time.Second)},
+	} {
+		testutil.Ok(t, i.put(e))
+	}
+	testutil.Ok(t, i.delete("b/3.txt"))
+	testutil.Ok(t, i.delete("not-indexed"))
+
+	e, ok := i.get("a/1.txt")
+	testutil.Assert(t, ok)
+	testutil.Equals(t, int64(10), e.Sum)
+	_, ok = i.get("b/3.txt")
+	testutil.Assert(t, !ok)
+
+	exp := []indexEntry{
+		{label: label{ObjID: "a/1.txt", Sum: 10}, Size: 3, LastModified: modified.Add(time.Second)},
+		{label: label{ObjID: "a/2.txt", Sum: 2, CheckSum: []byte{1, 2}}, Size: 2, LastModified: modified},
+	}
+	testutil.Equals(t, exp, i.list("a/"))
+	testutil.Equals(t, exp, i.list(""))
+	testutil.Equals(t, 0, len(i.list("b/")))
+	testutil.Ok(t, i.Close())
+	testutil.NotOk(t, i.put(exp[0]))
+
+	// Reopening compacts overwritten and deleted records.
+	b, err := os.ReadFile(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, bytes.Count(b, []byte("\n")))
+
+	i, err = openLabelIndex(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, exp, i.list(""))
+	b, err = os.ReadFile(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, bytes.Count(b, []byte("\n")))
+
+	// Appends continue after compaction.
+	testutil.Ok(t, i.put(indexEntry{label: label{ObjID: "c/4.txt", Sum: 4}}))
+	testutil.Ok(t, i.Close())
+
+	i, err = openLabelIndex(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(i.list("")))
+	testutil.Ok(t, i.Close())
+}
+
+func TestLabelIndex_TornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.ndjson")
+
+	i, err := openLabelIndex(path)
+	testutil.Ok(t, err)
+	testutil.Ok(t, i.put(indexEntry{label: label{ObjID: "a/1.txt", Sum: 1}}))
+	testutil.Ok(t, i.Close())
+
+	// Crash in the middle of writing the last record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	testutil.Ok(t, err)
+	_, err = f.WriteString(`{"object_id":"a/2.txt","su`)
+	testutil.Ok(t, err)
+	testutil.Ok(t, f.Close())
+
+	i, err = openLabelIndex(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []indexEntry{{label: label{ObjID: "a/1.txt", Sum: 1}}}, i.list(""))
+	testutil.Ok(t, i.put(indexEntry{label: label{ObjID: "a/2.txt", Sum: 2}}))
+	testutil.Ok(t, i.Close())
+
+	i, err = openLabelIndex(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(i.list("")))
+	testutil.Ok(t, i.Close())
+
+	// Corrupted record in the middle is not a crash, index can't be trusted.
+	testutil.Ok(t, os.WriteFile(path, []byte("{\"object_id\":\"a/1.txt\"}\nnot json\n{\"object_id\":\"a/2.txt\"}\n"), os.ModePerm))
+	_, err = openLabelIndex(path)
+	testutil.NotOk(t, err)
+}
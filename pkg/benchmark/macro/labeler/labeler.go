@@ -5,14 +5,14 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
+	"go-advanced/pkg/benchmark/micro"
 	"io"
 	"os"
 	"sync"
 
 	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/examples/pkg/profile/fd"
-	"github.com/efficientgo/examples/pkg/sum"
 	"github.com/gobwas/pool/pbytes"
 	"github.com/thanos-io/objstore"
 )
@@ -34,40 +34,93 @@ type labeler struct {
 	pool         sync.Pool
 	bucketedPool *pbytes.Pool
 	buf          []byte
+	// budget limits memory used by buffers of all labelers, if set.
+	budget *memoryBudget
+
+	// ranges is the number of ranges labelObject5 labels concurrently, unless request selects it, up to maxRanges
+	// (0 means no limit). rangePool pools their buffers.
+	ranges, maxRanges int
+	rangePool         sync.Pool
+
+	// decompressors are used for objects stored compressed (see micro.CodecFromName and micro.DetectCodec).
+	decompressors micro.DecompressorPool
+}
+
+// decompressed returns reader decompressing rc while streaming if object is compressed, otherwise rc as it is.
+// Close releases pooled decompressor, it does not close rc.
+func (l *labeler) decompressed(rc io.Reader, objID string) (io.ReadCloser, error) {
+	return l.decompressors.NewReader(rc, objID)
+}
+
+// bucketStream marks read errors of the bucket stream as upstream unavailable, like bucketErr. Stream ending before
+// size bytes fails too, instead of labeling truncated content. Negative size means it's not known.
+type bucketStream struct {
+	r    io.Reader
+	left int64
+}
+
+func newBucketStream(r io.Reader, size int64) *bucketStream { return &bucketStream{r: r, left: size} }
+
+func (s *bucketStream) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if s.left >= 0 {
+		s.left -= int64(n)
+	}
+	switch {
+	case err == io.EOF && s.left > 0:
+		err = withCode(codeUpstreamUnavailable, errors.Newf("stream ended %v bytes before the end of the object", s.left))
+	case err != nil && err != io.EOF:
+		err = withCode(codeUpstreamUnavailable, err)
+	}
+	return n, err
 }
 
 func (l *labeler) labelObject1(ctx context.Context, objID string) (_ label, err error) {
 	a, err := l.bkt.Attributes(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	rc, err := l.bkt.Get(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	defer errcapture.Do(&err, rc.Close, "close stream")
 
-	buf := make([]byte, bufferSize(int(a.Size)))
-	s, err := sum.Sum6Reader(rc, buf)
+	bufSize, release, err := l.reserve(ctx, bufferSize(int(a.Size)))
 	if err != nil {
 		return label{}, err
 	}
+	defer release()
 
-	// Get/calculate other attributes...
+	buf := make([]byte, bufSize)
+	r, err := l.decompressed(newBucketStream(rc, a.Size), objID)
+	if err != nil {
+		return label{}, err
+	}
+	defer errcapture.Do(&err, r.Close, "release decompressor")
 
-	return label{
-		ObjID: objID,
-		Sum:   s,
-		// ...
-	}, nil
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	if _, err := io.CopyBuffer(p, r, buf); err != nil {
+		return label{}, err
+	}
+	return p.label(objID)
 }
 
 func (l *labeler) labelObjectNaive(ctx context.Context, objID string) (_ label, err error) {
+	// Size is needed only to detect truncated streams.
+	a, err := l.bkt.Attributes(ctx, objID)
+	if err != nil {
+		return label{}, bucketErr(l.bkt, err)
+	}
+
 	rc, err := l.bkt.Get(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	// Download file first.
@@ -81,126 +134,161 @@ func (l *labeler) labelObjectNaive(ctx context.Context, objID string) (_ label,
 		_ = os.RemoveAll(f.Name())
 	}()
 
-	h := sha256.New()
-
-	// Write to both checksum hash and file.
-	if _, err := io.Copy(f, io.TeeReader(rc, h)); err != nil {
+	r, err := l.decompressed(newBucketStream(rc, a.Size), objID)
+	if err != nil {
+		return label{}, err
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return label{}, err
+	}
+	if err := r.Close(); err != nil {
 		return label{}, err
 	}
 	if err := rc.Close(); err != nil {
 		return label{}, err
 	}
 
-	s, err := sum.Sum(f.Name())
+	// Naive, whole object in memory, unless it does not fit into the memory budget.
+	wanted := int(size)
+	if wanted == 0 {
+		wanted = 1
+	}
+	bufSize, release, err := l.reserve(ctx, wanted)
 	if err != nil {
 		return label{}, err
 	}
+	defer release()
 
-	// Get/calculate other attributes...
-
-	return label{
-		ObjID:    objID,
-		Sum:      s,
-		CheckSum: h.Sum(nil),
-		// ...
-	}, nil
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return label{}, err
+	}
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	// File implements io.WriterTo, which would copy with its own buffer instead of the reserved one.
+	if _, err := io.CopyBuffer(p, struct{ io.Reader }{f}, make([]byte, bufSize)); err != nil {
+		return label{}, err
+	}
+	return p.label(objID)
 }
 
 func (l *labeler) labelObject2(ctx context.Context, objID string) (_ label, err error) {
 	a, err := l.bkt.Attributes(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	rc, err := l.bkt.Get(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	defer errcapture.Do(&err, rc.Close, "close stream")
 
-	bufSize := bufferSize(int(a.Size))
-	buf := l.pool.Get().([]byte)
-	if cap(buf) < bufSize {
-		buf = make([]byte, bufSize)
+	wanted := bufferSize(int(a.Size))
+	bufSize, release, err := l.reserve(ctx, wanted)
+	if err != nil {
+		return label{}, err
 	}
+	defer release()
+
+	buf := fitBuffer(l.pool.Get().([]byte), bufSize, wanted)
 	defer func() { l.pool.Put(buf) }()
 
-	s, err := sum.Sum6Reader(rc, buf[:bufSize])
+	r, err := l.decompressed(newBucketStream(rc, a.Size), objID)
 	if err != nil {
 		return label{}, err
 	}
+	defer errcapture.Do(&err, r.Close, "release decompressor")
 
-	// Get/calculate other attributes...
-
-	return label{
-		ObjID: objID,
-		Sum:   s,
-		// ...
-	}, nil
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	if _, err := io.CopyBuffer(p, r, buf); err != nil {
+		return label{}, err
+	}
+	return p.label(objID)
 }
 
 func (l *labeler) labelObject3(ctx context.Context, objID string) (_ label, err error) {
 	a, err := l.bkt.Attributes(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	rc, err := l.bkt.Get(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	defer errcapture.Do(&err, rc.Close, "close stream")
 
-	bufSize := bufferSize(int(a.Size))
-	buf := l.bucketedPool.Get(bufSize, bufSize)
-	if cap(buf) < bufSize {
-		buf = make([]byte, bufSize)
+	wanted := bufferSize(int(a.Size))
+	bufSize, release, err := l.reserve(ctx, wanted)
+	if err != nil {
+		return label{}, err
 	}
+	defer release()
+
+	buf := fitBuffer(l.bucketedPool.Get(bufSize, bufSize), bufSize, wanted)
 	defer func() { l.bucketedPool.Put(buf) }()
 
-	s, err := sum.Sum6Reader(rc, buf[:bufSize])
+	r, err := l.decompressed(newBucketStream(rc, a.Size), objID)
 	if err != nil {
 		return label{}, err
 	}
+	defer errcapture.Do(&err, r.Close, "release decompressor")
 
-	// Get/calculate other attributes...
-
-	return label{
-		ObjID: objID,
-		Sum:   s,
-		// ...
-	}, nil
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	if _, err := io.CopyBuffer(p, r, buf); err != nil {
+		return label{}, err
+	}
+	return p.label(objID)
 }
 
 func (l *labeler) labelObject4(ctx context.Context, objID string) (_ label, err error) {
 	a, err := l.bkt.Attributes(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	rc, err := l.bkt.Get(ctx, objID)
 	if err != nil {
-		return label{}, err
+		return label{}, bucketErr(l.bkt, err)
 	}
 
 	defer errcapture.Do(&err, rc.Close, "close stream")
 
-	bufSize := bufferSize(int(a.Size))
-	if cap(l.buf) < bufSize {
-		l.buf = make([]byte, bufSize)
-	}
-	s, err := sum.Sum6Reader(rc, l.buf[:bufSize])
+	wanted := bufferSize(int(a.Size))
+	bufSize, release, err := l.reserve(ctx, wanted)
 	if err != nil {
 		return label{}, err
 	}
+	defer release()
 
-	// Get/calculate other attributes...
+	l.buf = fitBuffer(l.buf, bufSize, wanted)
+	if l.budget != nil {
+		// Buffer is reused by the next object only without the memory budget, as it's released from the budget here.
+		defer func() { l.buf = nil }()
+	}
+	r, err := l.decompressed(newBucketStream(rc, a.Size), objID)
+	if err != nil {
+		return label{}, err
+	}
+	defer errcapture.Do(&err, r.Close, "release decompressor")
 
-	return label{
-		ObjID: objID,
-		Sum:   s,
-		// ...
-	}, nil
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	if _, err := io.CopyBuffer(p, r, l.buf); err != nil {
+		return label{}, err
+	}
+	return p.label(objID)
 }
@@ -76,6 +76,7 @@ func TestLabeler_LabelObject(t *testing.T) {
 					},
 				}),
 			),
+			Readiness: e2e.NewHTTPReadinessProbe("http", "/-/ready", 200, 200),
 		}), "http")
 	testutil.Ok(t, e2e.StartAndWaitReady(labeler))
 
@@ -123,7 +124,7 @@ EOF
 	testutil.Ok(t, e2e.StartAndWaitReady(k6))
 
 	url := fmt.Sprintf(
-		"http://%s/label_object?object_id=object1.txt",
+		"http://%s/label_object?object_id=object1.txt&stage=sum,checksum",
 		labeler.InternalEndpoint("http"),
 	)
 	testutil.Ok(t, k6.Exec(e2e.NewCommand( // k6 batch jobs with config: 1 virtual user (-u 1), 5 minutes duration (-d 5m).
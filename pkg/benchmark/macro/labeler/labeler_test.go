@@ -6,6 +6,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"go-advanced/pkg/benchmark/micro"
 	"runtime"
 	"sync"
 	"testing"
@@ -99,6 +101,11 @@ func BenchmarkLabeler(b *testing.B) {
 
 		bench1(b, l.labelObject4)
 	})
+	b.Run("labelObject5", func(b *testing.B) {
+		l := &labeler{bkt: bkt, ranges: runtime.GOMAXPROCS(0)}
+
+		bench1(b, l.labelObject5)
+	})
 }
 
 func TestLabeler(t *testing.T) {
@@ -171,4 +178,113 @@ func TestLabeler(t *testing.T) {
 		testutil.Ok(t, err)
 		testutil.Equals(t, exp2, ret.Sum)
 	})
+	t.Run("labelObject5", func(t *testing.T) {
+		l := &labeler{bkt: bkt, ranges: 4}
+
+		ret, err := l.labelObject5(ctx, "2M.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp1, ret.Sum)
+		ret, err = l.labelObject5(ctx, "100M.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp2, ret.Sum)
+	})
+}
+
+func uploadCompressed(tb testing.TB, bkt objstore.Bucket, name string, codec micro.Codec, input []byte) {
+	tb.Helper()
+
+	b := bytes.Buffer{}
+	w, err := micro.NewCompressor(&b, codec)
+	testutil.Ok(tb, err)
+	_, err = w.Write(input)
+	testutil.Ok(tb, err)
+	testutil.Ok(tb, w.Close())
+	testutil.Ok(tb, bkt.Upload(context.Background(), name, &b))
+}
+
+func TestLabeler_Compressed(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	buf := bytes.Buffer{}
+	exp, err := sumtestutil.CreateTestInputWithExpectedResult(&buf, 2e6)
+	testutil.Ok(t, err)
+
+	// Compression is detected from the suffix or, if there is none, from magic bytes.
+	objIDs := []string{"2M.txt"}
+	testutil.Ok(t, bkt.Upload(ctx, "2M.txt", bytes.NewReader(buf.Bytes())))
+	for _, codec := range []micro.Codec{micro.CodecGzip, micro.CodecZstd, micro.CodecSnappy} {
+		uploadCompressed(t, bkt, "2M.txt."+codec.String(), codec, buf.Bytes())
+		objIDs = append(objIDs, "2M.txt."+codec.String())
+	}
+	uploadCompressed(t, bkt, "2M.txt.gz", micro.CodecGzip, buf.Bytes())
+	uploadCompressed(t, bkt, "2M.txt.zst", micro.CodecZstd, buf.Bytes())
+	uploadCompressed(t, bkt, "2M.txt.sz", micro.CodecSnappy, buf.Bytes())
+	objIDs = append(objIDs, "2M.txt.gz", "2M.txt.zst", "2M.txt.sz")
+
+	l := &labeler{bkt: bkt, tmpDir: t.TempDir()}
+	l.pool.New = func() any { return []byte(nil) }
+	l.bucketedPool = pbytes.New(1e3, 10e6)
+
+	for name, labelFn := range map[string]labelFunc{
+		"labelObjectNaive": l.labelObjectNaive,
+		"labelObject1":     l.labelObject1,
+		"labelObject2":     l.labelObject2,
+		"labelObject3":     l.labelObject3,
+		"labelObject4":     l.labelObject4,
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, objID := range objIDs {
+				// Twice to use pooled decompressors.
+				for i := 0; i < 2; i++ {
+					ret, err := labelFn(ctx, objID)
+					testutil.Ok(t, err, objID)
+					testutil.Equals(t, exp, ret.Sum, objID)
+				}
+			}
+		})
+	}
+
+	// Checksum is of the content, so it's the same for all functions, however object is stored.
+	content := sha256.Sum256(buf.Bytes())
+	checksumCtx := withStages(ctx, []string{"checksum", "sum"})
+	for _, objID := range objIDs {
+		for _, labelFn := range []labelFunc{l.labelObjectNaive, l.labelObject1} {
+			ret, err := labelFn(checksumCtx, objID)
+			testutil.Ok(t, err, objID)
+			testutil.Equals(t, content[:], ret.CheckSum, objID)
+		}
+	}
+}
+
+// BenchmarkLabeler_Compressed shows the cost of decompression per codec.
+// Recommended run options:
+// $ export ver=v1 && go test -run '^$' -bench '^BenchmarkLabeler_Compressed' -benchtime 100x -count 6 -cpu 1 -benchmem | tee ${ver}.txt
+func BenchmarkLabeler_Compressed(b *testing.B) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+
+	buf := bytes.Buffer{}
+	_, err := sumtestutil.CreateTestInputWithExpectedResult(&buf, 1e7)
+	testutil.Ok(b, err)
+
+	for _, codec := range []micro.Codec{micro.CodecNone, micro.CodecGzip, micro.CodecZstd, micro.CodecSnappy} {
+		objID := "10M.txt"
+		if codec != micro.CodecNone {
+			objID += "." + codec.String()
+		}
+		uploadCompressed(b, bkt, objID, codec, buf.Bytes())
+
+		b.Run(codec.String(), func(b *testing.B) {
+			l := &labeler{bkt: bkt}
+			l.pool.New = func() any { return []byte(nil) }
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := l.labelObject2(ctx, objID)
+				testutil.Ok(b, err)
+			}
+		})
+	}
 }
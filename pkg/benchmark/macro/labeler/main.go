@@ -5,28 +5,36 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"go-advanced/pkg/benchmark/macro/grpcmiddleware"
 	"go-advanced/pkg/benchmark/macro/httpmidleware"
+	"go-advanced/pkg/benchmark/macro/labeler/labelerpb"
 	stdlog "log"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
-	"sync"
+	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/efficientgo/core/errcapture"
 	"github.com/efficientgo/core/errors"
 	"github.com/felixge/fgprof"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
-	"github.com/gobwas/pool/pbytes"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
-	"github.com/thanos-io/objstore/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -34,13 +42,8 @@ const (
 	labelObject2 = "labelObject2"
 	labelObject3 = "labelObject3"
 	labelObject4 = "labelObject4"
-)
-
-var (
-	labelerFlags       = flag.NewFlagSet("labeler-v1", flag.ExitOnError)
-	addr               = labelerFlags.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
-	objstoreConfigYAML = labelerFlags.String("objstore.config", "", "Configuration YAML for object storage to label objects against")
-	labelerFunction    = labelerFlags.String("function", "labelObjectNaive", "The function to use for labeling. labelObjectNaive, "+labelObject1+", "+labelObject2+", "+labelObject3+","+labelObject4)
+	labelObject5 = "labelObject5"
+	labelObject6 = "labelObject6"
 )
 
 func main() {
@@ -50,8 +53,95 @@ func main() {
 	}
 }
 
-func runMain(ctx context.Context, args []string) (err error) {
+// parseFlags parses args with a new flag set, so each call starts from default values, and returns config with flag
+// values and the -config.file path.
+func parseFlags(args []string) (config, string, error) {
+	var (
+		labelerFlags        = flag.NewFlagSet("labeler-v1", flag.ExitOnError)
+		configFile          = labelerFlags.String("config.file", "", "YAML configuration file overriding values of flags. It's reloaded on SIGHUP or POST to /-/reload.")
+		addr                = labelerFlags.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
+		grpcAddr            = labelerFlags.String("grpc.listen-address", ":8090", "The address to listen on for gRPC requests. gRPC API is disabled if empty.")
+		objstoreConfigYAML  = labelerFlags.String("objstore.config", "", "Configuration YAML for object storage to label objects against")
+		labelerFunction     = labelerFlags.String("function", "labelObjectNaive", "The function to use for labeling. labelObjectNaive, "+labelObject1+", "+labelObject2+", "+labelObject3+","+labelObject4+", "+labelObject5+", "+labelObject6)
+		rangesConcurrency   = labelerFlags.Int("ranges.concurrency", 4, "Number of ranges of the object "+labelObject5+" sums at once, unless request sets range_concurrency parameter.")
+		rangesMax           = labelerFlags.Int("ranges.max-concurrency", 32, "Maximum range_concurrency parameter of "+labelObject5+" requests.")
+		resumeInterval      = labelerFlags.Int64("resume.checkpoint-interval", 64<<20, "Number of bytes "+labelObject6+" labels between checkpoints it resumes from after bucket failures.")
+		resumeDir           = labelerFlags.String("resume.dir", "", "Directory persisting "+labelObject6+" checkpoints, so labeling resumes after restart too. Checkpoints are kept only in memory if empty.")
+		resumeMaxRetries    = labelerFlags.Int("resume.max-retries", 5, "Maximum number of "+labelObject6+" retries in a row without progress after bucket failures.")
+		resumeMinBackoff    = labelerFlags.Duration("resume.min-backoff", 100*time.Millisecond, "Time "+labelObject6+" waits before the first retry. It doubles with each retry without progress.")
+		resumeMaxBackoff    = labelerFlags.Duration("resume.max-backoff", 10*time.Second, "Maximum time "+labelObject6+" waits before retry.")
+		batchConcurrency    = labelerFlags.Int("batch.concurrency", 4, "Maximum number of objects labeled at once by a single /label_objects request. With "+labelObject4+" objects above -admission.workers wait in the admission queue.")
+		admissionWorkers    = labelerFlags.Int("admission.workers", 4, "Number of "+labelObject4+" labelers, each with its own buffer, so maximum number of objects labeled at once.")
+		admissionQueueSize  = labelerFlags.Int("admission.queue-size", 16, "Maximum number of requests waiting for a free "+labelObject4+" labeler. Requests above it are rejected with 429.")
+		admissionMaxWait    = labelerFlags.Duration("admission.max-wait", 10*time.Second, "Maximum time request waits for a free "+labelObject4+" labeler before it's rejected with 429, unless request is canceled earlier.")
+		admissionRetryAfter = labelerFlags.Duration("admission.retry-after", 1*time.Second, "Retry-After returned with 429 when request was not admitted.")
+		poolBucketedMinSize = labelerFlags.Int("pool.bucketed-min-size", 1e3, "Size of the smallest buffers in the "+labelObject3+" bucketed pool.")
+		poolBucketedMaxSize = labelerFlags.Int("pool.bucketed-max-size", 10e6, "Size of the biggest buffers in the "+labelObject3+" bucketed pool.")
+		memoryBudgetBytes   = labelerFlags.Int("memory.budget", 0, "Maximum number of bytes of buffers used by all labeling requests at once. Requests above it get smaller buffers or wait. 0 means no limit.")
+		uploadMaxBodySize   = labelerFlags.Int64("upload.max-body-size", 100<<20, "Maximum size of /label request body in bytes. Bigger bodies are rejected with 413.")
+		uploadPrefix        = labelerFlags.String("upload.prefix", "uploads/", "Prefix of keys of /label request bodies persisted with persist=true parameter. Key ends with sha256 of the body.")
+		crawlPrefixes       = &stringsFlag{}
+		crawlInterval       = labelerFlags.Duration("crawl.interval", 5*time.Minute, "Time between crawls of all prefixes.")
+		crawlConcurrency    = labelerFlags.Int("crawl.concurrency", 2, "Maximum number of objects labeled at once by the crawler. It adds up with /label_objects requests.")
+		indexPath           = labelerFlags.String("index.path", "./labels-index.ndjson", "Local file persisting labels of crawled objects.")
+		cacheBackend        = labelerFlags.String("cache.backend", "none", "Cache of labels by object ID, size and modification time: none, memory or disk.")
+		cacheSize           = labelerFlags.Int("cache.size", 10000, "Maximum number of cached labels.")
+		cacheTTL            = labelerFlags.Duration("cache.ttl", 1*time.Hour, "Maximum time label is cached for.")
+		cacheDir            = labelerFlags.String("cache.dir", "./cache", "Directory for cached labels, if -cache.backend=disk.")
+		writeBack           = labelerFlags.Bool("write-back", false, "If true, labels are uploaded as <object ID>.label.json sidecars next to objects, so other systems can discover them. Labels are served from sidecars until the object, stages or labeling algorithm change.")
+		tlsCertFile         = labelerFlags.String("tls.cert-file", "", "TLS certificate file to serve HTTPS with. Reloaded with the configuration.")
+		tlsKeyFile          = labelerFlags.String("tls.key-file", "", "TLS key file of -tls.cert-file.")
+		shutdownTimeout     = labelerFlags.Duration("shutdown.timeout", 30*time.Second, "Maximum time in-flight requests are waited for on shutdown, before they are cut off. New requests are rejected with 503 meanwhile.")
+		labelStages         = labelerFlags.String("stages", "sum", "Comma separated label stages used if request does not select any with the stage parameter, and by the crawler. Available: sum, checksum, lines, minmax, histogram, sha256, crc32c, content_type.")
+	)
+	labelerFlags.Var(crawlPrefixes, "crawl.prefix", "Prefix of objects to label in the background and serve from /labels. Can be repeated. Empty prefix means the whole bucket. Crawling is disabled if not set.")
 	if err := labelerFlags.Parse(args); err != nil {
+		return config{}, "", err
+	}
+
+	cfg := config{
+		ListenAddress:     *addr,
+		GRPCListenAddress: *grpcAddr,
+		Function:          *labelerFunction,
+		Stages:            strings.Split(*labelStages, ","),
+		Pools:             poolsConfig{BucketedMinSize: *poolBucketedMinSize, BucketedMaxSize: *poolBucketedMaxSize},
+		Batch:             batchConfig{Concurrency: *batchConcurrency},
+		Ranges:            rangesConfig{Concurrency: *rangesConcurrency, MaxConcurrency: *rangesMax},
+		Resume: resumeConfig{
+			CheckpointInterval: *resumeInterval,
+			Dir:                *resumeDir,
+			MaxRetries:         *resumeMaxRetries,
+			MinBackoff:         *resumeMinBackoff,
+			MaxBackoff:         *resumeMaxBackoff,
+		},
+		Admission: admissionConfig{
+			Workers:    *admissionWorkers,
+			QueueSize:  *admissionQueueSize,
+			MaxWait:    *admissionMaxWait,
+			RetryAfter: *admissionRetryAfter,
+		},
+		MemoryBudget: *memoryBudgetBytes,
+		Cache:        cacheConfig{Backend: *cacheBackend, Size: *cacheSize, TTL: *cacheTTL, Dir: *cacheDir},
+		WriteBack:    *writeBack,
+		Upload:       uploadConfig{MaxBodySize: *uploadMaxBodySize, Prefix: *uploadPrefix},
+		Crawl: crawlConfig{
+			Prefixes:    []string(*crawlPrefixes),
+			Interval:    *crawlInterval,
+			Concurrency: *crawlConcurrency,
+			IndexPath:   *indexPath,
+		},
+		TLS:             tlsConfig{CertFile: *tlsCertFile, KeyFile: *tlsKeyFile},
+		ShutdownTimeout: *shutdownTimeout,
+	}
+	if err := yaml.Unmarshal([]byte(*objstoreConfigYAML), &cfg.Objstore); err != nil {
+		return config{}, "", errors.Wrap(err, "parse -objstore.config")
+	}
+	return cfg, *configFile, nil
+}
+
+func runMain(ctx context.Context, args []string) (err error) {
+	defaults, configFile, err := parseFlags(args)
+	if err != nil {
 		return err
 	}
 
@@ -61,153 +151,207 @@ func runMain(ctx context.Context, args []string) (err error) {
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
-	if *objstoreConfigYAML == "" {
-		return errors.New("missing -objstore.config flag")
-	}
 
-	logger := log.NewLogfmtLogger(os.Stderr)
-	bkt, err := client.NewBucket(logger, []byte(*objstoreConfigYAML), reg, "labeler")
+	cfg, err := loadConfig(defaults, configFile)
 	if err != nil {
-		return errors.Wrap(err, "bucket create")
+		return err
 	}
 
-	l := &labeler{bkt: bkt}
-	var labelObjectFunc labelFunc
-	switch *labelerFunction {
-	case "labelObjectNaive":
-		l.tmpDir = "./tmp"
-		if err := os.RemoveAll(l.tmpDir); err != nil {
-			return errors.Wrap(err, "rm all")
-		}
-		if err := os.MkdirAll(l.tmpDir, os.ModePerm); err != nil {
-			return errors.Wrap(err, "mkdir all")
-		}
-
-		labelObjectFunc = l.labelObjectNaive
-	case labelObject1:
-		labelObjectFunc = l.labelObject1
-	case labelObject2:
-		l.pool.New = func() any { return []byte(nil) }
-		labelObjectFunc = l.labelObject2
-	case labelObject3:
-		l.bucketedPool = pbytes.New(1e3, 10e6)
-		labelObjectFunc = l.labelObject3
-	case labelObject4:
-		// Yolo.
-		labelerSet := [4]*labeler{
-			{bkt: bkt},
-			{bkt: bkt},
-			{bkt: bkt},
-			{bkt: bkt},
-		}
-		var used [4]bool
-		l := sync.Mutex{}
-
-		labelObjectFunc = func(ctx context.Context, objID string) (label, error) {
-			l.Lock()
-			found := -1
-			for i, u := range used {
-				if u {
-					continue
-				}
-				found = i
-			}
-			if found == -1 {
-				l.Unlock()
-				return label{}, errors.New("Did not expect more requests than 4 at the same time.")
-			}
-			used[found] = true
-			l.Unlock()
-
-			ret, err := labelerSet[found].labelObject4(ctx, objID)
-			l.Lock()
-			used[found] = false
-			l.Unlock()
-			return ret, err
-		}
-	default:
-		return errors.Newf("unknown function %v", *labelerFunction)
+	// Leftovers of labelObjectNaive from the previous run.
+	if err := os.RemoveAll(naiveTmpDir); err != nil {
+		return errors.Wrap(err, "rm all")
+	}
 
+	logger := log.NewLogfmtLogger(os.Stderr)
+	r, err := newReloader(logger, reg, defaults, configFile, cfg)
+	if err != nil {
+		return err
 	}
+	defer errcapture.Do(&err, r.Close, "close bucket")
 
 	metricMiddleware := httpmidleware.NewMiddleware(reg, nil)
 	m := http.NewServeMux()
 	m.Handle("/metrics", metricMiddleware.WrapHandler("/metric", promhttp.HandlerFor(
-		reg,
+		// Metrics of the current config are registered separately, so reload can register them again.
+		prometheus.Gatherers{reg, r},
 		promhttp.HandlerOpts{
 			// Opt into OpenMetrics to support exemplars.
 			EnableOpenMetrics: true,
 		},
 	)))
-	m.HandleFunc("/label_object", metricMiddleware.WrapHandler("/label_object", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	p := newProbe(reloadingBucket{r: r})
+	m.Handle("/label_object", metricMiddleware.WrapHandler("/label_object", p.rejectWhenShuttingDown(r)))
+	m.Handle("/label_objects", metricMiddleware.WrapHandler("/label_objects", p.rejectWhenShuttingDown(r)))
+	m.Handle("/label", metricMiddleware.WrapHandler("/label", p.rejectWhenShuttingDown(r)))
+	m.Handle("/-/reload", metricMiddleware.WrapHandler("/-/reload", newReloadHandler(r)))
+	m.Handle("/-/healthy", p.newHealthyHandler())
+	m.Handle("/-/ready", p.newReadyHandler())
+
+	//TODO:NOTE use `go tool pprof -http :8081 http://localhost:<port>/debug/pprof/<sample_type>` for rendering pprof profiles.
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/fgprof/profile", fgprof.Handler().ServeHTTP)
+
+	srv := http.Server{Addr: cfg.ListenAddress, Handler: m}
+	if cfg.TLS.enabled() {
+		srv.TLSConfig = &tls.Config{GetCertificate: r.getCertificate}
+	}
+
+	g := &run.Group{}
+	// index is nil if crawling is disabled.
+	var index *labelIndex
+	if len(cfg.Crawl.Prefixes) > 0 {
+		// Not shadowing err, so close error is returned.
+		if index, err = openLabelIndex(cfg.Crawl.IndexPath); err != nil {
+			return errors.Wrap(err, "open label index")
+		}
+		defer errcapture.Do(&err, index.Close, "close label index")
+
+		c := newCrawler(log.With(logger, "component", "crawler"), reg, reloadingBucket{r: r}, r.labelObject, index, cfg.Crawl.Prefixes, cfg.Crawl.Interval, cfg.Crawl.Concurrency)
+		crawlCtx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting crawler", "prefixes", strings.Join(cfg.Crawl.Prefixes, ","), "index", cfg.Crawl.IndexPath)
+			return c.run(crawlCtx)
+		}, func(error) {
+			cancel()
+		})
+		m.Handle("/labels", metricMiddleware.WrapHandler("/labels", p.rejectWhenShuttingDown(newLabelsHandler(index))))
+	}
+	g.Add(func() error {
+		level.Info(logger).Log("msg", "starting HTTP server", "addr", cfg.ListenAddress, "tls", cfg.TLS.enabled())
+		if cfg.TLS.enabled() {
+			// Certificates are from TLSConfig.
+			if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				return errors.Wrap(err, "starting web server")
+			}
+			return nil
+		}
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			return errors.Wrap(err, "starting web server")
+		}
+		return nil
+	}, func(error) {
+		// Timeout of the current config, as it could be reloaded.
+		timeout := r.config().ShutdownTimeout
+		level.Info(logger).Log("msg", "shutting down HTTP server", "timeout", timeout)
+		if err := p.shutdown(&srv, timeout); err != nil {
+			level.Error(logger).Log("msg", "failed to stop web server gracefully", "err", err)
+		}
+	})
+	if cfg.GRPCListenAddress != "" {
+		grpcMiddleware := grpcmiddleware.NewMiddleware(reg, nil)
+		opts := []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(grpcMiddleware.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(grpcMiddleware.StreamServerInterceptor()),
+		}
+		if cfg.TLS.enabled() {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{GetCertificate: r.getCertificate})))
+		}
+		grpcSrv := grpc.NewServer(opts...)
+		labelerpb.RegisterLabelerServer(grpcSrv, &grpcServer{acquire: r.acquire, index: index})
+
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting gRPC server", "addr", cfg.GRPCListenAddress, "tls", cfg.TLS.enabled())
+			l, err := net.Listen("tcp", cfg.GRPCListenAddress)
+			if err != nil {
+				return errors.Wrap(err, "listen gRPC")
+			}
+			if err := grpcSrv.Serve(l); err != nil {
+				return errors.Wrap(err, "starting gRPC server")
+			}
+			return nil
+		}, func(error) {
+			timeout := r.config().ShutdownTimeout
+			level.Info(logger).Log("msg", "shutting down gRPC server", "timeout", timeout)
+			if err := stopGRPC(grpcSrv, timeout); err != nil {
+				level.Error(logger).Log("msg", "failed to stop gRPC server gracefully", "err", err)
+			}
+		})
+	}
+	{
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		reloadCtx, cancel := context.WithCancel(ctx)
+		g.Add(func() error {
+			return runReloadOnSignal(reloadCtx, r, hup)
+		}, func(error) {
+			signal.Stop(hup)
+			cancel()
+		})
+	}
+	g.Add(run.SignalHandler(ctx, syscall.SIGINT, syscall.SIGTERM))
+	return g.Run()
+}
+
+// newLabelHandler returns handler of /label_object. It labels object given by `object_id` parameter with labelFn and
+// stages selected by `stage` parameters. `range_concurrency` parameter selects the number of ranges labelObject5 sums
+// at once.
+func newLabelHandler(labelFn labelFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("Handling request for %s\n", r.URL.Path)
 
 		ctx := r.Context()
 		w.Header().Add("Content-Type", "application/json; charset=utf-8")
 
 		if err := r.ParseForm(); err != nil {
-			httpErrHandle(w, http.StatusInternalServerError, err)
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
 		}
 
 		objectIDs := r.Form["object_id"]
 		if len(objectIDs) == 0 {
-			httpErrHandle(w, http.StatusBadRequest, errors.New("object_id parameter is required"))
+			httpErrHandle(w, r, withCode(codeInvalidInput, errors.New("object_id parameter is required")))
 			return
 		} else if len(objectIDs) > 1 {
-			httpErrHandle(w, http.StatusBadRequest, errors.New("only one object_id parameter is required"))
+			httpErrHandle(w, r, withCode(codeInvalidInput, errors.New("only one object_id parameter is required")))
 			return
 		}
 
-		// TODO(bwplotka): Discard request body.
+		stageNames, err := parseStages(r.Form["stage"])
+		if err != nil {
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
+		}
+		ranges, err := parseRangeConcurrency(r.Form["range_concurrency"])
+		if err != nil {
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
+		}
 
-		lbl, err := labelObjectFunc(ctx, objectIDs[0])
+		lbl, err := labelFn(withRangeConcurrency(withStages(ctx, stageNames), ranges), objectIDs[0])
 		if err != nil {
-			httpErrHandle(w, http.StatusInternalServerError, err)
+			setRetryAfter(w, err)
+			httpErrHandle(w, r, err)
 			return
 		}
 
 		b, err := json.Marshal(&lbl)
 		if err != nil {
-			httpErrHandle(w, http.StatusInternalServerError, err)
+			httpErrHandle(w, r, err)
 			return
 		}
 
 		if _, err := w.Write(b); err != nil {
-			httpErrHandle(w, http.StatusInternalServerError, err)
+			httpErrHandle(w, r, err)
 			return
 		}
-	})))
-
-	//TODO:NOTE use `go tool pprof -http :8081 http://localhost:<port>/debug/pprof/<sample_type>` for rendering pprof profiles.
-	m.HandleFunc("/debug/pprof/", pprof.Index)
-	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	m.HandleFunc("/debug/fgprof/profile", fgprof.Handler().ServeHTTP)
-
-	srv := http.Server{Addr: *addr, Handler: m}
-
-	g := &run.Group{}
-	g.Add(func() error {
-		level.Info(logger).Log("msg", "starting HTTP server", "addr", *addr)
-		if err := srv.ListenAndServe(); err != nil {
-			return errors.Wrap(err, "starting web server")
-		}
-		return nil
-	}, func(error) {
-		if err := srv.Close(); err != nil {
-			level.Error(logger).Log("msg", "failed to stop web server", "err", err)
-		}
 	})
-	g.Add(run.SignalHandler(ctx, syscall.SIGINT, syscall.SIGTERM))
-	return g.Run()
 }
 
-func httpErrHandle(w http.ResponseWriter, code int, err error) {
-	w.WriteHeader(code)
-	_, _ = w.Write([]byte("{ \"error\": \" " + err.Error() + "\"}"))
+// stringsFlag is a flag which can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
 }
 
 type label struct {
 	ObjID    string `json:"object_id"`
 	Sum      int64  `json:"sum"`
 	CheckSum []byte `json:"checksum"`
+	// Attributes are computed by the selected Labeler stages, by stage name.
+	Attributes map[string]json.RawMessage `json:"attributes,omitempty"`
 }
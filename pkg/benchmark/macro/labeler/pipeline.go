@@ -0,0 +1,432 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"go-advanced/pkg/benchmark/micro"
+	"hash"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// Labeler is a single stage of the label computation. Decompressed content of the object is written to all selected
+// stages in chunks, in a single pass, then each stage sets its attribute in Label.
+type Labeler interface {
+	// Write consumes the next chunk of the object. It must not retain the chunk.
+	Write(p []byte) (int, error)
+	// Label is called once after the whole object was written.
+	Label(lbl *label) error
+}
+
+// stages are all registered Labeler stages by name. Each stage sets attribute with its name, except "sum" and
+// "checksum", which set label.Sum and label.CheckSum.
+var stages = map[string]func() Labeler{}
+
+// registerStage makes stage available for selection by name. It panics if the name is already taken, so it's meant
+// to be called from init.
+func registerStage(name string, newStage func() Labeler) {
+	if _, ok := stages[name]; ok {
+		panic("stage " + name + " registered twice")
+	}
+	stages[name] = newStage
+}
+
+func init() {
+	registerStage("sum", func() Labeler { return newSumStage() })
+	registerStage("lines", func() Labeler { return &linesStage{} })
+	registerStage("minmax", func() Labeler { return newMinMaxStage() })
+	registerStage("histogram", func() Labeler { return &histogramStage{} })
+	registerStage("sha256", func() Labeler { return &hashStage{name: "sha256", h: sha256.New()} })
+	registerStage("crc32c", func() Labeler {
+		return &hashStage{name: "crc32c", h: crc32.New(crc32.MakeTable(crc32.Castagnoli))}
+	})
+	registerStage("content_type", func() Labeler { return &contentTypeStage{} })
+	registerStage("checksum", func() Labeler { return &checksumStage{hashStage{name: "checksum", h: sha256.New()}} })
+}
+
+// parseStages returns stage names from values, each being a name or comma separated names, sorted and without
+// duplicates. It returns nil if values has no names.
+func parseStages(values []string) ([]string, error) {
+	set := map[string]struct{}{}
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if _, ok := stages[name]; !ok {
+				return nil, errors.Newf("unknown stage %q", name)
+			}
+			set[name] = struct{}{}
+		}
+	}
+	if len(set) == 0 {
+		return nil, nil
+	}
+	ret := make([]string, 0, len(set))
+	for name := range set {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+type stagesCtxKey struct{}
+
+// withStages returns context selecting stages for labelFunc called with it. Stages are request scoped, so they are
+// passed with context through cache and batching, like cancellation.
+func withStages(ctx context.Context, names []string) context.Context {
+	if len(names) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, stagesCtxKey{}, names)
+}
+
+// withDefaultStages returns context selecting stages, unless ctx already selects some.
+func withDefaultStages(ctx context.Context, names []string) context.Context {
+	if _, ok := ctx.Value(stagesCtxKey{}).([]string); ok {
+		return ctx
+	}
+	return withStages(ctx, names)
+}
+
+// stagesFromContext returns stages selected by withStages. Only the sum stage is selected if there are none, like
+// labelers computing only label.Sum. Service selects the configured stages with withDefaultStages instead.
+func stagesFromContext(ctx context.Context) []string {
+	if names, ok := ctx.Value(stagesCtxKey{}).([]string); ok {
+		return names
+	}
+	return []string{"sum"}
+}
+
+// pipeline writes object content to all stages selected in the context.
+type pipeline struct {
+	names  []string
+	stages []Labeler
+}
+
+func newPipeline(ctx context.Context) (*pipeline, error) {
+	p := &pipeline{names: stagesFromContext(ctx)}
+	for _, name := range p.names {
+		newStage, ok := stages[name]
+		if !ok {
+			return nil, errors.Newf("unknown stage %q", name)
+		}
+		p.stages = append(p.stages, newStage())
+	}
+	return p, nil
+}
+
+func (p *pipeline) Write(b []byte) (int, error) {
+	for i, s := range p.stages {
+		if _, err := s.Write(b); err != nil {
+			return 0, errors.Wrapf(err, "stage %v", p.names[i])
+		}
+	}
+	return len(b), nil
+}
+
+// MarshalBinary returns the state of all stages, so labeling can continue from it later (see UnmarshalBinary). It
+// fails if any stage does not implement encoding.BinaryMarshaler.
+func (p *pipeline) MarshalBinary() ([]byte, error) {
+	var ret []byte
+	for i, s := range p.stages {
+		m, ok := s.(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, errors.Newf("stage %v can't be checkpointed", p.names[i])
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return nil, errors.Wrapf(err, "stage %v", p.names[i])
+		}
+		ret = binary.AppendUvarint(ret, uint64(len(b)))
+		ret = append(ret, b...)
+	}
+	return ret, nil
+}
+
+// UnmarshalBinary restores the state of all stages returned by MarshalBinary of the pipeline with the same stages.
+func (p *pipeline) UnmarshalBinary(b []byte) error {
+	for i, s := range p.stages {
+		n, read := binary.Uvarint(b)
+		if read <= 0 || uint64(len(b)-read) < n {
+			return errors.Newf("stage %v: truncated state", p.names[i])
+		}
+		b = b[read:]
+
+		u, ok := s.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return errors.Newf("stage %v can't be checkpointed", p.names[i])
+		}
+		if err := u.UnmarshalBinary(b[:n]); err != nil {
+			return errors.Wrapf(err, "stage %v", p.names[i])
+		}
+		b = b[n:]
+	}
+	if len(b) > 0 {
+		return errors.Newf("%v bytes of state left after all stages", len(b))
+	}
+	return nil
+}
+
+// label returns label of the object written so far.
+func (p *pipeline) label(objID string) (label, error) {
+	lbl := label{ObjID: objID}
+	for i, s := range p.stages {
+		if err := s.Label(&lbl); err != nil {
+			return label{}, errors.Wrapf(err, "stage %v", p.names[i])
+		}
+	}
+	return lbl, nil
+}
+
+func setAttribute(lbl *label, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if lbl.Attributes == nil {
+		lbl.Attributes = map[string]json.RawMessage{}
+	}
+	lbl.Attributes[name] = b
+	return nil
+}
+
+// maxLineLen bounds the line buffered when it's split across writes, like Sum6Reader fails lines which do not fit
+// into its buffer, so memory used by stages does not depend on the content. It's much more than any int64 number
+// needs, even padded, so longer line means object is not a list of numbers. It also bounds how far labelObject5
+// searches back for line beginnings.
+const maxLineLen = 1024
+
+// lineSplitter calls fn with each non-empty line written, without the new line. Empty lines are skipped, like in
+// micro Sum variants. Line split across writes is buffered. The last line does not need to end with the new line,
+// it's passed to fn on flush.
+type lineSplitter struct {
+	fn   func(line []byte) error
+	rest []byte
+}
+
+func (s *lineSplitter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			if len(s.rest)+len(b) > maxLineLen {
+				return 0, withCode(codeTooLarge, errors.Newf("line longer than %v bytes", maxLineLen))
+			}
+			s.rest = append(s.rest, b...)
+			break
+		}
+
+		line := b[:i]
+		if len(s.rest) > 0 {
+			s.rest = append(s.rest, line...)
+			line = s.rest
+		}
+		if len(line) > 0 {
+			if err := s.fn(line); err != nil {
+				return 0, err
+			}
+		}
+		s.rest = s.rest[:0]
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+func (s *lineSplitter) flush() error {
+	if len(s.rest) == 0 {
+		return nil
+	}
+	err := s.fn(s.rest)
+	s.rest = s.rest[:0]
+	return err
+}
+
+// sumStage sums numbers, one per line.
+type sumStage struct {
+	lineSplitter
+	sum int64
+}
+
+func newSumStage() *sumStage {
+	s := &sumStage{}
+	s.fn = func(line []byte) error {
+		n, err := micro.ParseInt(line)
+		if err != nil {
+			return withCode(codeParseError, err)
+		}
+		s.sum += n
+		return nil
+	}
+	return s
+}
+
+// MarshalBinary returns the sum and the line not finished yet.
+func (s *sumStage) MarshalBinary() ([]byte, error) {
+	b := binary.AppendVarint(nil, s.sum)
+	return append(b, s.rest...), nil
+}
+
+func (s *sumStage) UnmarshalBinary(b []byte) error {
+	sum, n := binary.Varint(b)
+	if n <= 0 {
+		return errors.New("invalid sum")
+	}
+	s.sum = sum
+	s.rest = append(s.rest[:0], b[n:]...)
+	return nil
+}
+
+func (s *sumStage) Label(lbl *label) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	lbl.Sum = s.sum
+	return nil
+}
+
+// minMaxStage finds the smallest and the biggest number, one per line.
+type minMaxStage struct {
+	lineSplitter
+	seen     bool
+	min, max int64
+}
+
+func newMinMaxStage() *minMaxStage {
+	s := &minMaxStage{}
+	s.fn = func(line []byte) error {
+		n, err := micro.ParseInt(line)
+		if err != nil {
+			return withCode(codeParseError, err)
+		}
+		if !s.seen || n < s.min {
+			s.min = n
+		}
+		if !s.seen || n > s.max {
+			s.max = n
+		}
+		s.seen = true
+		return nil
+	}
+	return s
+}
+
+func (s *minMaxStage) Label(lbl *label) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if !s.seen {
+		// Nothing to report for empty object.
+		return nil
+	}
+	return setAttribute(lbl, "minmax", struct {
+		Min int64 `json:"min"`
+		Max int64 `json:"max"`
+	}{Min: s.min, Max: s.max})
+}
+
+// linesStage counts lines, including the last one without the new line.
+type linesStage struct {
+	lines   int64
+	partial bool
+}
+
+func (s *linesStage) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	s.lines += int64(bytes.Count(b, []byte{'\n'}))
+	s.partial = b[len(b)-1] != '\n'
+	return len(b), nil
+}
+
+func (s *linesStage) Label(lbl *label) error {
+	lines := s.lines
+	if s.partial {
+		lines++
+	}
+	return setAttribute(lbl, "lines", lines)
+}
+
+// histogramStage counts occurrences of each byte value.
+type histogramStage struct {
+	counts [256]uint64
+}
+
+func (s *histogramStage) Write(b []byte) (int, error) {
+	for _, c := range b {
+		s.counts[c]++
+	}
+	return len(b), nil
+}
+
+func (s *histogramStage) Label(lbl *label) error {
+	return setAttribute(lbl, "histogram", s.counts)
+}
+
+// hashStage sets hex encoded hash of the content.
+type hashStage struct {
+	name string
+	h    hash.Hash
+}
+
+func (s *hashStage) Write(b []byte) (int, error) { return s.h.Write(b) }
+
+// MarshalBinary returns the state of the hash. All hashes of the standard library implement encoding.BinaryMarshaler.
+func (s *hashStage) MarshalBinary() ([]byte, error) {
+	return s.h.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func (s *hashStage) UnmarshalBinary(b []byte) error {
+	return s.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+}
+
+func (s *hashStage) Label(lbl *label) error {
+	return setAttribute(lbl, s.name, hex.EncodeToString(s.h.Sum(nil)))
+}
+
+// checksumStage sets label.CheckSum to sha256 of the content. Like other stages it covers decompressed content, so
+// checksum does not depend on how the object is stored or which function labels it.
+type checksumStage struct {
+	hashStage
+}
+
+func (s *checksumStage) Label(lbl *label) error {
+	lbl.CheckSum = s.h.Sum(nil)
+	return nil
+}
+
+// sniffLen is the number of bytes http.DetectContentType considers.
+const sniffLen = 512
+
+// contentTypeStage detects MIME type of the content from its beginning.
+type contentTypeStage struct {
+	head []byte
+}
+
+func (s *contentTypeStage) Write(b []byte) (int, error) {
+	if missing := sniffLen - len(s.head); missing > 0 {
+		if len(b) < missing {
+			missing = len(b)
+		}
+		s.head = append(s.head, b[:missing]...)
+	}
+	return len(b), nil
+}
+
+func (s *contentTypeStage) Label(lbl *label) error {
+	return setAttribute(lbl, "content_type", http.DetectContentType(s.head))
+}
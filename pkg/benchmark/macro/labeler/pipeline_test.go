@@ -0,0 +1,233 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go-advanced/pkg/benchmark/micro"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/objstore"
+)
+
+func TestParseStages(t *testing.T) {
+	names, err := parseStages([]string{"sum,lines", " sha256 ", "lines", ""})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"lines", "sha256", "sum"}, names)
+
+	names, err = parseStages(nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(names))
+
+	_, err = parseStages([]string{"sum,nope"})
+	testutil.NotOk(t, err)
+}
+
+func TestPipeline(t *testing.T) {
+	all := make([]string, 0, len(stages))
+	for name := range stages {
+		all = append(all, name)
+	}
+	all, err := parseStages(all)
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		name    string
+		content string
+		exp     label
+		expErr  bool
+	}{
+		{
+			name:    "numbers, last line without new line",
+			content: "10\n-3\n7",
+			exp: label{Sum: 14, Attributes: map[string]json.RawMessage{
+				"lines":        json.RawMessage(`3`),
+				"minmax":       json.RawMessage(`{"min":-3,"max":10}`),
+				"content_type": json.RawMessage(`"text/plain; charset=utf-8"`),
+			}},
+		},
+		{
+			name:    "empty",
+			content: "",
+			exp: label{Attributes: map[string]json.RawMessage{
+				"lines":        json.RawMessage(`0`),
+				"content_type": json.RawMessage(`"text/plain; charset=utf-8"`),
+			}},
+		},
+		{
+			name:    "blank lines",
+			content: "\n10\n\n-3\n\n\n7\n\n",
+			exp: label{Sum: 14, Attributes: map[string]json.RawMessage{
+				"lines":        json.RawMessage(`8`),
+				"minmax":       json.RawMessage(`{"min":-3,"max":10}`),
+				"content_type": json.RawMessage(`"text/plain; charset=utf-8"`),
+			}},
+		},
+		{name: "not a number", content: "1\nabc\n", expErr: true},
+		{name: "too long line", content: strings.Repeat("1", maxLineLen+1), expErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			p, err := newPipeline(withStages(context.Background(), all))
+			testutil.Ok(t, err)
+
+			// Chunks split lines, so stages have to carry state between writes.
+			var lbl label
+			_, err = io.CopyBuffer(p, iotest.OneByteReader(strings.NewReader(tcase.content)), make([]byte, 1))
+			if err == nil {
+				lbl, err = p.label("a.txt")
+			}
+			if tcase.expErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+
+			sha := sha256.Sum256([]byte(tcase.content))
+			tcase.exp.CheckSum = sha[:]
+			tcase.exp.Attributes["sha256"] = json.RawMessage(`"` + hex.EncodeToString(sha[:]) + `"`)
+			crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+			_, _ = crc.Write([]byte(tcase.content))
+			tcase.exp.Attributes["crc32c"] = json.RawMessage(`"` + hex.EncodeToString(crc.Sum(nil)) + `"`)
+			var histogram [256]uint64
+			for _, c := range []byte(tcase.content) {
+				histogram[c]++
+			}
+			b, err := json.Marshal(histogram)
+			testutil.Ok(t, err)
+			tcase.exp.Attributes["histogram"] = b
+			tcase.exp.ObjID = "a.txt"
+			testutil.Equals(t, tcase.exp, lbl)
+		})
+	}
+}
+
+func TestSumStage_LikeSum6Reader(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"\n",
+		"\n\n",
+		"1\n\n2\n",
+		"1\n2\n\n\n",
+		"\n\n5",
+		"-1\n\n\n\n3",
+	} {
+		exp, err := micro.Sum6Reader(strings.NewReader(content), make([]byte, 1024))
+		testutil.Ok(t, err, "%q", content)
+
+		p, err := newPipeline(withStages(context.Background(), []string{"sum"}))
+		testutil.Ok(t, err)
+		_, err = io.CopyBuffer(p, iotest.OneByteReader(strings.NewReader(content)), make([]byte, 1))
+		testutil.Ok(t, err, "%q", content)
+		lbl, err := p.label("a.txt")
+		testutil.Ok(t, err, "%q", content)
+		testutil.Equals(t, exp, lbl.Sum, "%q", content)
+	}
+}
+
+func TestPipeline_Checkpoint(t *testing.T) {
+	ctx := withStages(context.Background(), []string{"crc32c", "sha256", "sum"})
+	content := []byte("1\n22\n-3\n4")
+
+	exp, err := newPipeline(ctx)
+	testutil.Ok(t, err)
+	_, err = exp.Write(content)
+	testutil.Ok(t, err)
+	expLabel, err := exp.label("obj")
+	testutil.Ok(t, err)
+
+	// State in the middle of the line continues in another pipeline.
+	p, err := newPipeline(ctx)
+	testutil.Ok(t, err)
+	_, err = p.Write(content[:4])
+	testutil.Ok(t, err)
+	state, err := p.MarshalBinary()
+	testutil.Ok(t, err)
+
+	restored, err := newPipeline(ctx)
+	testutil.Ok(t, err)
+	testutil.Ok(t, restored.UnmarshalBinary(state))
+	_, err = restored.Write(content[4:])
+	testutil.Ok(t, err)
+	lbl, err := restored.label("obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, expLabel, lbl)
+
+	testutil.NotOk(t, restored.UnmarshalBinary(state[:len(state)-3]))
+	p, err = newPipeline(withStages(context.Background(), []string{"lines", "sum"}))
+	testutil.Ok(t, err)
+	_, err = p.MarshalBinary()
+	testutil.NotOk(t, err)
+}
+
+func TestPipeline_DefaultStages(t *testing.T) {
+	p, err := newPipeline(context.Background())
+	testutil.Ok(t, err)
+	_, err = p.Write([]byte("1\n2\n"))
+	testutil.Ok(t, err)
+	lbl, err := p.label("a.txt")
+	testutil.Ok(t, err)
+	testutil.Equals(t, label{ObjID: "a.txt", Sum: 3}, lbl)
+}
+
+func TestLabelObjects_Stages(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+
+	l := &labeler{bkt: bkt}
+	c, err := newLabelCache(log.NewNopLogger(), prometheus.NewRegistry(), newMemLabelStore(), 10, time.Hour)
+	testutil.Ok(t, err)
+	labelFn := c.wrap(bkt, l.labelObject1)
+
+	srv := httptest.NewServer(newBatchHandler(bkt, labelFn, 2))
+	t.Cleanup(srv.Close)
+
+	get := func(params url.Values) (int, batchResponseLine) {
+		res, err := http.Get(srv.URL + "/label_objects?" + params.Encode())
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, res.Body.Close()) }()
+
+		b, err := io.ReadAll(res.Body)
+		testutil.Ok(t, err)
+		line := batchResponseLine{}
+		if res.StatusCode == http.StatusOK {
+			testutil.Ok(t, json.Unmarshal(bytes.TrimSpace(b), &line))
+		}
+		return res.StatusCode, line
+	}
+
+	code, line := get(url.Values{"object_id": {"a.txt"}})
+	testutil.Equals(t, http.StatusOK, code)
+	testutil.Equals(t, int64(3), line.Sum)
+	testutil.Equals(t, 0, len(line.Attributes))
+
+	// Cached label without lines is not reused for request selecting lines.
+	code, line = get(url.Values{"object_id": {"a.txt"}, "stage": {"sum,lines"}})
+	testutil.Equals(t, http.StatusOK, code)
+	testutil.Equals(t, int64(3), line.Sum)
+	testutil.Equals(t, map[string]json.RawMessage{"lines": json.RawMessage(`2`)}, line.Attributes)
+
+	code, line = get(url.Values{"object_id": {"a.txt"}, "stage": {"lines"}})
+	testutil.Equals(t, http.StatusOK, code)
+	testutil.Equals(t, int64(0), line.Sum)
+	testutil.Equals(t, map[string]json.RawMessage{"lines": json.RawMessage(`2`)}, line.Attributes)
+
+	code, _ = get(url.Values{"object_id": {"a.txt"}, "stage": {"nope"}})
+	testutil.Equals(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,236 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"go-advanced/pkg/benchmark/micro"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+)
+
+type rangeConcurrencyCtxKey struct{}
+
+// withRangeConcurrency returns context selecting the number of ranges labelObject5 labels concurrently, like
+// withStages. Zero means the labeler default.
+func withRangeConcurrency(ctx context.Context, n int) context.Context {
+	if n == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, rangeConcurrencyCtxKey{}, n)
+}
+
+// parseRangeConcurrency returns the number of ranges from `range_concurrency` parameter values, or zero if there is
+// none.
+func parseRangeConcurrency(values []string) (int, error) {
+	switch len(values) {
+	case 0:
+		return 0, nil
+	case 1:
+	default:
+		return 0, errors.New("only one range_concurrency parameter is allowed")
+	}
+	n, err := strconv.Atoi(values[0])
+	if err != nil || n < 1 {
+		return 0, errors.Newf("range_concurrency has to be a positive number, got %q", values[0])
+	}
+	return n, nil
+}
+
+// rangeConcurrency returns the number of ranges selected in ctx or the labeler default.
+func (l *labeler) rangeConcurrency(ctx context.Context) (int, error) {
+	n, ok := ctx.Value(rangeConcurrencyCtxKey{}).(int)
+	if !ok {
+		n = l.ranges
+	}
+	if l.maxRanges > 0 && n > l.maxRanges {
+		return 0, withCode(codeInvalidInput, errors.Newf("range_concurrency %v is above the maximum of %v", n, l.maxRanges))
+	}
+	if n < 1 {
+		return 1, nil
+	}
+	return n, nil
+}
+
+// labelObject5 is like labelObject1, but it splits the object into ranges read with GetRange and sums them
+// concurrently, each with its own pooled buffer. Ranges start at line beginnings, so no line is split. Only the sum
+// stage can be merged from ranges, so objects labeled with other stages and compressed objects are labeled
+// sequentially with labelObject1. Labels are the same either way.
+func (l *labeler) labelObject5(ctx context.Context, objID string) (label, error) {
+	workers, err := l.rangeConcurrency(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	if names := stagesFromContext(ctx); len(names) != 1 || names[0] != "sum" || micro.CodecFromName(objID) != micro.CodecNone {
+		return l.labelObject1(ctx, objID)
+	}
+
+	a, err := l.bkt.Attributes(ctx, objID)
+	if err != nil {
+		return label{}, bucketErr(l.bkt, err)
+	}
+	size := int(a.Size)
+	if size == 0 || workers == 1 {
+		return l.labelObject1(ctx, objID)
+	}
+
+	head := make([]byte, micro.MaxMagicLen)
+	if size < len(head) {
+		head = head[:size]
+	}
+	if err := l.readAt(ctx, objID, head, 0); err != nil {
+		return label{}, err
+	}
+	if micro.DetectCodec(head) != micro.CodecNone {
+		return l.labelObject1(ctx, objID)
+	}
+
+	bytesPerRange := size / workers
+	if bytesPerRange == 0 {
+		// Otherwise all ranges would be empty.
+		workers, bytesPerRange = 1, size
+	}
+
+	var (
+		sums    = make([]int64, workers)
+		errs    = make([]error, workers)
+		ctxs    = make([]context.Context, workers)
+		cancels = make([]context.CancelFunc, workers)
+		wg      sync.WaitGroup
+	)
+	for i := range ctxs {
+		ctxs[i], cancels[i] = context.WithCancel(ctx)
+		defer cancels[i]()
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			if sums[i], errs[i] = l.sumRange(ctxs[i], objID, i, workers, bytesPerRange, size); errs[i] != nil {
+				// Later ranges are not needed anymore, but earlier ones still run to report the first error in the
+				// object, like labelObject1.
+				for _, cancel := range cancels[i+1:] {
+					cancel()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lbl := label{ObjID: objID}
+	for i := range sums {
+		if errs[i] != nil {
+			return label{}, errs[i]
+		}
+		// Overflow wraps around like in the sequential sum, so the result is the same regardless of the order.
+		lbl.Sum += sums[i]
+	}
+	return lbl, nil
+}
+
+// sumRange sums numbers in routineNumber-th range of the object, from the beginning of the line at or before
+// routineNumber*bytesPerRange, to the beginning of the next range.
+func (l *labeler) sumRange(ctx context.Context, objID string, routineNumber, workers, bytesPerRange, size int) (_ int64, err error) {
+	// If the range begins in the too long line, the range where the line begins fails, which is reported first.
+	begin, err := l.lineBeginning(ctx, objID, routineNumber*bytesPerRange)
+	if err != nil {
+		return 0, err
+	}
+	end := size
+	if routineNumber < workers-1 {
+		off := (routineNumber + 1) * bytesPerRange
+		if end, err = l.lineBeginning(ctx, objID, off); err == errLineTooLong {
+			// Range ends in the too long line, so the stage fails on it, unless there is an error before.
+			end = off
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if begin >= end {
+		// Whole range is within one line, summed by the range where it begins.
+		return 0, nil
+	}
+
+	wanted := bufferSize(end - begin)
+	bufSize, release, err := l.reserve(ctx, wanted)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	buf, _ := l.rangePool.Get().([]byte)
+	buf = fitBuffer(buf, bufSize, wanted)
+	defer func() { l.rangePool.Put(buf) }()
+
+	rc, err := l.bkt.GetRange(ctx, objID, int64(begin), int64(end-begin))
+	if err != nil {
+		return 0, bucketErr(l.bkt, err)
+	}
+	defer errcapture.Do(&err, rc.Close, "close range")
+
+	// Only the sum stage is selected.
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyBuffer(p, newBucketStream(rc, int64(end-begin)), buf); err != nil {
+		return 0, err
+	}
+	lbl, err := p.label(objID)
+	if err != nil {
+		return 0, err
+	}
+	return lbl.Sum, nil
+}
+
+// errLineTooLong is the error of the sum stage for lines longer than maxLineLen.
+var errLineTooLong = withCode(codeTooLarge, errors.Newf("line longer than %v bytes", maxLineLen))
+
+// lineBeginning returns the offset of the beginning of the line which off is in, like shardedRangeFromReaderAt. The
+// last newline before off is searched backwards in small chunks up to maxLineLen bytes, as longer lines fail anyway.
+// It returns errLineTooLong if there is none.
+func (l *labeler) lineBeginning(ctx context.Context, objID string, off int) (int, error) {
+	// Most lines are short, so one chunk is usually enough.
+	buf := make([]byte, 64)
+	for searched := 0; off > 0; {
+		if searched > maxLineLen {
+			return 0, errLineTooLong
+		}
+		chunk := buf
+		if off < len(chunk) {
+			chunk = chunk[:off]
+		}
+		off -= len(chunk)
+		searched += len(chunk)
+
+		if err := l.readAt(ctx, objID, chunk, off); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return off + i + 1, nil
+		}
+	}
+	// No newline before, so it's the first line.
+	return 0, nil
+}
+
+// readAt reads len(b) bytes of the object at off.
+func (l *labeler) readAt(ctx context.Context, objID string, b []byte, off int) (err error) {
+	rc, err := l.bkt.GetRange(ctx, objID, int64(off), int64(len(b)))
+	if err != nil {
+		return bucketErr(l.bkt, err)
+	}
+	defer errcapture.Do(&err, rc.Close, "close range")
+
+	if _, err := io.ReadFull(newBucketStream(rc, int64(len(b))), b); err != nil {
+		return errors.Wrapf(err, "read %v bytes at %v", len(b), off)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"go-advanced/pkg/benchmark/micro"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+// rangeCountingBucket counts GetRange calls.
+type rangeCountingBucket struct {
+	objstore.Bucket
+	ranges atomic.Int64
+}
+
+func (b *rangeCountingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.ranges.Add(1)
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func TestLabelObject5(t *testing.T) {
+	ctx := context.Background()
+	bkt := &rangeCountingBucket{Bucket: objstore.NewInMemBucket()}
+
+	long := strings.Repeat("1", maxLineLen+1)
+	objects := map[string]string{
+		"empty.txt":        "",
+		"one.txt":          "5",
+		"lines.txt":        "1\n-2\n30\n400\n5\n-60\n7\n8\n9\n10\n",
+		"empty-line.txt":   "1\n2\n\n3\n4\n",
+		"no-newline.txt":   "1\n2\n3\n4\n5\n6\n7\n8\n9\n1000",
+		"wide.txt":         "1\n" + strings.Repeat("0", 100) + "7\n2\n" + strings.Repeat("0", 900) + "3\n4\n",
+		"overflow.txt":     "9223372036854775807\n1\n9223372036854775807\n9223372036854775807\n-5\n",
+		"parse-errors.txt": "1\n2\nx\n3\n4\n5\n6\ny\n7\n8\n",
+		"late-error.txt":   strings.Repeat("1\n", 500) + "z\n",
+		"long-line.txt":    strings.Repeat("1\n", 300) + long + "\n" + strings.Repeat("2\n", 300),
+		"long-after.txt":   strings.Repeat("1\n", 300) + "x\n" + long + "\n" + strings.Repeat("2\n", 300),
+		"long-last.txt":    strings.Repeat("1\n", 300) + long,
+	}
+	// Compressed objects are labeled sequentially, also if compression is detected from magic bytes.
+	uploadCompressed(t, bkt, "compressed.txt.gz", micro.CodecGzip, []byte("1\n2\n3\n"))
+	uploadCompressed(t, bkt, "detected.txt", micro.CodecZstd, []byte("1\n2\n3\n"))
+	objIDs := []string{"compressed.txt.gz", "detected.txt", "missing.txt"}
+	for name, content := range objects {
+		testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader(content)))
+		objIDs = append(objIDs, name)
+	}
+
+	seq := &labeler{bkt: bkt}
+	l := &labeler{bkt: bkt, ranges: 3, maxRanges: 1000}
+	for _, objID := range objIDs {
+		// Labels and errors are the same as sequential, with any number of ranges.
+		exp, expErr := seq.labelObject1(ctx, objID)
+		for _, n := range []int{0, 1, 2, 3, 7, 16, 1000} {
+			t.Run(fmt.Sprintf("%v/%v", objID, n), func(t *testing.T) {
+				lbl, err := l.labelObject5(withRangeConcurrency(ctx, n), objID)
+				if expErr != nil {
+					testutil.NotOk(t, err)
+					testutil.Equals(t, expErr.Error(), err.Error())
+					testutil.Equals(t, codeOf(expErr), codeOf(err))
+					return
+				}
+				testutil.Ok(t, err)
+				testutil.Equals(t, exp, lbl)
+			})
+		}
+	}
+
+	t.Run("ranges are read concurrently", func(t *testing.T) {
+		bkt.ranges.Store(0)
+		lbl, err := l.labelObject5(withRangeConcurrency(ctx, 4), "lines.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(408), lbl.Sum)
+		// Magic bytes, 4 ranges and their 3 line beginnings searched by both neighbours.
+		testutil.Equals(t, int64(1+4+2*3), bkt.ranges.Load())
+	})
+	t.Run("other stages are labeled sequentially", func(t *testing.T) {
+		bkt.ranges.Store(0)
+		stagesCtx := withStages(withRangeConcurrency(ctx, 4), []string{"lines", "sum"})
+		lbl, err := l.labelObject5(stagesCtx, "lines.txt")
+		testutil.Ok(t, err)
+		exp, err := seq.labelObject1(stagesCtx, "lines.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, lbl)
+		testutil.Equals(t, int64(0), bkt.ranges.Load())
+	})
+	t.Run("above maximum", func(t *testing.T) {
+		_, err := l.labelObject5(withRangeConcurrency(ctx, 1001), "lines.txt")
+		testutil.Equals(t, codeInvalidInput, codeOf(err))
+	})
+}
+
+func TestParseRangeConcurrency(t *testing.T) {
+	for _, tcase := range []struct {
+		values []string
+		exp    int
+		err    bool
+	}{
+		{values: nil, exp: 0},
+		{values: []string{"8"}, exp: 8},
+		{values: []string{"0"}, err: true},
+		{values: []string{"-1"}, err: true},
+		{values: []string{"many"}, err: true},
+		{values: []string{"1", "2"}, err: true},
+	} {
+		n, err := parseRangeConcurrency(tcase.values)
+		if tcase.err {
+			testutil.NotOk(t, err, "%v", tcase.values)
+			continue
+		}
+		testutil.Ok(t, err, "%v", tcase.values)
+		testutil.Equals(t, tcase.exp, n, "%v", tcase.values)
+	}
+}
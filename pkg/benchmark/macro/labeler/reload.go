@@ -0,0 +1,396 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gobwas/pool/pbytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
+	"gopkg.in/yaml.v3"
+)
+
+// naiveTmpDir is where labelObjectNaive downloads objects.
+const naiveTmpDir = "./tmp"
+
+// service is everything built from the reloadable part of the config: the bucket client, labelFunc and handlers
+// using them. Each request uses the service which was current when it started until it finishes, so reload does not
+// drop in-flight requests.
+type service struct {
+	cfg     config
+	bkt     objstore.Bucket
+	labelFn labelFunc
+	// handler serves /label_object, /label_objects and /label.
+	handler http.Handler
+	cert    *tls.Certificate
+	// reg has metrics of this service only, so the next one can register the same metrics.
+	reg *prometheus.Registry
+
+	inflight sync.WaitGroup
+	// closed is closed once all in-flight requests finished and the service is closed.
+	closed chan struct{}
+}
+
+// newService returns service built from cfg. Labeling buffers of all services are reserved from the same budget, if
+// not nil, so in-flight requests of the old service and requests of the new one don't use more memory together.
+func newService(logger log.Logger, cfg config, budget *memoryBudget) (_ *service, err error) {
+	s := &service{cfg: cfg, reg: prometheus.NewRegistry(), closed: make(chan struct{})}
+
+	objstoreYAML, err := yaml.Marshal(&cfg.Objstore)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal objstore config")
+	}
+	if s.bkt, err = client.NewBucket(logger, objstoreYAML, s.reg, "labeler"); err != nil {
+		return nil, errors.Wrap(err, "bucket create")
+	}
+	defer func() {
+		if err != nil {
+			_ = s.bkt.Close()
+		}
+	}()
+
+	l := &labeler{bkt: s.bkt, budget: budget}
+	switch cfg.Function {
+	case "labelObjectNaive":
+		l.tmpDir = naiveTmpDir
+		if err := os.MkdirAll(l.tmpDir, os.ModePerm); err != nil {
+			return nil, errors.Wrap(err, "mkdir all")
+		}
+		s.labelFn = l.labelObjectNaive
+	case labelObject1:
+		s.labelFn = l.labelObject1
+	case labelObject2:
+		l.pool.New = func() any { return []byte(nil) }
+		s.labelFn = l.labelObject2
+	case labelObject3:
+		l.bucketedPool = pbytes.New(cfg.Pools.BucketedMinSize, cfg.Pools.BucketedMaxSize)
+		s.labelFn = l.labelObject3
+	case labelObject4:
+		a, err := newAdmission(s.reg, s.bkt, l.budget, cfg.Admission.Workers, cfg.Admission.QueueSize, cfg.Admission.MaxWait, cfg.Admission.RetryAfter)
+		if err != nil {
+			return nil, errors.Wrap(err, "create admission")
+		}
+		s.labelFn = a.labelObject
+	case labelObject5:
+		l.ranges, l.maxRanges = cfg.Ranges.Concurrency, cfg.Ranges.MaxConcurrency
+		s.labelFn = l.labelObject5
+	case labelObject6:
+		r, err := newResumer(log.With(logger, "component", "resumer"), s.reg, l, cfg.Resume.Dir, cfg.Resume.CheckpointInterval, cfg.Resume.MaxRetries, cfg.Resume.MinBackoff, cfg.Resume.MaxBackoff)
+		if err != nil {
+			return nil, errors.Wrap(err, "create resumer")
+		}
+		s.labelFn = r.labelObject
+	default:
+		return nil, errors.Newf("unknown function %v", cfg.Function)
+	}
+
+	if cfg.WriteBack {
+		s.labelFn = newSidecars(logger, s.reg, s.bkt).wrap(s.labelFn)
+	}
+
+	if cfg.Cache.Backend != "none" {
+		var store labelStore
+		switch cfg.Cache.Backend {
+		case "memory":
+			store = newMemLabelStore()
+		case "disk":
+			if store, err = newDiskLabelStore(cfg.Cache.Dir); err != nil {
+				return nil, errors.Wrap(err, "create disk cache")
+			}
+		default:
+			return nil, errors.Newf("unknown cache backend %v", cfg.Cache.Backend)
+		}
+		c, err := newLabelCache(log.With(logger, "component", "cache"), s.reg, store, cfg.Cache.Size, cfg.Cache.TTL)
+		if err != nil {
+			return nil, errors.Wrap(err, "create cache")
+		}
+		s.labelFn = c.wrap(s.bkt, s.labelFn)
+	}
+
+	// Config is validated, so stages are too.
+	stages, _ := parseStages(cfg.Stages)
+	labelFn := s.labelFn
+	s.labelFn = func(ctx context.Context, objID string) (label, error) {
+		return labelFn(withDefaultStages(ctx, stages), objID)
+	}
+
+	if cfg.TLS.enabled() {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load TLS certificate")
+		}
+		s.cert = &cert
+	}
+
+	m := http.NewServeMux()
+	m.Handle("/label_object", newLabelHandler(s.labelFn))
+	m.Handle("/label_objects", newBatchHandler(s.bkt, s.labelFn, cfg.Batch.Concurrency))
+	m.Handle("/label", newUploadHandler(l, s.bkt, stages, cfg.Upload.MaxBodySize, cfg.Upload.Prefix))
+	s.handler = m
+	return s, nil
+}
+
+// reloader holds the current service and replaces it with one built from the config file on reload.
+type reloader struct {
+	logger   log.Logger
+	defaults config
+	path     string
+	// budget is shared by all services, nil if there is no memory budget. It can't be changed without restart.
+	budget *memoryBudget
+
+	// reloadMtx serializes reloads, mtx guards current.
+	reloadMtx sync.Mutex
+	mtx       sync.RWMutex
+	current   *service
+
+	lastReloadSuccessful  prometheus.Gauge
+	lastReloadSuccessTime prometheus.Gauge
+}
+
+// newReloader returns reloader with service built from cfg. Reload reads the config file at path again, on top of
+// defaults.
+func newReloader(logger log.Logger, reg prometheus.Registerer, defaults config, path string, cfg config) (_ *reloader, err error) {
+	var budget *memoryBudget
+	if cfg.MemoryBudget > 0 {
+		if budget, err = newMemoryBudget(reg, cfg.MemoryBudget); err != nil {
+			return nil, errors.Wrap(err, "create memory budget")
+		}
+	}
+	s, err := newService(logger, cfg, budget)
+	if err != nil {
+		return nil, err
+	}
+	r := &reloader{
+		logger:   logger,
+		defaults: defaults,
+		path:     path,
+		budget:   budget,
+		current:  s,
+
+		lastReloadSuccessful: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "labeler_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		}),
+		lastReloadSuccessTime: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "labeler_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		}),
+	}
+	r.lastReloadSuccessful.Set(1)
+	r.lastReloadSuccessTime.SetToCurrentTime()
+	return r, nil
+}
+
+// acquire returns the current service. Release has to be called once it's not used anymore.
+func (r *reloader) acquire() (s *service, release func()) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	// Added under the lock, so reload can't start waiting for in-flight requests before.
+	r.current.inflight.Add(1)
+	return r.current, r.current.inflight.Done
+}
+
+// reload replaces the current service with one built from the config file. On error current service is kept. Old
+// service is closed in the background, once its in-flight requests finish.
+func (r *reloader) reload() (err error) {
+	r.reloadMtx.Lock()
+	defer r.reloadMtx.Unlock()
+
+	defer func() {
+		if err != nil {
+			r.lastReloadSuccessful.Set(0)
+			return
+		}
+		r.lastReloadSuccessful.Set(1)
+		r.lastReloadSuccessTime.SetToCurrentTime()
+	}()
+
+	cfg, err := loadConfig(r.defaults, r.path)
+	if err != nil {
+		return err
+	}
+	r.mtx.RLock()
+	old := r.current
+	r.mtx.RUnlock()
+	if err := old.cfg.validateReload(cfg); err != nil {
+		return err
+	}
+	s, err := newService(r.logger, cfg, r.budget)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	r.current = s
+	r.mtx.Unlock()
+
+	go func() {
+		old.inflight.Wait()
+		if err := old.bkt.Close(); err != nil {
+			level.Warn(r.logger).Log("msg", "failed to close bucket of the old config", "err", err)
+		}
+		close(old.closed)
+	}()
+	level.Info(r.logger).Log("msg", "configuration reloaded", "function", cfg.Function)
+	return nil
+}
+
+// Close closes the current service, once its in-flight requests finish.
+func (r *reloader) Close() error {
+	r.mtx.RLock()
+	s := r.current
+	r.mtx.RUnlock()
+
+	s.inflight.Wait()
+	defer close(s.closed)
+	return s.bkt.Close()
+}
+
+// config returns the configuration of the current service.
+func (r *reloader) config() config {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return r.current.cfg
+}
+
+// ServeHTTP serves request with the current service.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s, release := r.acquire()
+	defer release()
+
+	s.handler.ServeHTTP(w, req)
+}
+
+// labelObject is labelFunc of the current service.
+func (r *reloader) labelObject(ctx context.Context, objID string) (label, error) {
+	s, release := r.acquire()
+	defer release()
+
+	return s.labelFn(ctx, objID)
+}
+
+// Gather returns metrics of the current service.
+func (r *reloader) Gather() ([]*dto.MetricFamily, error) {
+	s, release := r.acquire()
+	defer release()
+
+	return s.reg.Gather()
+}
+
+// getCertificate returns TLS certificate of the current service, so certificates are reloaded too.
+func (r *reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return r.current.cert, nil
+}
+
+// newReloadHandler returns handler of /-/reload, reloading the configuration on POST or PUT.
+func newReloadHandler(r *reloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			httpErrHandle(w, req, withCode(codeMethodNotAllowed, errors.Newf("method %v not allowed", req.Method)))
+			return
+		}
+		if err := r.reload(); err != nil {
+			httpErrHandle(w, req, errors.Wrap(err, "reload"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// reloadingBucket reads from the bucket of the current service, so long-lived users like crawler follow reloads.
+type reloadingBucket struct {
+	r *reloader
+}
+
+func (b reloadingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	s, release := b.r.acquire()
+	defer release()
+
+	return s.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b reloadingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	s, release := b.r.acquire()
+	rc, err := s.bkt.Get(ctx, name)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: release}, nil
+}
+
+func (b reloadingBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	s, release := b.r.acquire()
+	rc, err := s.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: release}, nil
+}
+
+func (b reloadingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	s, release := b.r.acquire()
+	defer release()
+
+	return s.bkt.Exists(ctx, name)
+}
+
+func (b reloadingBucket) IsObjNotFoundErr(err error) bool {
+	s, release := b.r.acquire()
+	defer release()
+
+	return s.bkt.IsObjNotFoundErr(err)
+}
+
+func (b reloadingBucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	s, release := b.r.acquire()
+	defer release()
+
+	return s.bkt.Attributes(ctx, name)
+}
+
+// releasingReadCloser releases the service once the reader is closed, so bucket is not closed while reading.
+type releasingReadCloser struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (rc *releasingReadCloser) Close() error {
+	defer rc.once.Do(rc.release)
+	return rc.ReadCloser.Close()
+}
+
+// runReloadOnSignal reloads on each signal from sig until ctx is canceled. Errors are logged, current config is kept.
+func runReloadOnSignal(ctx context.Context, r *reloader, sig <-chan os.Signal) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sig:
+			if err := r.reload(); err != nil {
+				level.Error(r.logger).Log("msg", "failed to reload configuration", "err", err)
+			}
+		}
+	}
+}
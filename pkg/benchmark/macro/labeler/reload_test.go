@@ -0,0 +1,206 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeLabelerConfig(t *testing.T, path, bktDir, function string) {
+	t.Helper()
+
+	testutil.Ok(t, os.WriteFile(path, []byte(`
+objstore:
+  type: FILESYSTEM
+  config:
+    directory: `+bktDir+`
+function: `+function+`
+`), os.ModePerm))
+}
+
+func TestReloader(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dirA, dirB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for d, content := range map[string]string{dirA: "1\n2\n", dirB: "10\n20\n"} {
+		testutil.Ok(t, os.MkdirAll(d, os.ModePerm))
+		testutil.Ok(t, os.WriteFile(filepath.Join(d, "obj.txt"), []byte(content), os.ModePerm))
+	}
+
+	defaults, _, err := parseFlags(nil)
+	testutil.Ok(t, err)
+	path := filepath.Join(dir, "labeler.yaml")
+	writeLabelerConfig(t, path, dirA, labelObject1)
+	cfg, err := loadConfig(defaults, path)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	r, err := newReloader(log.NewNopLogger(), reg, defaults, path, cfg)
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, r.Close()) })
+
+	lbl, err := r.labelObject(ctx, "obj.txt")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(3), lbl.Sum)
+
+	// In-flight request keeps the old service until it's done.
+	old, release := r.acquire()
+
+	writeLabelerConfig(t, path, dirB, labelObject4)
+	testutil.Ok(t, r.reload())
+	lbl, err = r.labelObject(ctx, "obj.txt")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(30), lbl.Sum)
+
+	lbl, err = old.labelFn(ctx, "obj.txt")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(3), lbl.Sum)
+	select {
+	case <-old.closed:
+		t.Fatal("old service closed with in-flight request")
+	default:
+	}
+	release()
+	select {
+	case <-old.closed:
+	case <-time.After(1 * time.Minute):
+		t.Fatal("old service not closed after in-flight request finished")
+	}
+
+	// Metrics of the new service are registered again.
+	_, err = prometheus.Gatherers{reg, r}.Gather()
+	testutil.Ok(t, err)
+
+	// Invalid config or config changing what requires restart is not applied.
+	for _, content := range []string{
+		"function: labelObject7\n",
+		"listen_address: :8081\n",
+		"memory_budget: 8192\n",
+	} {
+		testutil.Ok(t, os.WriteFile(path, []byte("objstore: {type: FILESYSTEM, config: {directory: "+dirA+"}}\n"+content), os.ModePerm))
+		testutil.NotOk(t, r.reload())
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(r.lastReloadSuccessful))
+		lbl, err = r.labelObject(ctx, "obj.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(30), lbl.Sum)
+	}
+
+	t.Run("/-/reload", func(t *testing.T) {
+		srv := httptest.NewServer(newReloadHandler(r))
+		t.Cleanup(srv.Close)
+
+		res, err := http.Get(srv.URL)
+		testutil.Ok(t, err)
+		testutil.Ok(t, res.Body.Close())
+		testutil.Equals(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+		res, err = http.Post(srv.URL, "", nil)
+		testutil.Ok(t, err)
+		testutil.Ok(t, res.Body.Close())
+		testutil.Equals(t, http.StatusInternalServerError, res.StatusCode)
+
+		writeLabelerConfig(t, path, dirA, labelObject2)
+		res, err = http.Post(srv.URL, "", nil)
+		testutil.Ok(t, err)
+		testutil.Ok(t, res.Body.Close())
+		testutil.Equals(t, http.StatusOK, res.StatusCode)
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(r.lastReloadSuccessful))
+
+		lbl, err := r.labelObject(ctx, "obj.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(3), lbl.Sum)
+	})
+
+	t.Run("SIGHUP", func(t *testing.T) {
+		writeLabelerConfig(t, path, dirB, labelObject3)
+
+		sig := make(chan os.Signal)
+		sctx, cancel := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() { done <- runReloadOnSignal(sctx, r, sig) }()
+		sig <- os.Interrupt
+		// Second signal is received only after the first reload is done.
+		sig <- os.Interrupt
+		cancel()
+		testutil.Ok(t, <-done)
+
+		lbl, err := r.labelObject(ctx, "obj.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(30), lbl.Sum)
+	})
+
+	t.Run("crawler bucket", func(t *testing.T) {
+		old, release := r.acquire()
+		release()
+
+		rc, err := reloadingBucket{r: r}.Get(ctx, "obj.txt")
+		testutil.Ok(t, err)
+		testutil.Ok(t, r.reload())
+
+		// Reader holds the service until it's closed.
+		select {
+		case <-old.closed:
+			t.Fatal("service closed with in-flight reader")
+		default:
+		}
+		b, err := io.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "10\n20\n", string(b))
+		testutil.Ok(t, rc.Close())
+		<-old.closed
+	})
+}
+
+func TestReloader_MemoryBudget(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	testutil.Ok(t, os.WriteFile(filepath.Join(dir, "obj.txt"), []byte("1\n2\n"), os.ModePerm))
+
+	defaults, _, err := parseFlags(nil)
+	testutil.Ok(t, err)
+	path := filepath.Join(dir, "labeler.yaml")
+	writeLabelerConfig(t, path, dir, labelObject1+"\nmemory_budget: 8192")
+	cfg, err := loadConfig(defaults, path)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	r, err := newReloader(log.NewNopLogger(), reg, defaults, path, cfg)
+	testutil.Ok(t, err)
+	t.Cleanup(func() { testutil.Ok(t, r.Close()) })
+	budget := r.budget
+
+	// In-flight request of the old service holds the reservation, which the new service has to respect.
+	old, release := r.acquire()
+	n, err := budget.reserve(ctx, 8192)
+	testutil.Ok(t, err)
+
+	writeLabelerConfig(t, path, dir, labelObject2+"\nmemory_budget: 8192")
+	testutil.Ok(t, r.reload())
+	testutil.Assert(t, budget == r.budget)
+
+	wctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, err = r.labelObject(wctx, "obj.txt")
+	cancel()
+	testutil.NotOk(t, err)
+
+	budget.release(n)
+	release()
+	<-old.closed
+	lbl, err := r.labelObject(ctx, "obj.txt")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(3), lbl.Sum)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(budget.usedBytes))
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"go-advanced/pkg/benchmark/micro"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/efficientgo/examples/pkg/sum/sumtestutil"
+	"github.com/go-kit/log"
+	"github.com/gobwas/pool/pbytes"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+var errInjected = errors.New("injected fault")
+
+// resilienceLabeler returns labeler of bkt with all labeling functions and its memory budget.
+func resilienceLabeler(t *testing.T, bkt objstore.Bucket) (map[string]labelFunc, *memoryBudget) {
+	t.Helper()
+
+	budget, err := newMemoryBudget(prometheus.NewRegistry(), 1<<20)
+	testutil.Ok(t, err)
+	l := &labeler{bkt: bkt, budget: budget, tmpDir: t.TempDir(), ranges: 4}
+	l.pool.New = func() any { return []byte(nil) }
+	l.bucketedPool = pbytes.New(1e3, 10e6)
+
+	r, err := newResumer(log.NewNopLogger(), prometheus.NewRegistry(), l, "", 1000, 20, time.Millisecond, 5*time.Millisecond)
+	testutil.Ok(t, err)
+
+	return map[string]labelFunc{
+		"labelObjectNaive": l.labelObjectNaive,
+		"labelObject1":     l.labelObject1,
+		"labelObject2":     l.labelObject2,
+		"labelObject3":     l.labelObject3,
+		"labelObject4":     l.labelObject4,
+		"labelObject5":     l.labelObject5,
+		"labelObject6":     r.labelObject,
+	}, budget
+}
+
+// TestLabeler_Resilience checks that bucket failures fail labeling with the right error code and never result in the
+// wrong label, leaking memory budget or labeling longer than the request allows.
+func TestLabeler_Resilience(t *testing.T) {
+	ctx := context.Background()
+	bkt := newFaultyBucket(objstore.NewInMemBucket(), newScriptedFaults(nil))
+
+	buf := bytes.Buffer{}
+	exp, err := sumtestutil.CreateTestInputWithExpectedResult(&buf, 2e4)
+	testutil.Ok(t, err)
+	content := buf.Bytes()
+	testutil.Ok(t, bkt.Upload(ctx, "lines.txt", bytes.NewReader(content)))
+	uploadCompressed(t, bkt, "lines.txt.gz", micro.CodecGzip, content)
+	objIDs := []string{"lines.txt", "lines.txt.gz"}
+
+	labelFns, budget := resilienceLabeler(t, bkt)
+	// Functions are labeled in the same order in each run, so random faults are the same too.
+	names := make([]string, 0, len(labelFns))
+	for name := range labelFns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, tcase := range []struct {
+		name   string
+		faults map[faultOp][]fault
+		// code is the code of the error all labeling functions fail with, except labelObject6, which retries
+		// upstream failures. Empty code means labeling succeeds.
+		code errorCode
+	}{
+		{name: "attributes error", faults: map[faultOp][]fault{faultAttributes: {{Err: errInjected}}}, code: codeUpstreamUnavailable},
+		{name: "get error", faults: map[faultOp][]fault{faultGet: {{Err: errInjected}}}, code: codeUpstreamUnavailable},
+		// Few bytes fail also the first read of labelObject5, which reads only the magic bytes.
+		{name: "read error", faults: map[faultOp][]fault{faultRead: {{Err: errInjected, After: 5}}}, code: codeUpstreamUnavailable},
+		{name: "truncated stream", faults: map[faultOp][]fault{faultRead: {{Truncate: true, After: 5}}}, code: codeUpstreamUnavailable},
+		// Close errors are not retried, as the stream was read already.
+		{name: "close error", faults: map[faultOp][]fault{faultClose: {{Err: errInjected}}}, code: codeInternal},
+		{
+			name: "slow reader",
+			faults: map[faultOp][]fault{
+				faultAttributes: {{Latency: time.Millisecond}},
+				faultGet:        {{Latency: time.Millisecond}},
+				faultRead:       {{Latency: time.Microsecond, ChunkSize: 1000}},
+			},
+		},
+	} {
+		for _, objID := range objIDs {
+			for _, name := range names {
+				labelFn := labelFns[name]
+				t.Run(tcase.name+"/"+objID+"/"+name, func(t *testing.T) {
+					bkt.policy = newScriptedFaults(cloneScript(tcase.faults))
+
+					lbl, err := labelFn(ctx, objID)
+					testutil.Equals(t, 0.0, promtestutil.ToFloat64(budget.usedBytes))
+
+					if tcase.code == "" || (name == "labelObject6" && tcase.code == codeUpstreamUnavailable) {
+						testutil.Ok(t, err)
+						testutil.Equals(t, exp, lbl.Sum)
+						testutil.Equals(t, objID, lbl.ObjID)
+						return
+					}
+					testutil.NotOk(t, err)
+					testutil.Equals(t, tcase.code, codeOf(err), "%v", err)
+					if tcase.code == codeInternal {
+						testutil.Assert(t, errors.Is(err, errInjected), "%v", err)
+					}
+				})
+			}
+		}
+	}
+
+	t.Run("latency above deadline", func(t *testing.T) {
+		for _, name := range names {
+			labelFn := labelFns[name]
+			bkt.policy = newScriptedFaults(map[faultOp][]fault{faultGet: {{Latency: time.Minute}}})
+
+			ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			start := time.Now()
+			_, err := labelFn(ctx, "lines.txt")
+			cancel()
+			testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "%v: %v", name, err)
+			testutil.Assert(t, time.Since(start) < 10*time.Second, "%v labeled for %v", name, time.Since(start))
+			testutil.Equals(t, 0.0, promtestutil.ToFloat64(budget.usedBytes))
+		}
+	})
+	t.Run("random faults", func(t *testing.T) {
+		bkt.policy = newRandomFaults(42, 0.2, map[faultOp][]fault{
+			faultAttributes: {{Err: errInjected}},
+			faultGet:        {{Err: errInjected}, {Latency: time.Millisecond}},
+			faultRead: {
+				{Err: errInjected, After: int64(len(content))},
+				{Truncate: true, After: int64(len(content))},
+				{ChunkSize: 100},
+			},
+		})
+
+		for _, objID := range objIDs {
+			for _, name := range names {
+				labelFn := labelFns[name]
+				var failed int
+				for i := 0; i < 20; i++ {
+					lbl, err := labelFn(ctx, objID)
+					if err != nil {
+						// Labeling may fail, but the label is never wrong.
+						testutil.Equals(t, codeUpstreamUnavailable, codeOf(err), "%v %v: %v", name, objID, err)
+						failed++
+						continue
+					}
+					testutil.Equals(t, exp, lbl.Sum, "%v %v", name, objID)
+				}
+				if name == "labelObject6" {
+					testutil.Equals(t, 0, failed, "%v %v", name, objID)
+				}
+				testutil.Equals(t, 0.0, promtestutil.ToFloat64(budget.usedBytes))
+			}
+		}
+	})
+}
+
+// cloneScript copies the script, so each run starts with the whole script.
+func cloneScript(script map[faultOp][]fault) map[faultOp][]fault {
+	ret := make(map[faultOp][]fault, len(script))
+	for op, faults := range script {
+		ret[op] = append([]fault(nil), faults...)
+	}
+	return ret
+}
@@ -0,0 +1,336 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go-advanced/pkg/benchmark/micro"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+)
+
+// checkpoint is the progress of labeling the object, from which labeling can continue instead of starting from zero.
+type checkpoint struct {
+	ObjID string `json:"object_id"`
+	// Size, LastModified and Stages are of the labeling which made the checkpoint, it's not valid for other.
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Stages       []string  `json:"stages"`
+
+	// Offset is the number of bytes of the object labeled so far.
+	Offset int64 `json:"offset"`
+	// State is the state of all stages (e.g. the partial sum), see pipeline.MarshalBinary.
+	State []byte `json:"state"`
+}
+
+func (c checkpoint) validFor(a objstore.ObjectAttributes, stages []string) bool {
+	return c.Size == a.Size && c.LastModified.Equal(a.LastModified) && strings.Join(c.Stages, ",") == strings.Join(stages, ",")
+}
+
+// checkpointStore keeps the last checkpoint of each object in a JSON file in the directory, so labeling can continue
+// from it after restart too.
+type checkpointStore struct {
+	dir string
+}
+
+func newCheckpointStore(dir string) (*checkpointStore, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &checkpointStore{dir: dir}, nil
+}
+
+func (s *checkpointStore) path(objID string) string {
+	h := sha256.Sum256([]byte(objID))
+	return filepath.Join(s.dir, hex.EncodeToString(h[:])+".json")
+}
+
+func (s *checkpointStore) load(objID string) (checkpoint, bool, error) {
+	b, err := os.ReadFile(s.path(objID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return checkpoint{}, false, nil
+		}
+		return checkpoint{}, false, err
+	}
+	cp := checkpoint{}
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return checkpoint{}, false, errors.Wrapf(err, "parse checkpoint %v", s.path(objID))
+	}
+	if cp.ObjID != objID {
+		// Hash collision.
+		return checkpoint{}, false, nil
+	}
+	return cp, true, nil
+}
+
+func (s *checkpointStore) store(cp checkpoint) error {
+	b, err := json.Marshal(&cp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(s.dir, s.path(cp.ObjID), b)
+}
+
+func (s *checkpointStore) remove(objID string) error {
+	if err := os.Remove(s.path(objID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// resumer labels objects like labelObject1, but it retries bucket failures with exponential backoff. Every interval
+// bytes it checkpoints the progress: the offset and the state of stages, so retry continues with GetRange from the last checkpoint. Only uncompressed objects labeled with
+// stages implementing encoding.BinaryMarshaler can be checkpointed, others are labeled from zero on retry.
+type resumer struct {
+	l      *labeler
+	logger log.Logger
+	// store is nil if checkpoints are kept only in memory until labeling finishes.
+	store *checkpointStore
+
+	interval               int64
+	maxRetries             int
+	minBackoff, maxBackoff time.Duration
+
+	retries      prometheus.Counter
+	checkpoints  prometheus.Counter
+	resumedBytes prometheus.Counter
+}
+
+func newResumer(logger log.Logger, reg prometheus.Registerer, l *labeler, dir string, interval int64, maxRetries int, minBackoff, maxBackoff time.Duration) (*resumer, error) {
+	if interval < 1 {
+		return nil, errors.Newf("checkpoint interval has to be positive, got %v", interval)
+	}
+	if maxRetries < 0 || minBackoff <= 0 || maxBackoff < minBackoff {
+		return nil, errors.Newf("retries can't be negative and backoff has to be positive with max not smaller than min, got %v, %v and %v", maxRetries, minBackoff, maxBackoff)
+	}
+	r := &resumer{
+		l:          l,
+		logger:     logger,
+		interval:   interval,
+		maxRetries: maxRetries,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+
+		retries: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_resume_retries_total",
+			Help: "Tracks the number of labeling retries after bucket failures.",
+		}),
+		checkpoints: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_resume_checkpoints_total",
+			Help: "Tracks the number of labeling checkpoints made.",
+		}),
+		resumedBytes: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_resume_skipped_bytes_total",
+			Help: "Tracks the number of bytes not read again, as labeling continued from checkpoints.",
+		}),
+	}
+	if dir != "" {
+		var err error
+		if r.store, err = newCheckpointStore(dir); err != nil {
+			return nil, errors.Wrap(err, "create checkpoint store")
+		}
+	}
+	return r, nil
+}
+
+// retry calls fn until it succeeds, fails with error other than upstream unavailable or maxRetries retries in a row
+// fail. It waits with exponential backoff between retries. Backoff starts from the beginning if fn made progress.
+func (r *resumer) retry(ctx context.Context, objID string, fn func() (progressed bool, _ error)) error {
+	backoff := r.minBackoff
+	for retries := 0; ; retries++ {
+		progressed, err := fn()
+		if err == nil || codeOf(err) != codeUpstreamUnavailable || ctx.Err() != nil {
+			return err
+		}
+		if progressed {
+			retries, backoff = 0, r.minBackoff
+		}
+		if retries >= r.maxRetries {
+			return errors.Wrapf(err, "after %v retries", retries)
+		}
+
+		r.retries.Inc()
+		level.Debug(r.logger).Log("msg", "retrying labeling", "object_id", objID, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+func (r *resumer) labelObject(ctx context.Context, objID string) (lbl label, err error) {
+	stages := stagesFromContext(ctx)
+
+	var cp checkpoint
+	if r.store != nil {
+		var ok bool
+		if cp, ok, err = r.store.load(objID); err != nil {
+			level.Warn(r.logger).Log("msg", "failed to load checkpoint, labeling from zero", "object_id", objID, "err", err)
+		} else if ok {
+			level.Debug(r.logger).Log("msg", "loaded checkpoint", "object_id", objID, "offset", cp.Offset)
+		}
+	}
+
+	var release func()
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+	var buf []byte
+	err = r.retry(ctx, objID, func() (bool, error) {
+		a, err := r.l.bkt.Attributes(ctx, objID)
+		if err != nil {
+			return false, bucketErr(r.l.bkt, err)
+		}
+		if !cp.validFor(a, stages) {
+			// Object changed since the checkpoint, so labeling starts from zero.
+			cp = checkpoint{ObjID: objID, Size: a.Size, LastModified: a.LastModified, Stages: stages}
+		}
+		if buf == nil {
+			wanted := bufferSize(int(a.Size))
+			bufSize, rel, err := r.l.reserve(ctx, wanted)
+			if err != nil {
+				return false, err
+			}
+			release, buf = rel, make([]byte, bufSize)
+		}
+
+		var progressed bool
+		lbl, progressed, err = r.label(ctx, &cp, buf)
+		return progressed, err
+	})
+	if r.store != nil && ctx.Err() == nil && codeOf(err) != codeUpstreamUnavailable {
+		// Done or failed for good, so the checkpoint is not needed anymore.
+		if rerr := r.store.remove(objID); rerr != nil {
+			level.Warn(r.logger).Log("msg", "failed to remove checkpoint", "object_id", objID, "err", rerr)
+		}
+	}
+	if err != nil {
+		return label{}, err
+	}
+	return lbl, nil
+}
+
+// label labels the object from the checkpoint, updating it every interval. It returns true if it made any
+// checkpoint.
+func (r *resumer) label(ctx context.Context, cp *checkpoint, buf []byte) (_ label, progressed bool, err error) {
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return label{}, false, err
+	}
+	if cp.Offset > 0 {
+		if err := p.UnmarshalBinary(cp.State); err != nil {
+			return label{}, false, errors.Wrap(err, "restore checkpoint")
+		}
+		r.resumedBytes.Add(float64(cp.Offset))
+	}
+
+	var rc io.ReadCloser
+	switch {
+	case cp.Offset == 0:
+		rc, err = r.l.bkt.Get(ctx, cp.ObjID)
+	case cp.Offset == cp.Size:
+		// Checkpoint was made after reading everything.
+		rc = io.NopCloser(bytes.NewReader(nil))
+	default:
+		rc, err = r.l.bkt.GetRange(ctx, cp.ObjID, cp.Offset, cp.Size-cp.Offset)
+	}
+	if err != nil {
+		return label{}, false, bucketErr(r.l.bkt, err)
+	}
+	defer errcapture.Do(&err, rc.Close, "close stream")
+
+	in := io.Reader(newBucketStream(rc, cp.Size-cp.Offset))
+	checkpointable := cp.Offset > 0
+	if cp.Offset == 0 {
+		head := make([]byte, micro.MaxMagicLen)
+		n, err := io.ReadFull(in, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return label{}, false, err
+		}
+		in = io.MultiReader(bytes.NewReader(head[:n]), in)
+
+		_, err = p.MarshalBinary()
+		checkpointable = err == nil && micro.CodecFromName(cp.ObjID) == micro.CodecNone &&
+			micro.DetectCodec(head[:n]) == micro.CodecNone
+	}
+
+	if !checkpointable {
+		dr, err := r.l.decompressed(in, cp.ObjID)
+		if err != nil {
+			return label{}, false, err
+		}
+		defer errcapture.Do(&err, dr.Close, "release decompressor")
+
+		if _, err := io.CopyBuffer(p, dr, buf); err != nil {
+			return label{}, false, err
+		}
+		lbl, err := p.label(cp.ObjID)
+		return lbl, false, err
+	}
+
+	offset := cp.Offset
+	for {
+		n, rerr := in.Read(buf)
+		if n > 0 {
+			if _, err := p.Write(buf[:n]); err != nil {
+				return label{}, progressed, err
+			}
+			offset += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return label{}, progressed, errors.Wrapf(rerr, "read at %v", offset)
+		}
+		if offset-cp.Offset >= r.interval {
+			if err := r.checkpoint(cp, offset, p); err != nil {
+				return label{}, progressed, err
+			}
+			progressed = true
+		}
+	}
+	lbl, err := p.label(cp.ObjID)
+	return lbl, progressed, err
+}
+
+// checkpoint updates cp to offset with the state of p, and persists it if checkpoints are persisted. Failed
+// persisting is only logged, as labeling can continue from the checkpoint in memory.
+func (r *resumer) checkpoint(cp *checkpoint, offset int64, p *pipeline) error {
+	state, err := p.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "checkpoint")
+	}
+	cp.Offset, cp.State = offset, state
+	r.checkpoints.Inc()
+
+	if r.store != nil {
+		if err := r.store.store(*cp); err != nil {
+			level.Warn(r.logger).Log("msg", "failed to store checkpoint", "object_id", cp.ObjID, "err", err)
+		}
+	}
+	return nil
+}
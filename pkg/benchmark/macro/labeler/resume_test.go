@@ -0,0 +1,164 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"go-advanced/pkg/benchmark/micro"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/efficientgo/examples/pkg/sum/sumtestutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+func newTestResumer(t *testing.T, bkt objstore.Bucket, dir string, maxRetries int) *resumer {
+	t.Helper()
+
+	r, err := newResumer(log.NewNopLogger(), prometheus.NewRegistry(), &labeler{bkt: bkt}, dir, 1000, maxRetries, time.Millisecond, 5*time.Millisecond)
+	testutil.Ok(t, err)
+	return r
+}
+
+func TestResumer(t *testing.T) {
+	ctx := context.Background()
+	bkt := newFaultyBucket(objstore.NewInMemBucket(), newScriptedFaults(nil))
+	// failStreams fails the given number of next streams after the given number of bytes, like broken connection.
+	// Failing streams return small chunks, so the failure happens right after the given number of bytes.
+	failStreams := func(streams int, after int64) {
+		script := make([]fault, streams)
+		for i := range script {
+			script[i] = fault{Err: errInjected, After: after, ChunkSize: 512}
+		}
+		bkt.policy = newScriptedFaults(map[faultOp][]fault{faultRead: script})
+	}
+
+	buf := bytes.Buffer{}
+	_, err := sumtestutil.CreateTestInputWithExpectedResult(&buf, 2e4)
+	testutil.Ok(t, err)
+	content := buf.Bytes()
+	testutil.Ok(t, bkt.Upload(ctx, "20k-lines.txt", bytes.NewReader(content)))
+	uploadCompressed(t, bkt, "20k-lines.txt.gz", micro.CodecGzip, content)
+	testutil.Ok(t, bkt.Upload(ctx, "bad.txt", strings.NewReader(strings.Repeat("1\n", 1000)+"x\n")))
+
+	// Labels are the same as without failures.
+	expected := func(t *testing.T, ctx context.Context, objID string) label {
+		t.Helper()
+
+		exp, err := (&labeler{bkt: bkt.Bucket}).labelObject1(ctx, objID)
+		testutil.Ok(t, err)
+		return exp
+	}
+
+	t.Run("resumes from checkpoints", func(t *testing.T) {
+		r := newTestResumer(t, bkt, "", 2)
+		// Each stream fails after 2.5 checkpoints, more times than retries, but each makes progress.
+		failStreams(5, 2500)
+		bkt.streamOffsets()
+
+		stagesCtx := withStages(ctx, []string{"checksum", "sha256", "sum"})
+		lbl, err := r.labelObject(stagesCtx, "20k-lines.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected(t, stagesCtx, "20k-lines.txt"), lbl)
+
+		offsets := bkt.streamOffsets()
+		testutil.Equals(t, 6, len(offsets))
+		testutil.Equals(t, int64(0), offsets[0])
+		for i := 1; i < len(offsets); i++ {
+			// Chunks are not aligned with the checkpoint interval, so progress is between 2 and 2.5 intervals.
+			testutil.Assert(t, offsets[i]-offsets[i-1] >= 2000 && offsets[i]-offsets[i-1] <= 2500, "offsets %v", offsets)
+		}
+		testutil.Equals(t, 5.0, promtestutil.ToFloat64(r.retries))
+		testutil.Equals(t, float64(offsets[5]), promtestutil.ToFloat64(r.resumedBytes)-float64(offsets[1]+offsets[2]+offsets[3]+offsets[4]))
+	})
+	t.Run("retries exhausted without progress", func(t *testing.T) {
+		r := newTestResumer(t, bkt, "", 2)
+		failStreams(3, 500)
+		bkt.streamOffsets()
+
+		_, err := r.labelObject(ctx, "20k-lines.txt")
+		testutil.NotOk(t, err)
+		testutil.Equals(t, codeUpstreamUnavailable, codeOf(err))
+		testutil.Equals(t, []int64{0, 0, 0}, bkt.streamOffsets())
+		testutil.Equals(t, 2.0, promtestutil.ToFloat64(r.retries))
+	})
+	t.Run("not checkpointable labeling starts from zero", func(t *testing.T) {
+		r := newTestResumer(t, bkt, "", 2)
+		for _, tcase := range []struct {
+			objID     string
+			stages    []string
+			failAfter int64
+		}{
+			// Compressed object is much smaller than the content.
+			{objID: "20k-lines.txt.gz", failAfter: 100},
+			{objID: "20k-lines.txt", stages: []string{"lines", "sum"}, failAfter: 2500},
+		} {
+			failStreams(2, tcase.failAfter)
+			bkt.streamOffsets()
+
+			stagesCtx := withStages(ctx, tcase.stages)
+			lbl, err := r.labelObject(stagesCtx, tcase.objID)
+			testutil.Ok(t, err)
+			testutil.Equals(t, expected(t, stagesCtx, tcase.objID), lbl)
+			testutil.Equals(t, []int64{0, 0, 0}, bkt.streamOffsets())
+		}
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(r.checkpoints))
+	})
+	t.Run("permanent errors are not retried", func(t *testing.T) {
+		r := newTestResumer(t, bkt, "", 2)
+		failStreams(0, 0)
+		bkt.streamOffsets()
+
+		_, err := r.labelObject(ctx, "bad.txt")
+		testutil.Equals(t, codeParseError, codeOf(err))
+		_, err = r.labelObject(ctx, "missing.txt")
+		testutil.Equals(t, codeNotFound, codeOf(err))
+		testutil.Equals(t, []int64{0}, bkt.streamOffsets())
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(r.retries))
+	})
+	t.Run("persisted checkpoint", func(t *testing.T) {
+		dir := t.TempDir()
+		failStreams(1, 2500)
+		bkt.streamOffsets()
+
+		_, err := newTestResumer(t, bkt, dir, 0).labelObject(ctx, "20k-lines.txt")
+		testutil.Equals(t, codeUpstreamUnavailable, codeOf(err))
+
+		// Labeling continues from the checkpoint after restart, until the object changes.
+		r := newTestResumer(t, bkt, dir, 0)
+		lbl, err := r.labelObject(ctx, "20k-lines.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, expected(t, ctx, "20k-lines.txt"), lbl)
+		offsets := bkt.streamOffsets()
+		testutil.Equals(t, 2, len(offsets))
+		testutil.Equals(t, offsets[1], int64(promtestutil.ToFloat64(r.resumedBytes)))
+		testutil.Assert(t, offsets[1] >= 2000)
+
+		// Checkpoint is removed once labeling is done.
+		entries, err := os.ReadDir(dir)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(entries))
+	})
+	t.Run("changed object", func(t *testing.T) {
+		dir := t.TempDir()
+		testutil.Ok(t, bkt.Upload(ctx, "changed.txt", bytes.NewReader(content)))
+		failStreams(1, 2500)
+		_, err := newTestResumer(t, bkt, dir, 0).labelObject(ctx, "changed.txt")
+		testutil.Equals(t, codeUpstreamUnavailable, codeOf(err))
+
+		testutil.Ok(t, bkt.Upload(ctx, "changed.txt", strings.NewReader("1\n2\n")))
+		bkt.streamOffsets()
+		lbl, err := newTestResumer(t, bkt, dir, 0).labelObject(ctx, "changed.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(3), lbl.Sum)
+		testutil.Equals(t, []int64{0}, bkt.streamOffsets())
+	})
+}
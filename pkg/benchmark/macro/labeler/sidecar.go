@@ -0,0 +1,142 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/thanos-io/objstore"
+)
+
+// labelAlgorithmVersion is the version of labeling, stored in sidecars. Bump it whenever labels of the same content
+// change, so sidecars written before are recomputed.
+const labelAlgorithmVersion = 1
+
+// sidecarSuffix is appended to the object ID to get the ID of its sidecar.
+const sidecarSuffix = ".label.json"
+
+// sidecar is the label of the object stored next to it in the bucket, so other systems can discover it.
+type sidecar struct {
+	label
+	Version int `json:"version"`
+	// Stages computing the label.
+	Stages    []string  `json:"stages"`
+	LabeledAt time.Time `json:"labeled_at"`
+	// Size and LastModified are attributes of the labeled object, so sidecar of the changed object is stale.
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// sidecars writes labels back to the bucket as <objID>.label.json sidecars and serves labels from them.
+type sidecars struct {
+	logger log.Logger
+	bkt    objstore.Bucket
+	now    func() time.Time
+
+	lookups       *prometheus.CounterVec
+	writeFailures prometheus.Counter
+}
+
+func newSidecars(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket) *sidecars {
+	return &sidecars{
+		logger: logger,
+		bkt:    bkt,
+		now:    time.Now,
+
+		lookups: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "labeler_sidecar_lookups_total",
+			Help: "Tracks the number of sidecar lookups by the result: hit, missing, stale (different version, stages or object) or invalid.",
+		}, []string{"result"}),
+		writeFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "labeler_sidecar_write_failures_total",
+			Help: "Tracks the number of labels which could not be written back as sidecars.",
+		}),
+	}
+}
+
+// load returns sidecar of objID and true, or false if it does not exist.
+func (s *sidecars) load(ctx context.Context, objID string) (_ sidecar, _ bool, err error) {
+	rc, err := s.bkt.Get(ctx, objID+sidecarSuffix)
+	if err != nil {
+		if s.bkt.IsObjNotFoundErr(err) {
+			return sidecar{}, false, nil
+		}
+		return sidecar{}, false, bucketErr(s.bkt, err)
+	}
+	defer errcapture.Do(&err, rc.Close, "close sidecar")
+
+	var sc sidecar
+	if err := json.NewDecoder(rc).Decode(&sc); err != nil {
+		return sidecar{}, false, errors.Wrap(err, "decode sidecar")
+	}
+	return sc, true, nil
+}
+
+func (s *sidecars) store(ctx context.Context, sc sidecar) error {
+	b, err := json.Marshal(&sc)
+	if err != nil {
+		return err
+	}
+	return s.bkt.Upload(ctx, sc.ObjID+sidecarSuffix, bytes.NewReader(b))
+}
+
+// wrap returns labelFn which serves labels from sidecars of the same algorithm version, stages and object
+// attributes. Otherwise object is labeled and the label is written back as its sidecar. Failed write back is logged,
+// the label is still returned. Sidecars themselves are labeled without write back.
+func (s *sidecars) wrap(labelFn labelFunc) labelFunc {
+	return func(ctx context.Context, objID string) (label, error) {
+		if strings.HasSuffix(objID, sidecarSuffix) {
+			return labelFn(ctx, objID)
+		}
+
+		a, err := s.bkt.Attributes(ctx, objID)
+		if err != nil {
+			return label{}, bucketErr(s.bkt, err)
+		}
+		stages := stagesFromContext(ctx)
+
+		sc, ok, err := s.load(ctx, objID)
+		switch {
+		case err != nil:
+			// Labeled again and overwritten below.
+			s.lookups.WithLabelValues("invalid").Inc()
+			level.Warn(s.logger).Log("msg", "failed to load sidecar, labeling again", "object_id", objID, "err", err)
+		case !ok:
+			s.lookups.WithLabelValues("missing").Inc()
+		case sc.Version != labelAlgorithmVersion || strings.Join(sc.Stages, ",") != strings.Join(stages, ",") ||
+			sc.Size != a.Size || !sc.LastModified.Equal(a.LastModified):
+			s.lookups.WithLabelValues("stale").Inc()
+		default:
+			s.lookups.WithLabelValues("hit").Inc()
+			return sc.label, nil
+		}
+
+		lbl, err := labelFn(ctx, objID)
+		if err != nil {
+			return label{}, err
+		}
+		if err := s.store(ctx, sidecar{
+			label:        lbl,
+			Version:      labelAlgorithmVersion,
+			Stages:       stages,
+			LabeledAt:    s.now(),
+			Size:         a.Size,
+			LastModified: a.LastModified,
+		}); err != nil {
+			s.writeFailures.Inc()
+			level.Warn(s.logger).Log("msg", "failed to write back sidecar", "object_id", objID, "err", err)
+		}
+		return lbl, nil
+	}
+}
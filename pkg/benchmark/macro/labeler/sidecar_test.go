@@ -0,0 +1,165 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+// readOnlyBucket fails all uploads.
+type readOnlyBucket struct {
+	objstore.Bucket
+}
+
+func (readOnlyBucket) Upload(context.Context, string, io.Reader) error {
+	return errors.New("access denied")
+}
+
+func TestSidecars(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := newSidecars(log.NewNopLogger(), prometheus.NewRegistry(), bkt)
+	s.now = func() time.Time { return now }
+
+	var labeled []string
+	l := &labeler{bkt: bkt}
+	labelFn := s.wrap(func(ctx context.Context, objID string) (label, error) {
+		labeled = append(labeled, objID)
+		return l.labelObject1(ctx, objID)
+	})
+	loadSidecar := func(t *testing.T, objID string) sidecar {
+		t.Helper()
+
+		rc, err := bkt.Get(ctx, objID+sidecarSuffix)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+
+		sc := sidecar{}
+		testutil.Ok(t, json.NewDecoder(rc).Decode(&sc))
+		return sc
+	}
+	lookups := func(result string) float64 {
+		return promtestutil.ToFloat64(s.lookups.WithLabelValues(result))
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		lbl, err := labelFn(ctx, "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, label{ObjID: "a.txt", Sum: 3}, lbl)
+		testutil.Equals(t, []string{"a.txt"}, labeled)
+		testutil.Equals(t, 1.0, lookups("missing"))
+
+		a, err := bkt.Attributes(ctx, "a.txt")
+		testutil.Ok(t, err)
+		sc := loadSidecar(t, "a.txt")
+		testutil.Assert(t, a.LastModified.Equal(sc.LastModified))
+		sc.LastModified = time.Time{}
+		testutil.Equals(t, sidecar{
+			label:     lbl,
+			Version:   labelAlgorithmVersion,
+			Stages:    []string{"sum"},
+			LabeledAt: now,
+			Size:      a.Size,
+		}, sc)
+	})
+	t.Run("hit", func(t *testing.T) {
+		labeled = nil
+		lbl, err := labelFn(ctx, "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, label{ObjID: "a.txt", Sum: 3}, lbl)
+		testutil.Equals(t, 0, len(labeled))
+		testutil.Equals(t, 1.0, lookups("hit"))
+	})
+	t.Run("stale", func(t *testing.T) {
+		// Other stages.
+		labeled = nil
+		lbl, err := labelFn(withStages(ctx, []string{"sum", "lines"}), "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"a.txt"}, labeled)
+		testutil.Equals(t, json.RawMessage(`2`), lbl.Attributes["lines"])
+		testutil.Equals(t, []string{"sum", "lines"}, loadSidecar(t, "a.txt").Stages)
+
+		// Changed object.
+		testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n3\n")))
+		labeled = nil
+		lbl, err = labelFn(ctx, "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(6), lbl.Sum)
+		testutil.Equals(t, []string{"a.txt"}, labeled)
+
+		// Older algorithm.
+		sc := loadSidecar(t, "a.txt")
+		sc.Version = labelAlgorithmVersion - 1
+		sc.Sum = 1000
+		b, err := json.Marshal(&sc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, "a.txt"+sidecarSuffix, bytes.NewReader(b)))
+		labeled = nil
+		lbl, err = labelFn(ctx, "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(6), lbl.Sum)
+		testutil.Equals(t, []string{"a.txt"}, labeled)
+		testutil.Equals(t, labelAlgorithmVersion, loadSidecar(t, "a.txt").Version)
+		testutil.Equals(t, 3.0, lookups("stale"))
+	})
+	t.Run("invalid", func(t *testing.T) {
+		testutil.Ok(t, bkt.Upload(ctx, "a.txt"+sidecarSuffix, strings.NewReader("{")))
+		labeled = nil
+		lbl, err := labelFn(ctx, "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(6), lbl.Sum)
+		testutil.Equals(t, []string{"a.txt"}, labeled)
+		testutil.Equals(t, 1.0, lookups("invalid"))
+		testutil.Equals(t, int64(6), loadSidecar(t, "a.txt").Sum)
+	})
+	t.Run("sidecar and missing object", func(t *testing.T) {
+		// Sidecars are not written back for sidecars.
+		labeled = nil
+		_, err := labelFn(ctx, "a.txt"+sidecarSuffix)
+		testutil.Equals(t, codeParseError, codeOf(err))
+		testutil.Equals(t, []string{"a.txt" + sidecarSuffix}, labeled)
+		exists, err := bkt.Exists(ctx, "a.txt"+sidecarSuffix+sidecarSuffix)
+		testutil.Ok(t, err)
+		testutil.Assert(t, !exists)
+
+		labeled = nil
+		_, err = labelFn(ctx, "missing.txt")
+		testutil.Equals(t, codeNotFound, codeOf(err))
+		testutil.Equals(t, 0, len(labeled))
+	})
+}
+
+func TestSidecars_WriteFailure(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a.txt", strings.NewReader("1\n2\n")))
+
+	s := newSidecars(log.NewNopLogger(), prometheus.NewRegistry(), readOnlyBucket{Bucket: bkt})
+	labelFn := s.wrap((&labeler{bkt: bkt}).labelObject1)
+
+	// Label is returned regardless.
+	for i := 0; i < 2; i++ {
+		lbl, err := labelFn(ctx, "a.txt")
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(3), lbl.Sum)
+	}
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(s.writeFailures))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(s.lookups.WithLabelValues("missing")))
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"github.com/thanos-io/objstore"
+)
+
+// labelUpload labels content read from r with stages selected in ctx, while streaming. If bkt is not nil, content is
+// also stored in bkt under prefix and sha256 of the content as uploaded (before decompression), so it can be labeled
+// again with /label_object and the label has its object ID.
+func (l *labeler) labelUpload(ctx context.Context, r io.Reader, size int64, bkt objstore.Bucket, prefix string) (_ label, err error) {
+	h := sha256.New()
+	src := io.TeeReader(r, h)
+
+	var f *os.File
+	if bkt != nil {
+		// Key is known only once everything is read, so content is kept in the temporary file until then.
+		if f, err = os.CreateTemp("", "labeler-upload-*"); err != nil {
+			return label{}, err
+		}
+		defer func() {
+			_ = f.Close()
+			_ = os.RemoveAll(f.Name())
+		}()
+		src = io.TeeReader(src, f)
+	}
+
+	bufSize, release, err := l.reserve(ctx, bufferSize(int(size)))
+	if err != nil {
+		return label{}, err
+	}
+	defer release()
+
+	dr, err := l.decompressed(src, "")
+	if err != nil {
+		return label{}, err
+	}
+	defer errcapture.Do(&err, dr.Close, "release decompressor")
+
+	p, err := newPipeline(ctx)
+	if err != nil {
+		return label{}, err
+	}
+	buf := make([]byte, bufSize)
+	if _, err := io.CopyBuffer(p, dr, buf); err != nil {
+		return label{}, err
+	}
+	// Decompressor does not have to read trailing bytes, but the key and stored content have to cover them.
+	if _, err := io.CopyBuffer(io.Discard, src, buf); err != nil {
+		return label{}, err
+	}
+
+	lbl, err := p.label("")
+	if err != nil {
+		return label{}, err
+	}
+	if bkt == nil {
+		return lbl, nil
+	}
+
+	lbl.ObjID = prefix + hex.EncodeToString(h.Sum(nil))
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return label{}, err
+	}
+	if err := bkt.Upload(ctx, lbl.ObjID, f); err != nil {
+		return label{}, withCode(codeUpstreamUnavailable, errors.Wrap(err, "upload"))
+	}
+	return lbl, nil
+}
+
+// newUploadHandler returns handler of /label. It labels POST request body with stages selected by `stage` parameters,
+// or defaultStages if there are none, without reading the bucket. Chunked bodies are supported, bodies above
+// maxBodySize are rejected. With `persist=true` parameter body is also stored in bkt (see labeler.labelUpload).
+func newUploadHandler(l *labeler, bkt objstore.Bucket, defaultStages []string, maxBodySize int64, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			httpErrHandle(w, r, withCode(codeMethodNotAllowed, errors.Newf("method %v not allowed", r.Method)))
+			return
+		}
+		if r.ContentLength > maxBodySize {
+			httpErrHandle(w, r, withCode(codeTooLarge, errors.Newf("body of %v bytes is larger than %v bytes", r.ContentLength, maxBodySize)))
+			return
+		}
+
+		// Not ParseForm, as it would read form encoded body.
+		query := r.URL.Query()
+		stageNames, err := parseStages(query["stage"])
+		if err != nil {
+			httpErrHandle(w, r, withCode(codeInvalidInput, err))
+			return
+		}
+		var persistTo objstore.Bucket
+		if v := query.Get("persist"); v != "" {
+			persist, err := strconv.ParseBool(v)
+			if err != nil {
+				httpErrHandle(w, r, withCode(codeInvalidInput, errors.Wrap(err, "persist parameter")))
+				return
+			}
+			if persist {
+				persistTo = bkt
+			}
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxBodySize)
+		lbl, err := l.labelUpload(withDefaultStages(withStages(r.Context(), stageNames), defaultStages), body, r.ContentLength, persistTo, prefix)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				err = withCode(codeTooLarge, errors.Newf("body is larger than %v bytes", maxBodySize))
+			}
+			httpErrHandle(w, r, err)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(&lbl); err != nil {
+			// Client is gone or connection broken, nothing more to report.
+			return
+		}
+	})
+}
@@ -0,0 +1,156 @@
+// Copyright (c) Efficient Go Authors
+// Licensed under the Apache License 2.0.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"go-advanced/pkg/benchmark/micro"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/thanos-io/objstore"
+)
+
+func TestUploadHandler(t *testing.T) {
+	ctx := context.Background()
+	bkt := objstore.NewInMemBucket()
+	l := &labeler{bkt: bkt}
+	srv := httptest.NewServer(newUploadHandler(l, bkt, []string{"sum"}, 64, "uploads/"))
+	t.Cleanup(srv.Close)
+
+	post := func(query string, body io.Reader) (int, label) {
+		t.Helper()
+
+		res, err := http.Post(srv.URL+"/label?"+query, "text/plain", body)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, res.Body.Close()) }()
+
+		lbl := label{}
+		if res.StatusCode == http.StatusOK {
+			testutil.Ok(t, json.NewDecoder(res.Body).Decode(&lbl))
+		}
+		return res.StatusCode, lbl
+	}
+	checksum := func(b []byte) []byte {
+		s := sha256.Sum256(b)
+		return s[:]
+	}
+
+	t.Run("body", func(t *testing.T) {
+		code, lbl := post("", strings.NewReader("1\n2\n"))
+		testutil.Equals(t, http.StatusOK, code)
+		testutil.Equals(t, label{Sum: 3}, lbl)
+
+		code, lbl = post("stage=lines&stage=sum", strings.NewReader("1\n2\n3"))
+		testutil.Equals(t, http.StatusOK, code)
+		testutil.Equals(t, int64(6), lbl.Sum)
+		testutil.Equals(t, json.RawMessage(`3`), lbl.Attributes["lines"])
+	})
+	t.Run("configured stages", func(t *testing.T) {
+		srv := httptest.NewServer(newUploadHandler(l, bkt, []string{"lines", "sum"}, 64, "uploads/"))
+		defer srv.Close()
+
+		res, err := http.Post(srv.URL+"/label", "text/plain", strings.NewReader("1\n2\n"))
+		testutil.Ok(t, err)
+		lbl := label{}
+		testutil.Ok(t, json.NewDecoder(res.Body).Decode(&lbl))
+		testutil.Ok(t, res.Body.Close())
+		testutil.Equals(t, int64(3), lbl.Sum)
+		testutil.Equals(t, json.RawMessage(`2`), lbl.Attributes["lines"])
+
+		// Stages selected by request replace the configured ones.
+		res, err = http.Post(srv.URL+"/label?stage=sum", "text/plain", strings.NewReader("1\n2\n"))
+		testutil.Ok(t, err)
+		lbl = label{}
+		testutil.Ok(t, json.NewDecoder(res.Body).Decode(&lbl))
+		testutil.Ok(t, res.Body.Close())
+		testutil.Equals(t, int64(3), lbl.Sum)
+		testutil.Equals(t, 0, len(lbl.Attributes))
+	})
+	t.Run("chunked", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go func() {
+			for _, chunk := range []string{"1\n", "2", "0\n", "30\n"} {
+				if _, err := pw.Write([]byte(chunk)); err != nil {
+					return
+				}
+			}
+			_ = pw.Close()
+		}()
+		code, lbl := post("", pr)
+		testutil.Equals(t, http.StatusOK, code)
+		testutil.Equals(t, int64(51), lbl.Sum)
+	})
+	t.Run("compressed", func(t *testing.T) {
+		b := bytes.Buffer{}
+		w, err := micro.NewCompressor(&b, micro.CodecGzip)
+		testutil.Ok(t, err)
+		_, err = w.Write([]byte("1\n2\n"))
+		testutil.Ok(t, err)
+		testutil.Ok(t, w.Close())
+
+		code, lbl := post("stage=sum,checksum", bytes.NewReader(b.Bytes()))
+		testutil.Equals(t, http.StatusOK, code)
+		testutil.Equals(t, int64(3), lbl.Sum)
+		// Checksum is of the content, like for objects.
+		testutil.Equals(t, checksum([]byte("1\n2\n")), lbl.CheckSum)
+	})
+	t.Run("persist", func(t *testing.T) {
+		code, lbl := post("persist=true", strings.NewReader("5\n6\n"))
+		testutil.Equals(t, http.StatusOK, code)
+		sum := checksum([]byte("5\n6\n"))
+		testutil.Equals(t, label{ObjID: "uploads/" + hex.EncodeToString(sum), Sum: 11}, lbl)
+
+		// Stored object can be labeled later.
+		stored, err := l.labelObject1(ctx, lbl.ObjID)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(11), stored.Sum)
+	})
+	t.Run("invalid request", func(t *testing.T) {
+		for query, body := range map[string]string{
+			"persist=maybe": "1\n",
+			"stage=nope":    "1\n",
+		} {
+			code, _ := post(query, strings.NewReader(body))
+			testutil.Equals(t, http.StatusBadRequest, code, query)
+		}
+		code, _ := post("", strings.NewReader("1\nx\n"))
+		testutil.Equals(t, http.StatusUnprocessableEntity, code)
+
+		res, err := http.Get(srv.URL + "/label")
+		testutil.Ok(t, err)
+		testutil.Ok(t, res.Body.Close())
+		testutil.Equals(t, http.StatusMethodNotAllowed, res.StatusCode)
+	})
+	t.Run("too large", func(t *testing.T) {
+		before := 0
+		testutil.Ok(t, bkt.Iter(ctx, "uploads/", func(string) error { before++; return nil }))
+
+		large := strings.Repeat("1\n", 64)
+		// Rejected by Content-Length, before reading.
+		code, _ := post("persist=true", strings.NewReader(large))
+		testutil.Equals(t, http.StatusRequestEntityTooLarge, code)
+
+		// Without Content-Length, rejected once read.
+		pr, pw := io.Pipe()
+		go func() {
+			_, _ = pw.Write([]byte(large))
+			_ = pw.Close()
+		}()
+		code, _ = post("persist=true", pr)
+		testutil.Equals(t, http.StatusRequestEntityTooLarge, code)
+
+		after := 0
+		testutil.Ok(t, bkt.Iter(ctx, "uploads/", func(string) error { after++; return nil }))
+		testutil.Equals(t, before, after)
+	})
+}
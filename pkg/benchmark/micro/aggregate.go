@@ -0,0 +1,214 @@
+package micro
+
+import (
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"io"
+	"os"
+)
+
+// ColumnStats holds statistics of a single column, computed in one pass.
+type ColumnStats struct {
+	Count int64
+	Sum   int64
+	Min   int64
+	Max   int64
+
+	// Welford's online algorithm state, so we don't need second pass for variance.
+	mean, m2 float64
+}
+
+func (s *ColumnStats) add(v int64) {
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+
+	delta := float64(v) - s.mean
+	s.mean += delta / float64(s.Count)
+	s.m2 += delta * (float64(v) - s.mean)
+}
+
+// Mean returns arithmetic mean of the column or 0 if there were no values.
+func (s ColumnStats) Mean() float64 { return s.mean }
+
+// Variance returns population variance of the column or 0 if there were no values.
+func (s ColumnStats) Variance() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.m2 / float64(s.Count)
+}
+
+// Aggregator is like Sum6Reader, but for delimited, multi-column lines (e.g. CSV metric dumps).
+// It computes ColumnStats for selected columns in a single pass, reusing the given buffer, so
+// allocations does not grow with the input size.
+type Aggregator struct {
+	delim   byte
+	columns []int
+	// lookup maps field index to index in stats or -1 if field is not selected.
+	lookup []int
+	stats  []ColumnStats
+
+	line int
+}
+
+// NewAggregator returns Aggregator for lines delimited by delim, which aggregates given (0-based) columns.
+func NewAggregator(delim byte, columns ...int) (*Aggregator, error) {
+	if delim == '\n' {
+		return nil, errors.New("delimiter can't be a newline")
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("at least one column is required")
+	}
+
+	var maxColumn int
+	for _, c := range columns {
+		if c < 0 {
+			return nil, errors.Newf("column index can't be negative, got %v", c)
+		}
+		if c > maxColumn {
+			maxColumn = c
+		}
+	}
+
+	a := &Aggregator{
+		delim:   delim,
+		columns: columns,
+		lookup:  make([]int, maxColumn+1),
+		stats:   make([]ColumnStats, len(columns)),
+	}
+	for i := range a.lookup {
+		a.lookup[i] = -1
+	}
+	for i, c := range columns {
+		if a.lookup[c] != -1 {
+			return nil, errors.Newf("column %v selected more than once", c)
+		}
+		a.lookup[c] = i
+	}
+	return a, nil
+}
+
+// Stats returns statistics in the same order as columns passed to NewAggregator.
+// Returned slice is reused by Aggregator, copy it if you want to keep it after Reset.
+func (a *Aggregator) Stats() []ColumnStats { return a.stats }
+
+// Reset clears statistics, so Aggregator can be reused for another input.
+func (a *Aggregator) Reset() {
+	for i := range a.stats {
+		a.stats[i] = ColumnStats{}
+	}
+	a.line = 0
+}
+
+// Aggregate is like Sum6, but for multi-column files. See Aggregator for details.
+func Aggregate(fileName string, delim byte, columns ...int) (_ []ColumnStats, err error) {
+	a, err := NewAggregator(delim, columns...)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer errcapture.Do(&err, f.Close, "close file")
+
+	buf := make([]byte, 8*1024)
+	if err := a.AggregateReader(f, buf); err != nil {
+		return nil, err
+	}
+	return a.Stats(), nil
+}
+
+// AggregateReader aggregates all lines from r using buf as the only read buffer. It can be called multiple times
+// to aggregate multiple readers together. Line has to fit in buf. Empty lines are skipped and the last line does not
+// need to have trailing newline.
+func (a *Aggregator) AggregateReader(r io.Reader, buf []byte) (err error) {
+	var offset, n int
+	for err != io.EOF {
+		n, err = r.Read(buf[offset:])
+		if err != nil && err != io.EOF {
+			return err
+		}
+		n += offset
+
+		var last int
+		for i := range buf[:n] {
+			if buf[i] != '\n' {
+				continue
+			}
+			a.line++
+			if err := a.aggregateLine(buf[last:i]); err != nil {
+				return err
+			}
+			last = i + 1
+		}
+
+		offset = n - last
+		if offset == len(buf) {
+			return errors.Newf("line %v does not fit in the buffer of %v bytes", a.line+1, len(buf))
+		}
+		if offset > 0 {
+			_ = copy(buf, buf[last:n])
+		}
+	}
+
+	if offset > 0 {
+		// Last line without trailing newline.
+		a.line++
+		return a.aggregateLine(buf[:offset])
+	}
+	return nil
+}
+
+func (a *Aggregator) aggregateLine(line []byte) error {
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	if len(line) == 0 {
+		return nil
+	}
+
+	var field, start, found int
+	for i := 0; i <= len(line) && field < len(a.lookup); i++ {
+		if i < len(line) && line[i] != a.delim {
+			continue
+		}
+
+		if j := a.lookup[field]; j >= 0 {
+			v := trimSpaces(line[start:i])
+			if len(v) == 0 {
+				return errors.Newf("line %v: column %v is empty", a.line, field)
+			}
+			num, err := ParseInt(v)
+			if err != nil {
+				return errors.Wrapf(err, "line %v: column %v", a.line, field)
+			}
+			a.stats[j].add(num)
+			found++
+		}
+		field++
+		start = i + 1
+	}
+
+	if found < len(a.columns) {
+		return errors.Newf("line %v: expected at least %v columns, got %v", a.line, len(a.lookup), field)
+	}
+	return nil
+}
+
+func trimSpaces(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		b = b[1:]
+	}
+	for len(b) > 0 && (b[len(b)-1] == ' ' || b[len(b)-1] == '\t') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,175 @@
+package micro
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/efficientgo/core/testutil"
+	"math"
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	for _, tcase := range []struct {
+		name    string
+		input   string
+		delim   byte
+		columns []int
+		bufSize int
+
+		expected []ColumnStats
+		mean     []float64
+		variance []float64
+		err      string
+	}{
+		{
+			name:     "empty",
+			delim:    ',',
+			columns:  []int{0},
+			expected: []ColumnStats{{}},
+			mean:     []float64{0},
+			variance: []float64{0},
+		},
+		{
+			name:     "single column, no trailing newline",
+			input:    "1\n2\n3\n4",
+			delim:    ',',
+			columns:  []int{0},
+			expected: []ColumnStats{{Count: 4, Sum: 10, Min: 1, Max: 4}},
+			mean:     []float64{2.5},
+			variance: []float64{1.25},
+		},
+		{
+			name:     "csv with selected columns, spaces, CRLF and empty lines",
+			input:    "a,1, -5,100\r\n\nb,3,5 ,200\r\nc,2,0,300\n",
+			delim:    ',',
+			columns:  []int{3, 1, 2},
+			expected: []ColumnStats{{Count: 3, Sum: 600, Min: 100, Max: 300}, {Count: 3, Sum: 6, Min: 1, Max: 3}, {Count: 3, Sum: 0, Min: -5, Max: 5}},
+			mean:     []float64{200, 2, 0},
+			variance: []float64{20000.0 / 3, 2.0 / 3, 50.0 / 3},
+		},
+		{
+			name:     "tab separated with small buffer",
+			input:    "10\t-10\n20\t-20\n30\t-30\n40\t-40\n",
+			delim:    '\t',
+			columns:  []int{0, 1},
+			bufSize:  8,
+			expected: []ColumnStats{{Count: 4, Sum: 100, Min: 10, Max: 40}, {Count: 4, Sum: -100, Min: -40, Max: -10}},
+			mean:     []float64{25, -25},
+			variance: []float64{125, 125},
+		},
+		{
+			name:    "missing column",
+			input:   "1,2\n3\n",
+			delim:   ',',
+			columns: []int{1},
+			err:     "line 2: expected at least 2 columns, got 1",
+		},
+		{
+			name:    "empty column",
+			input:   "1,2\n3, \n",
+			delim:   ',',
+			columns: []int{1},
+			err:     "line 2: column 1 is empty",
+		},
+		{
+			name:    "line longer than buffer",
+			input:   "1,2\n123456789,2\n",
+			delim:   ',',
+			columns: []int{0},
+			bufSize: 8,
+			err:     "line 2 does not fit in the buffer of 8 bytes",
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			a, err := NewAggregator(tcase.delim, tcase.columns...)
+			testutil.Ok(t, err)
+
+			if tcase.bufSize == 0 {
+				tcase.bufSize = 8 * 1024
+			}
+			err = a.AggregateReader(bytes.NewReader([]byte(tcase.input)), make([]byte, tcase.bufSize))
+			if tcase.err != "" {
+				testutil.NotOk(t, err)
+				testutil.Equals(t, tcase.err, err.Error())
+				return
+			}
+			testutil.Ok(t, err)
+
+			stats := a.Stats()
+			testutil.Equals(t, len(tcase.expected), len(stats))
+			for i, s := range stats {
+				testutil.Equals(t, tcase.expected[i].Count, s.Count)
+				testutil.Equals(t, tcase.expected[i].Sum, s.Sum)
+				testutil.Equals(t, tcase.expected[i].Min, s.Min)
+				testutil.Equals(t, tcase.expected[i].Max, s.Max)
+				testutil.Assert(t, math.Abs(tcase.mean[i]-s.Mean()) < 1e-9, "mean %v: expected %v, got %v", i, tcase.mean[i], s.Mean())
+				testutil.Assert(t, math.Abs(tcase.variance[i]-s.Variance()) < 1e-9, "variance %v: expected %v, got %v", i, tcase.variance[i], s.Variance())
+			}
+		})
+	}
+}
+
+func TestNewAggregator_Errors(t *testing.T) {
+	_, err := NewAggregator(',')
+	testutil.NotOk(t, err)
+	_, err = NewAggregator(',', -1)
+	testutil.NotOk(t, err)
+	_, err = NewAggregator(',', 1, 1)
+	testutil.NotOk(t, err)
+	_, err = NewAggregator('\n', 1)
+	testutil.NotOk(t, err)
+}
+
+func createAggregateTestInput(numLines int) []byte {
+	b := bytes.Buffer{}
+	for i := 0; i < numLines; i++ {
+		_, _ = fmt.Fprintf(&b, "host-%d,%d,%d,%d\n", i%10, i, -i, i%1000)
+	}
+	return b.Bytes()
+}
+
+// TestAggregator_AllocsFlat checks that allocations do not grow with the input size.
+func TestAggregator_AllocsFlat(t *testing.T) {
+	a, err := NewAggregator(',', 1, 2, 3)
+	testutil.Ok(t, err)
+
+	buf := make([]byte, 8*1024)
+	r := bytes.NewReader(nil)
+
+	var allocs []float64
+	for _, numLines := range []int{1e2, 1e4, 1e5} {
+		input := createAggregateTestInput(numLines)
+		allocs = append(allocs, testing.AllocsPerRun(10, func() {
+			a.Reset()
+			r.Reset(input)
+			if err := a.AggregateReader(r, buf); err != nil {
+				t.Fatal(err)
+			}
+		}))
+		testutil.Equals(t, int64(numLines), a.Stats()[0].Count)
+	}
+	testutil.Equals(t, []float64{0, 0, 0}, allocs)
+}
+
+// BenchmarkAggregateReader recommended run options:
+// $ go test -run '^$' -bench '^BenchmarkAggregateReader' -benchtime 10s -count 6 -cpu 4 -benchmem
+func BenchmarkAggregateReader(b *testing.B) {
+	for _, numLines := range []int{1e4, 1e6} {
+		b.Run(fmt.Sprintf("lines-%d", numLines), func(b *testing.B) {
+			b.ReportAllocs()
+
+			input := createAggregateTestInput(numLines)
+			a, err := NewAggregator(',', 1, 2, 3)
+			testutil.Ok(b, err)
+			buf := make([]byte, 8*1024)
+			r := bytes.NewReader(nil)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				a.Reset()
+				r.Reset(input)
+				testutil.Ok(b, a.AggregateReader(r, buf))
+			}
+		})
+	}
+}
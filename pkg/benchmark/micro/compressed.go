@@ -0,0 +1,233 @@
+package micro
+
+import (
+	"bytes"
+	"github.com/efficientgo/core/errors"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Codec is a compression format of the input.
+type Codec int
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecZstd
+	// CodecSnappy is the framed snappy format (https://github.com/google/snappy/blob/main/framing_format.txt).
+	CodecSnappy
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecGzip:
+		return "gzip"
+	case CodecZstd:
+		return "zstd"
+	case CodecSnappy:
+		return "snappy"
+	}
+	return "none"
+}
+
+// ParseCodec returns codec by its name, as returned by Codec.String.
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{CodecNone, CodecGzip, CodecZstd, CodecSnappy} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return CodecNone, errors.Newf("unknown codec %q", name)
+}
+
+func (c Codec) MarshalText() ([]byte, error) { return []byte(c.String()), nil }
+
+func (c *Codec) UnmarshalText(text []byte) (err error) {
+	*c, err = ParseCodec(string(text))
+	return err
+}
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// MaxMagicLen is the number of bytes DetectCodec needs to recognize all codecs.
+const MaxMagicLen = 10
+
+// CodecFromName returns codec based on the file or object name suffix: `.gz`, `.zst` or `.sz`. It returns
+// CodecNone for other names.
+func CodecFromName(name string) Codec {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return CodecGzip
+	case strings.HasSuffix(name, ".zst"):
+		return CodecZstd
+	case strings.HasSuffix(name, ".sz"):
+		return CodecSnappy
+	}
+	return CodecNone
+}
+
+// DetectCodec returns codec based on magic bytes at the beginning of the input. It returns CodecNone if none matches,
+// which is always the case for newline-delimited integers.
+func DetectCodec(head []byte) Codec {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return CodecGzip
+	case bytes.HasPrefix(head, zstdMagic):
+		return CodecZstd
+	case bytes.HasPrefix(head, snappyMagic):
+		return CodecSnappy
+	}
+	return CodecNone
+}
+
+// DecompressorPool pools decompressor state (window, tables and buffers, which are tens to hundreds of KB
+// depending on the codec), like labeler pools read buffers. Zero value is ready to use and it's safe to use
+// concurrently.
+type DecompressorPool struct {
+	gzip, zstd, snappy sync.Pool
+}
+
+// NewCompressor returns writer compressing to w with the given codec, e.g. to create compressed test inputs. Close
+// flushes the compressor, it does not close w.
+func NewCompressor(w io.Writer, codec Codec) (io.WriteCloser, error) {
+	switch codec {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	case CodecSnappy:
+		return s2.NewWriter(w, s2.WriterSnappyCompat()), nil
+	case CodecNone:
+		return nopWriteCloser{Writer: w}, nil
+	}
+	return nil, errors.Newf("unknown codec %v", codec)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// WithDecompression makes Sum6 and Sum6Reader detect compressed input by magic bytes and decompress it while
+// streaming, using decompressors from p. Other variants ignore it.
+func WithDecompression(p *DecompressorPool) Option {
+	return func(o *options) {
+		o.decompressors = p
+	}
+}
+
+// NewReader returns reader which decompresses r while streaming. Codec is detected from name suffix (see
+// CodecFromName) if name is not empty, otherwise from magic bytes (see DetectCodec). Input which is not compressed
+// is returned as it is. Close returns decompressor to the pool. It does not close r.
+func (p *DecompressorPool) NewReader(r io.Reader, name string) (io.ReadCloser, error) {
+	d := &decompressReader{pool: p, peeked: peekedReader{r: r}}
+
+	codec := CodecFromName(name)
+	if codec == CodecNone {
+		n, err := io.ReadFull(r, d.peeked.buf[:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		d.peeked.n = n
+		codec = DetectCodec(d.peeked.buf[:n])
+	}
+	d.codec = codec
+
+	switch codec {
+	case CodecGzip:
+		if gr, ok := p.gzip.Get().(*gzip.Reader); ok {
+			if err := gr.Reset(&d.peeked); err != nil {
+				p.gzip.Put(gr)
+				return nil, errors.Wrap(err, "gzip")
+			}
+			d.r = gr
+			break
+		}
+		gr, err := gzip.NewReader(&d.peeked)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		d.r = gr
+	case CodecZstd:
+		zr, ok := p.zstd.Get().(*zstd.Decoder)
+		if !ok {
+			var err error
+			// Concurrency 1 decodes synchronously, without goroutines, so decoders are safe to be dropped by the pool.
+			if zr, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+				return nil, errors.Wrap(err, "zstd")
+			}
+		}
+		if err := zr.Reset(&d.peeked); err != nil {
+			p.zstd.Put(zr)
+			return nil, errors.Wrap(err, "zstd")
+		}
+		d.r = zr
+	case CodecSnappy:
+		sr, ok := p.snappy.Get().(*s2.Reader)
+		if !ok {
+			// S2 reads snappy framed format too.
+			sr = s2.NewReader(nil)
+		}
+		sr.Reset(&d.peeked)
+		d.r = sr
+	default:
+		d.r = &d.peeked
+	}
+	return d, nil
+}
+
+// peekedReader returns bytes peeked for magic detection first, then reads from r.
+type peekedReader struct {
+	buf     [MaxMagicLen]byte
+	n, read int
+	r       io.Reader
+}
+
+func (p *peekedReader) Read(b []byte) (int, error) {
+	if p.read < p.n {
+		n := copy(b, p.buf[p.read:p.n])
+		p.read += n
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+type decompressReader struct {
+	pool   *DecompressorPool
+	codec  Codec
+	peeked peekedReader
+	r      io.Reader
+}
+
+func (d *decompressReader) Read(b []byte) (int, error) {
+	if d.r == nil {
+		return 0, errors.New("read after close")
+	}
+	return d.r.Read(b)
+}
+
+func (d *decompressReader) Close() error {
+	if d.r == nil {
+		return nil
+	}
+	switch d.codec {
+	case CodecGzip:
+		d.pool.gzip.Put(d.r)
+	case CodecZstd:
+		// Release reference to the input, but keep decoder state.
+		_ = d.r.(*zstd.Decoder).Reset(nil)
+		d.pool.zstd.Put(d.r)
+	case CodecSnappy:
+		d.r.(*s2.Reader).Reset(nil)
+		d.pool.snappy.Put(d.r)
+	}
+	d.r = nil
+	return nil
+}
@@ -0,0 +1,138 @@
+package micro
+
+import (
+	"bytes"
+	"github.com/efficientgo/core/testutil"
+	"io"
+	"os"
+	"testing"
+)
+
+func compress(tb testing.TB, codec Codec, input []byte) []byte {
+	tb.Helper()
+
+	b := bytes.Buffer{}
+	w, err := NewCompressor(&b, codec)
+	testutil.Ok(tb, err)
+	_, err = w.Write(input)
+	testutil.Ok(tb, err)
+	testutil.Ok(tb, w.Close())
+	return b.Bytes()
+}
+
+var codecs = []Codec{CodecNone, CodecGzip, CodecZstd, CodecSnappy}
+
+func TestDetectCodec(t *testing.T) {
+	for _, codec := range codecs {
+		testutil.Equals(t, codec, DetectCodec(compress(t, codec, []byte("1\n2\n"))), codec.String())
+	}
+	for _, input := range []string{"", "1", "\x1f", "-1\n", "\xff\x06\x00\x00sNaP"} {
+		testutil.Equals(t, CodecNone, DetectCodec([]byte(input)), "input %q", input)
+	}
+
+	testutil.Equals(t, CodecGzip, CodecFromName("dir/10M.txt.gz"))
+	testutil.Equals(t, CodecZstd, CodecFromName("10M.txt.zst"))
+	testutil.Equals(t, CodecSnappy, CodecFromName("10M.txt.sz"))
+	testutil.Equals(t, CodecNone, CodecFromName("10M.txt"))
+	testutil.Equals(t, CodecNone, CodecFromName(""))
+}
+
+func TestSum6Reader_Compressed(t *testing.T) {
+	fn, stats := testInput(t, 1e4)
+	input, err := os.ReadFile(fn)
+	testutil.Ok(t, err)
+	exp := stats.Sum
+
+	p := &DecompressorPool{}
+	for _, codec := range codecs {
+		t.Run(codec.String(), func(t *testing.T) {
+			compressed := compress(t, codec, input)
+
+			// Second run reuses pooled decompressor.
+			for i := 0; i < 2; i++ {
+				ret, err := Sum6Reader(bytes.NewReader(compressed), make([]byte, 8*1024), WithDecompression(p))
+				testutil.Ok(t, err)
+				testutil.Equals(t, exp, ret)
+
+				ret, err = Sum6Reader(bytes.NewReader(compressed), make([]byte, 8*1024), WithDecompression(p), WithOverflowMode(OverflowStrict))
+				testutil.Ok(t, err)
+				testutil.Equals(t, exp, ret)
+			}
+
+			// Name takes precedence over magic bytes.
+			r, err := p.NewReader(bytes.NewReader(compressed), "input"+map[Codec]string{CodecGzip: ".gz", CodecZstd: ".zst", CodecSnappy: ".sz"}[codec])
+			testutil.Ok(t, err)
+			got, err := io.ReadAll(r)
+			testutil.Ok(t, err)
+			testutil.Ok(t, r.Close())
+			testutil.Equals(t, input, got)
+		})
+	}
+
+	t.Run("short input", func(t *testing.T) {
+		ret, err := Sum6Reader(bytes.NewReader([]byte("7")), make([]byte, 8), WithDecompression(p))
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(7), ret)
+	})
+	t.Run("corrupted input", func(t *testing.T) {
+		for _, codec := range codecs[1:] {
+			compressed := compress(t, codec, input)
+			_, err := Sum6Reader(bytes.NewReader(compressed[:len(compressed)/2]), make([]byte, 8*1024), WithDecompression(p))
+			testutil.NotOk(t, err, codec.String())
+		}
+	})
+}
+
+// TestDecompressorPool_Reuse checks that decompressor state is not allocated again for each stream.
+func TestDecompressorPool_Reuse(t *testing.T) {
+	input := bytes.Repeat([]byte("123\n-45\n"), 1e4)
+	buf := make([]byte, 8*1024)
+
+	for _, codec := range codecs[1:] {
+		compressed := compress(t, codec, input)
+		r := bytes.NewReader(nil)
+		p := &DecompressorPool{}
+
+		pooled := testing.AllocsPerRun(20, func() {
+			r.Reset(compressed)
+			if _, err := Sum6Reader(r, buf, WithDecompression(p)); err != nil {
+				t.Fatal(err)
+			}
+		})
+		notPooled := testing.AllocsPerRun(20, func() {
+			r.Reset(compressed)
+			if _, err := Sum6Reader(r, buf, WithDecompression(&DecompressorPool{})); err != nil {
+				t.Fatal(err)
+			}
+		})
+		testutil.Assert(t, pooled < notPooled, "%v: expected less allocations with pool, got %v and %v", codec, pooled, notPooled)
+	}
+}
+
+// BenchmarkSum6Reader_Compressed shows the cost of decompression per codec.
+// Recommended run options:
+// $ go test -run '^$' -bench '^BenchmarkSum6Reader_Compressed' -benchtime 10s -count 6 -cpu 4 -benchmem
+func BenchmarkSum6Reader_Compressed(b *testing.B) {
+	fn, _ := testInput(b, 1e6)
+	input, err := os.ReadFile(fn)
+	testutil.Ok(b, err)
+
+	p := &DecompressorPool{}
+	for _, codec := range codecs {
+		b.Run(codec.String(), func(b *testing.B) {
+			compressed := compress(b, codec, input)
+			buf := make([]byte, 8*1024)
+			r := bytes.NewReader(nil)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(input)))
+			b.ReportMetric(float64(len(input))/float64(len(compressed)), "ratio")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r.Reset(compressed)
+				_, err := Sum6Reader(r, buf, WithDecompression(p))
+				testutil.Ok(b, err)
+			}
+		})
+	}
+}
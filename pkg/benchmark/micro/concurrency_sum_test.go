@@ -1,10 +1,16 @@
 package micro
 
 import (
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 	"github.com/felixge/fgprof"
 	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 /**
@@ -21,8 +27,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/concurrentbenchmarkresult/v1.txt ./pkg/benchmark/micro/concurrentbenchmarkresult/v1.txt
 */
 func BenchmarkConcurrentSum1(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = ConcurrentSum1("testdata/test.2000000.txt")
+		_, _ = ConcurrentSum1(fn)
 	}
 }
 
@@ -40,8 +48,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/concurrentbenchmarkresult/v2.txt ./pkg/benchmark/micro/concurrentbenchmarkresult/v2.txt
 */
 func BenchmarkConcurrentSum2(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = ConcurrentSum2("testdata/test.2000000.txt", 4)
+		_, _ = ConcurrentSum2(fn, 4)
 	}
 }
 
@@ -59,8 +69,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/concurrentbenchmarkresult/v3.txt ./pkg/benchmark/micro/concurrentbenchmarkresult/v3.txt
 */
 func BenchmarkConcurrentSum3(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = ConcurrentSum3("testdata/test.2000000.txt", 4)
+		_, _ = ConcurrentSum3(fn, 4)
 	}
 }
 
@@ -94,8 +106,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/concurrentbenchmarkresult/v4.txt ./pkg/benchmark/micro/concurrentbenchmarkresult/v4.txt
 */
 func BenchmarkConcurrentSum4(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = ConcurrentSum4("testdata/test.2000000.txt", 4)
+		_, _ = ConcurrentSum4(fn, 4)
 	}
 }
 
@@ -114,3 +128,99 @@ func BenchmarkConcurrentSum4_fgprof(b *testing.B) {
 	BenchmarkConcurrentSum4(b)
 	testutil.Ok(b, closeFunc())
 }
+
+/**
+export ver=vmmap && \
+	go test -run '^$' -bench '^BenchmarkConcurrentSumMmap' -benchtime 10s -count 6 \
+		-cpu 4 \
+		-benchmem \
+		-memprofile=./concurrentbenchmarkresult/${ver}.mem.pprof -cpuprofile=./concurrentbenchmarkresult/${ver}.cpu.pprof \
+	| tee ./concurrentbenchmarkresult/${ver}.txt
+*/
+/**
+using benchstat for visualization:
+$ gvm use go1.24.1
+$ benchstat ./pkg/benchmark/micro/concurrentbenchmarkresult/v4.txt ./pkg/benchmark/micro/concurrentbenchmarkresult/vmmap.txt
+*/
+func BenchmarkConcurrentSumMmap(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = ConcurrentSumMmap(fn, 4)
+	}
+}
+
+// rssBytes returns current RSS of the process (including memory mapped file pages) using /proc/self/statm. It's only
+// available on Linux.
+func rssBytes() (int64, error) {
+	b, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0, errors.Newf("unexpected /proc/self/statm content %q", b)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+// BenchmarkConcurrentSum_PeakRSS compares latency and peak RSS (sampled every millisecond) of heap, ReadAt and memory
+// mapped variants. Peak RSS is reported as "peak-RSS-bytes", relative to RSS before the benchmark.
+/**
+$ go test -run '^$' -bench '^BenchmarkConcurrentSum_PeakRSS' -benchtime 100x -count 6 -cpu 4 -benchmem
+*/
+func BenchmarkConcurrentSum_PeakRSS(b *testing.B) {
+	fn, _ := testInput(b, 1e6)
+
+	for _, tcase := range []struct {
+		name string
+		sum  func(fileName string, workers int, opts ...Option) (int64, error)
+	}{
+		{name: "ConcurrentSum3", sum: ConcurrentSum3},
+		{name: "ConcurrentSum4", sum: ConcurrentSum4},
+		{name: "ConcurrentSumMmap", sum: ConcurrentSumMmap},
+	} {
+		b.Run(tcase.name, func(b *testing.B) {
+			b.ReportAllocs()
+			runtime.GC()
+			debug.FreeOSMemory()
+
+			base, err := rssBytes()
+			if err != nil {
+				b.Skip("RSS is not available:", err)
+			}
+			peak := base
+			done := make(chan struct{})
+			sampled := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(1 * time.Millisecond):
+						// Not b.Fatal, as it must be called from the benchmark goroutine. Failed samples are ignored.
+						if rss, err := rssBytes(); err == nil && rss > peak {
+							peak = rss
+						}
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := tcase.sum(fn, 4)
+				testutil.Ok(b, err)
+			}
+			b.StopTimer()
+
+			close(done)
+			<-sampled
+			b.ReportMetric(float64(peak-base), "peak-RSS-bytes")
+		})
+	}
+}
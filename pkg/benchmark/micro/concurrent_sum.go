@@ -1,58 +1,82 @@
 package micro // ConcurrentSum1 performs sum concurrently. A lot slower than ConcurrentSum3. An example of pessimisation.
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"github.com/efficientgo/core/errcapture"
 	"github.com/efficientgo/core/errors"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"sync"
 	"sync/atomic"
 )
 
 // ConcurrentSum1 the naive implementation of concurrent because the order of sum is not matters.
 // Then using a shared variable that parallelly add to it.
-func ConcurrentSum1(fileName string) (ret int64, _ error) {
+func ConcurrentSum1(fileName string, opts ...Option) (ret int64, _ error) {
 	b, err := os.ReadFile(fileName)
 	if err != nil {
 		return 0, err
 	}
+	if o := newOptions(opts); o.overflow != OverflowWrap {
+		return concurrentSumBytes(context.Background(), b, runtime.GOMAXPROCS(0), o)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		retErr  error
+	)
+	sumLine := func(line []byte) {
+		defer wg.Done()
+		num, err := ParseInt(line)
+		if err != nil {
+			errOnce.Do(func() { retErr = err })
+			return
+		}
+		atomic.AddInt64(&ret, num)
+	}
 
-	var wg sync.WaitGroup
 	var last int
 	for i := 0; i < len(b); i++ {
 		if b[i] != '\n' {
 			continue
 		}
 
-		wg.Add(1)
-		go func(line []byte) { // Creation of goroutine turns to be mem intensive on scale! (on top of time)
-			defer wg.Done()
-			num, err := ParseInt(line)
-			if err != nil {
-				// TODO(bwplotka): Return err using other channel.
-				return
-			}
-			atomic.AddInt64(&ret, num)
-		}(b[last:i])
+		if i > last { // Skip empty lines.
+			wg.Add(1)
+			go sumLine(b[last:i]) // Creation of goroutine turns to be mem intensive on scale! (on top of time)
+		}
 		last = i + 1
 	}
+	if last < len(b) { // Last line without trailing newline.
+		wg.Add(1)
+		go sumLine(b[last:])
+	}
 	wg.Wait()
+	if retErr != nil {
+		return 0, retErr
+	}
 	return ret, nil
 }
 
 // ConcurrentSum2 performs sum concurrently. A lot slower than ConcurrentSum3. An example of pessimisation.
 // Read more in "Efficient Go"; Example 10-11.
-func ConcurrentSum2(fileName string, workers int) (ret int64, _ error) {
+func ConcurrentSum2(fileName string, workers int, opts ...Option) (ret int64, _ error) {
 	b, err := os.ReadFile(fileName)
 	if err != nil {
 		return 0, err
 	}
+	if o := newOptions(opts); o.overflow != OverflowWrap {
+		return concurrentSumBytes(context.Background(), b, workers, o)
+	}
 
 	var (
-		wg     = sync.WaitGroup{}
-		workCh = make(chan []byte, workers)
+		wg      = sync.WaitGroup{}
+		workCh  = make(chan []byte, workers)
+		errOnce sync.Once
+		retErr  error
 	)
 
 	//TODO:NOTE: one producer produces lines to workCh, multiple consumers read from it to parse & sum.
@@ -63,9 +87,14 @@ func ConcurrentSum2(fileName string, workers int) (ret int64, _ error) {
 			if b[i] != '\n' {
 				continue
 			}
-			workCh <- b[last:i]
+			if i > last { // Skip empty lines.
+				workCh <- b[last:i]
+			}
 			last = i + 1
 		}
+		if last < len(b) { // Last line without trailing newline.
+			workCh <- b[last:]
+		}
 		close(workCh)
 		wg.Done()
 	}()
@@ -76,7 +105,8 @@ func ConcurrentSum2(fileName string, workers int) (ret int64, _ error) {
 			for line := range workCh { // Common mistake: for _, line := range <-workCh
 				num, err := ParseInt(line)
 				if err != nil {
-					// TODO(bwplotka): Return err using other channel.
+					// Keep consuming, so producer is not blocked. See ConcurrentSum2Context for early stop.
+					errOnce.Do(func() { retErr = err })
 					continue
 				}
 				sum += num
@@ -86,15 +116,19 @@ func ConcurrentSum2(fileName string, workers int) (ret int64, _ error) {
 		}()
 	}
 	wg.Wait()
+	if retErr != nil {
+		return 0, retErr
+	}
 	return ret, nil
 }
 
 // Over inline budget, but for readability it's better. Consider splitting functions if needed to get it inlinded.
 // ./sum_concurrent.go:11:6: cannot inline shardedRange: function too complex: cost 95 exceeds budget 80
-func shardedRange(routineNumber int, bytesPerWorker int, b []byte) (int, int) {
+func shardedRange(routineNumber int, workers int, bytesPerWorker int, b []byte) (int, int) {
 	begin := routineNumber * bytesPerWorker
 	end := begin + bytesPerWorker
-	if end+bytesPerWorker > len(b) {
+	if routineNumber == workers-1 {
+		// The last shard takes the remainder. For small inputs it can be bigger than bytesPerWorker.
 		end = len(b)
 	}
 
@@ -105,34 +139,58 @@ func shardedRange(routineNumber int, bytesPerWorker int, b []byte) (int, int) {
 
 // ConcurrentSum3 uses coordination free sharding to perform more efficient computation.
 // Read more in "Efficient Go"; Example 10-12.
-func ConcurrentSum3(fileName string, workers int) (ret int64, _ error) {
+func ConcurrentSum3(fileName string, workers int, opts ...Option) (ret int64, _ error) {
 	b, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return 0, err
 	}
+	if o := newOptions(opts); o.overflow != OverflowWrap {
+		return concurrentSumBytes(context.Background(), b, workers, o)
+	}
+	return concurrentSumBytesWrap(b, workers)
+}
 
+// concurrentSumBytesWrap is the original, unchecked ConcurrentSum3 algorithm over b, used in OverflowWrap mode.
+func concurrentSumBytesWrap(b []byte, workers int) (ret int64, _ error) {
 	var (
 		bytesPerWorker = len(b) / workers
 		resultCh       = make(chan int64)
+		errOnce        sync.Once
+		retErr         error
 	)
+	if bytesPerWorker == 0 {
+		// Otherwise all shards would be empty.
+		workers, bytesPerWorker = 1, len(b)
+	}
 
 	for i := 0; i < workers; i++ {
 		go func(i int) {
 			// Coordination-free algorithm, which shards buffered file deterministically.
-			begin, end := shardedRange(i, bytesPerWorker, b)
+			begin, end := shardedRange(i, workers, bytesPerWorker, b)
 
 			var sum int64
-			for last := begin; begin < end; begin++ {
+			last := begin
+			for ; begin < end; begin++ {
 				if b[begin] != '\n' {
 					continue
 				}
-				num, err := ParseInt(b[last:begin])
+				if begin > last { // Skip empty lines.
+					num, err := ParseInt(b[last:begin])
+					if err != nil {
+						errOnce.Do(func() { retErr = err })
+						resultCh <- 0
+						return
+					}
+					sum += num
+				}
+				last = begin + 1
+			}
+			if end == len(b) && last < end { // Last line without trailing newline.
+				num, err := ParseInt(b[last:end])
 				if err != nil {
-					// TODO(bwplotka): Return err using other channel.
-					continue
+					errOnce.Do(func() { retErr = err })
 				}
 				sum += num
-				last = begin + 1
 			}
 			resultCh <- sum
 		}(i)
@@ -142,42 +200,45 @@ func ConcurrentSum3(fileName string, workers int) (ret int64, _ error) {
 		ret += <-resultCh
 	}
 	close(resultCh)
+	if retErr != nil {
+		return 0, retErr
+	}
 	return ret, nil
 }
 
-func shardedRangeFromReaderAt(routineNumber int, bytesPerWorker int, size int, f io.ReaderAt) (int, int) {
-	begin := routineNumber * bytesPerWorker
-	end := begin + bytesPerWorker
-	if end+bytesPerWorker > size {
+// shardedRangeFromReaderAt is like shardedRange, but for f of the given size. The last newline before the shard is
+// searched backwards in small chunks as far as needed, so lines of any length are never split between shards.
+func shardedRangeFromReaderAt(routineNumber int, workers int, bytesPerWorker int, size int, f io.ReaderAt) (begin int, end int, err error) {
+	begin = routineNumber * bytesPerWorker
+	end = begin + bytesPerWorker
+	if routineNumber == workers-1 {
+		// The last shard takes the remainder. For small inputs it can be bigger than bytesPerWorker.
 		end = size
 	}
 
-	if begin == 0 {
-		return begin, end
-	}
-
-	const maxNumSize = 10
-	buf := make([]byte, maxNumSize)
-	begin -= maxNumSize
-
-	if _, err := f.ReadAt(buf, int64(begin)); err != nil {
-		// TODO(bwplotka): Return err using other channel.
-		fmt.Println(err)
-		return 0, 0
-	}
+	// Most lines are short, so one chunk is usually enough.
+	buf := make([]byte, 64)
+	for off := begin; off > 0; {
+		chunk := buf
+		if off < len(chunk) {
+			chunk = chunk[:off]
+		}
+		off -= len(chunk)
 
-	for i := maxNumSize; i > 0; i-- {
-		if buf[i-1] == '\n' {
-			begin += i
-			break
+		if n, err := f.ReadAt(chunk, int64(off)); err != nil && !(err == io.EOF && n == len(chunk)) {
+			return 0, 0, errors.Wrapf(err, "find beginning of shard %v at %v", routineNumber, off)
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return off + i + 1, end, nil
 		}
 	}
-	return begin, end
+	// No newline before, so it's the first line.
+	return 0, end, nil
 }
 
 // ConcurrentSum4 is like ConcurrentSum3, but it reads file in sharded way too.
 // Read more in "Efficient Go"; Example 10-13.
-func ConcurrentSum4(fileName string, workers int) (ret int64, _ error) {
+func ConcurrentSum4(fileName string, workers int, opts ...Option) (ret int64, err error) {
 	f, err := os.Open(fileName)
 	if err != nil {
 		return 0, err
@@ -193,22 +254,32 @@ func ConcurrentSum4(fileName string, workers int) (ret int64, _ error) {
 		size           = int(s.Size())
 		bytesPerWorker = size / workers
 		resultCh       = make(chan int64)
+		errOnce        sync.Once
+		retErr         error
 	)
 
-	if bytesPerWorker < 10 {
-		return 0, errors.New("can't have less bytes per goroutine than 10")
+	if o := newOptions(opts); o.overflow != OverflowWrap {
+		return concurrentSumReaderAt(context.Background(), f, size, workers, o)
+	}
+	if bytesPerWorker == 0 {
+		// Otherwise all shards would be empty.
+		workers, bytesPerWorker = 1, size
 	}
 
 	for i := 0; i < workers; i++ {
 		go func(i int) {
-			begin, end := shardedRangeFromReaderAt(i, bytesPerWorker, size, f)
+			begin, end, err := shardedRangeFromReaderAt(i, workers, bytesPerWorker, size, f)
+			if err != nil {
+				errOnce.Do(func() { retErr = err })
+				resultCh <- 0
+				return
+			}
 			r := io.NewSectionReader(f, int64(begin), int64(end-begin))
 
 			b := make([]byte, 8*1024)
-			sum, err := Sum6Reader(r, b)
+			sum, err := sum6Reader(r, b, end == size)
 			if err != nil {
-				// TODO(bwplotka): Return err using other channel.
-				fmt.Println(err)
+				errOnce.Do(func() { retErr = err })
 			}
 			resultCh <- sum
 		}(i)
@@ -218,5 +289,8 @@ func ConcurrentSum4(fileName string, workers int) (ret int64, _ error) {
 		ret += <-resultCh
 	}
 	close(resultCh)
+	if retErr != nil {
+		return 0, retErr
+	}
 	return ret, nil
 }
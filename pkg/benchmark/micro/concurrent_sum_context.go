@@ -0,0 +1,311 @@
+package micro
+
+import (
+	"bytes"
+	"context"
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ConcurrentSum2Context is like ConcurrentSum2, but the first parse error stops the producer and is returned
+// to the caller as *SumError with the line number and byte offset. Cancelling ctx aborts the sum.
+func ConcurrentSum2Context(ctx context.Context, fileName string, workers int, opts ...Option) (int64, error) {
+	if workers < 1 {
+		return 0, errors.Newf("workers has to be positive, got %v", workers)
+	}
+
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	o := newOptions(opts)
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      = sync.WaitGroup{}
+		workCh  = make(chan []byte, workers)
+		results = make([]*accumulator, workers)
+		errs    = make([]error, workers)
+	)
+
+	wg.Add(workers + 1)
+	go func() {
+		defer wg.Done()
+		defer close(workCh)
+
+		var last int
+		for i := 0; i < len(b); i++ {
+			if b[i] != '\n' {
+				continue
+			}
+			select {
+			case workCh <- b[last:i]:
+			case <-wctx.Done():
+				return
+			}
+			last = i + 1
+		}
+		if last < len(b) {
+			select {
+			case workCh <- b[last:]:
+			case <-wctx.Done():
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			// No stop checks in accumulator: lines already taken from workCh are always parsed, so no line before the
+			// failed one is skipped. Lines that are still in workCh after the failure are after it.
+			a := newAccumulator(o)
+			for line := range workCh {
+				// Lines share backing array with b, so the offset is the difference of capacities.
+				if err := a.addLine(line, int64(cap(b)-cap(line))); err != nil {
+					errs[i] = err
+					cancel()
+					break
+				}
+			}
+			results[i] = a
+		}(i)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Overflow depends on the order of additions. If it might have happened, find the result sequentially.
+	sequential := func() (int64, error) { return sumBytesCheckedContext(ctx, b, o) }
+	a := newAccumulator(o)
+	for _, r := range results {
+		if !a.merge(r) {
+			return sequential()
+		}
+	}
+
+	var firstErr *SumError
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		serr := err.(*SumError)
+		if firstErr == nil || serr.Offset < firstErr.Offset {
+			firstErr = serr
+		}
+	}
+	if firstErr != nil {
+		if errors.Is(firstErr, ErrOverflow) {
+			return sequential()
+		}
+		// Line numbers are counted per worker, count them again.
+		firstErr.Line = bytes.Count(b[:firstErr.Offset], []byte("\n")) + 1
+		return 0, firstErr
+	}
+	return a.result(), nil
+}
+
+// ConcurrentSum3Context is like ConcurrentSum3, but the first parse error stops workers of next shards and is
+// returned to the caller as *SumError with the line number and byte offset. Cancelling ctx aborts the sum.
+func ConcurrentSum3Context(ctx context.Context, fileName string, workers int, opts ...Option) (int64, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return concurrentSumBytes(ctx, b, workers, newOptions(opts))
+}
+
+// ConcurrentSum4Context is like ConcurrentSum4, but the first parse or I/O error stops workers of next shards and
+// is returned to the caller as *SumError with the line number and byte offset. Cancelling ctx aborts the sum.
+func ConcurrentSum4Context(ctx context.Context, fileName string, workers int, opts ...Option) (ret int64, err error) {
+	if workers < 1 {
+		return 0, errors.Newf("workers has to be positive, got %v", workers)
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer errcapture.Do(&err, f.Close, "close file")
+
+	s, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return concurrentSumReaderAt(ctx, f, int(s.Size()), workers, newOptions(opts))
+}
+
+func sumBytesCheckedContext(ctx context.Context, b []byte, o options) (int64, error) {
+	a := newAccumulator(o)
+	a.done = ctx.Done()
+	if err := a.sumBytes(b, 0, true); err != nil {
+		if err == errStopped {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	return a.result(), nil
+}
+
+// shardResult is a result of a single shard worker.
+type shardResult struct {
+	a     *accumulator
+	begin int64
+	err   error
+}
+
+// runShards runs worker for each shard concurrently. Accumulators passed to workers stop when ctx is done or
+// worker of any previous shard failed, so the first failed shard has always the first error in the input.
+func runShards(ctx context.Context, workers int, o options, worker func(i int, a *accumulator) (begin int64, err error)) []shardResult {
+	var (
+		wg      sync.WaitGroup
+		failed  atomic.Int64
+		results = make([]shardResult, workers)
+	)
+	failed.Store(math.MaxInt64)
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			a := newAccumulator(o)
+			a.shard = int64(i)
+			a.failed = &failed
+			a.done = ctx.Done()
+
+			begin, err := worker(i, a)
+			if err != nil && err != errStopped {
+				for {
+					cur := failed.Load()
+					if cur <= int64(i) || failed.CompareAndSwap(cur, int64(i)) {
+						break
+					}
+				}
+			}
+			results[i] = shardResult{a: a, begin: begin, err: err}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// mergeShards merges shard results in order. Results and errors are the same as if input was summed
+// sequentially: the first error of the first failed shard is returned, always as *SumError. If overflow or saturation might have happened
+// (they depend on the order of additions) sequential is used to find the correct result.
+func mergeShards(ctx context.Context, results []shardResult, o options, countLines func(until int64) (int, error), sequential func() (int64, error)) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	a := newAccumulator(o)
+	for _, r := range results {
+		// Failed shard is merged too, as overflow before its error would be the first error.
+		if !a.merge(r.a) {
+			return sequential()
+		}
+		if r.err == nil {
+			continue
+		}
+		if errors.Is(r.err, ErrOverflow) {
+			return sequential()
+		}
+
+		serr, ok := r.err.(*SumError)
+		if !ok {
+			// Shard failed before summing any line, e.g. when looking for its beginning.
+			return 0, &SumError{Offset: r.begin, Err: r.err}
+		}
+		// Line numbers are counted per shard.
+		before, err := countLines(r.begin)
+		if err != nil {
+			return 0, &SumError{Offset: serr.Offset, Err: errors.Wrap(err, "count lines before shard")}
+		}
+		return 0, &SumError{Line: serr.Line + before, Offset: serr.Offset, Err: serr.Err}
+	}
+	return a.result(), nil
+}
+
+// concurrentSumBytes shards b like ConcurrentSum3, but with error propagation and cancellation.
+func concurrentSumBytes(ctx context.Context, b []byte, workers int, o options) (int64, error) {
+	if workers < 1 {
+		return 0, errors.Newf("workers has to be positive, got %v", workers)
+	}
+	bytesPerWorker := len(b) / workers
+	if bytesPerWorker == 0 {
+		workers, bytesPerWorker = 1, len(b)
+	}
+
+	results := runShards(ctx, workers, o, func(i int, a *accumulator) (int64, error) {
+		begin, end := shardedRange(i, workers, bytesPerWorker, b)
+		return int64(begin), a.sumBytes(b[begin:end], int64(begin), end == len(b))
+	})
+	return mergeShards(ctx, results, o, countLinesInBytes(b), func() (int64, error) {
+		return sumBytesCheckedContext(ctx, b, o)
+	})
+}
+
+// concurrentSumReaderAt shards f like ConcurrentSum4, but with error propagation and cancellation.
+func concurrentSumReaderAt(ctx context.Context, f io.ReaderAt, size int, workers int, o options) (int64, error) {
+	if workers < 1 {
+		return 0, errors.Newf("workers has to be positive, got %v", workers)
+	}
+	bytesPerWorker := size / workers
+	if bytesPerWorker == 0 {
+		workers, bytesPerWorker = 1, size
+	}
+
+	results := runShards(ctx, workers, o, func(i int, a *accumulator) (int64, error) {
+		begin, end, err := shardedRangeFromReaderAt(i, workers, bytesPerWorker, size, f)
+		if err != nil {
+			return int64(i * bytesPerWorker), err
+		}
+		r := io.NewSectionReader(f, int64(begin), int64(end-begin))
+		return int64(begin), a.sumReader(r, make([]byte, 8*1024), int64(begin), end == size)
+	})
+	return mergeShards(ctx, results, o, countLinesInReaderAt(f), func() (int64, error) {
+		a := newAccumulator(o)
+		a.done = ctx.Done()
+		if err := a.sumReader(io.NewSectionReader(f, 0, int64(size)), make([]byte, 8*1024), 0, true); err != nil {
+			if err == errStopped {
+				return 0, ctx.Err()
+			}
+			return 0, err
+		}
+		return a.result(), nil
+	})
+}
+
+func countLinesInBytes(b []byte) func(until int64) (int, error) {
+	return func(until int64) (int, error) {
+		return bytes.Count(b[:until], []byte("\n")), nil
+	}
+}
+
+func countLinesInReaderAt(r io.ReaderAt) func(until int64) (int, error) {
+	return func(until int64) (lines int, _ error) {
+		buf := make([]byte, 32*1024)
+		for off := int64(0); off < until; {
+			chunk := buf
+			if rem := until - off; rem < int64(len(chunk)) {
+				chunk = chunk[:rem]
+			}
+			n, err := r.ReadAt(chunk, off)
+			lines += bytes.Count(chunk[:n], []byte("\n"))
+			off += int64(n)
+			if err != nil && !(err == io.EOF && off >= until) {
+				return 0, err
+			}
+		}
+		return lines, nil
+	}
+}
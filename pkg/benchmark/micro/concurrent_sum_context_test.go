@@ -0,0 +1,159 @@
+package micro
+
+import (
+	"bytes"
+	"context"
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sumContextFunc func(ctx context.Context, fileName string, workers int, opts ...Option) (int64, error)
+
+var sumContextVariants = map[string]sumContextFunc{
+	"ConcurrentSum2Context": ConcurrentSum2Context,
+	"ConcurrentSum3Context": ConcurrentSum3Context,
+	"ConcurrentSum4Context": ConcurrentSum4Context,
+}
+
+func TestConcurrentSumContext(t *testing.T) {
+	ctx := context.Background()
+	for name, sum := range sumContextVariants {
+		t.Run(name, func(t *testing.T) {
+			for _, lines := range []int{100, 1e4, 1e6} {
+				fn, _ := testInput(t, lines)
+				exp, err := Sum(fn)
+				testutil.Ok(t, err)
+
+				for _, workers := range []int{1, 3, 8} {
+					ret, err := sum(ctx, fn, workers)
+					testutil.Ok(t, err)
+					testutil.Equals(t, exp, ret, "%v with %v workers", fn, workers)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentSumContext_ParseError(t *testing.T) {
+	// Errors in multiple places, the first one has to be returned no matter which worker found it.
+	input := strings.Repeat("12\n", 5000) + "1x\n" + strings.Repeat("12\n", 5000) + "-\n" + strings.Repeat("12\n", 5000) + "y"
+	fn := filepath.Join(t.TempDir(), "input.txt")
+	testutil.Ok(t, os.WriteFile(fn, []byte(input), os.ModePerm))
+
+	for name, sum := range sumContextVariants {
+		t.Run(name, func(t *testing.T) {
+			for _, workers := range []int{1, 2, 4, 16} {
+				_, err := sum(context.Background(), fn, workers)
+				testutil.NotOk(t, err)
+
+				var serr *SumError
+				testutil.Assert(t, errors.As(err, &serr), "expected SumError, got %v", err)
+				testutil.Equals(t, 5001, serr.Line)
+				testutil.Equals(t, int64(15000), serr.Offset)
+			}
+		})
+	}
+}
+
+func TestConcurrentSumContext_Cancel(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "input.txt")
+	testutil.Ok(t, os.WriteFile(fn, bytes.Repeat([]byte("123\n-45\n"), 1e6), os.ModePerm))
+
+	for name, sum := range sumContextVariants {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := sum(ctx, fn, 4)
+			testutil.NotOk(t, err)
+			testutil.Assert(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+
+			ctx, cancel = context.WithTimeout(context.Background(), 1*time.Microsecond)
+			defer cancel()
+			<-ctx.Done()
+
+			_, err = sum(ctx, fn, 4)
+			testutil.NotOk(t, err)
+			testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected context.DeadlineExceeded, got %v", err)
+		})
+	}
+}
+
+type failingReaderAt struct {
+	r        io.ReaderAt
+	failFrom int64
+}
+
+func (f failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > f.failFrom {
+		return 0, errors.New("injected I/O error")
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func TestConcurrentSumReaderAt_IOError(t *testing.T) {
+	input := bytes.Repeat([]byte("1\n"), 100000)
+	r := failingReaderAt{r: bytes.NewReader(input), failFrom: 150000}
+
+	_, err := concurrentSumReaderAt(context.Background(), r, len(input), 4, options{})
+	testutil.NotOk(t, err)
+
+	var serr *SumError
+	testutil.Assert(t, errors.As(err, &serr), "expected SumError, got %v", err)
+	testutil.Equals(t, "injected I/O error", serr.Err.Error())
+	testutil.Assert(t, serr.Offset >= 100000 && serr.Offset <= 150000, "unexpected offset %v", serr.Offset)
+}
+
+// funcReaderAt fails reads for which fail returns true.
+type funcReaderAt struct {
+	r    io.ReaderAt
+	fail func(p []byte, off int64) bool
+}
+
+func (f funcReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if f.fail(p, off) {
+		return 0, errors.New("injected I/O error")
+	}
+	return f.r.ReadAt(p, off)
+}
+
+func TestConcurrentSumReaderAt_IOErrorOutsideShard(t *testing.T) {
+	input := bytes.Repeat([]byte("1\n"), 100000)
+
+	t.Run("beginning of shard", func(t *testing.T) {
+		// Only shard 2 of 4 fails, while looking for the newline before its nominal beginning in small chunks.
+		r := funcReaderAt{r: bytes.NewReader(input), fail: func(p []byte, off int64) bool {
+			return len(p) <= 64 && off+int64(len(p)) == 100000
+		}}
+		_, err := concurrentSumReaderAt(context.Background(), r, len(input), 4, options{})
+		testutil.NotOk(t, err)
+
+		var serr *SumError
+		testutil.Assert(t, errors.As(err, &serr), "expected SumError, got %v", err)
+		testutil.Equals(t, 0, serr.Line)
+		testutil.Equals(t, int64(100000), serr.Offset)
+		testutil.Assert(t, strings.Contains(serr.Err.Error(), "injected I/O error"), "%v", serr.Err)
+	})
+	t.Run("counting lines before shard", func(t *testing.T) {
+		input := append([]byte(nil), input...)
+		input[120000] = 'x'
+		// Only reads of lines counting, which are bigger than any other.
+		r := funcReaderAt{r: bytes.NewReader(input), fail: func(p []byte, _ int64) bool {
+			return len(p) > 8*1024
+		}}
+		_, err := concurrentSumReaderAt(context.Background(), r, len(input), 4, options{})
+		testutil.NotOk(t, err)
+
+		var serr *SumError
+		testutil.Assert(t, errors.As(err, &serr), "expected SumError, got %v", err)
+		testutil.Equals(t, 0, serr.Line)
+		testutil.Equals(t, int64(120000), serr.Offset)
+		testutil.Assert(t, strings.Contains(serr.Err.Error(), "injected I/O error"), "%v", serr.Err)
+	})
+}
@@ -0,0 +1,39 @@
+package micro
+
+import (
+	"context"
+	"github.com/efficientgo/core/errcapture"
+	"go-advanced/pkg/memoryallocation/mmap"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// ConcurrentSumMmap is like ConcurrentSum3, but instead of reading the whole file onto the heap (ConcurrentSum3) or
+// issuing ReadAt per shard (ConcurrentSum4), it memory maps the file and sums shards, split on newline boundaries,
+// directly from the page cache. Pages are counted in RSS only when touched and kernel is advised about
+// sequential access, so it can read ahead and drop pages behind aggressively.
+// Like ConcurrentSum3, OverflowWrap mode runs the original, unchecked loop, while other modes report *SumError.
+func ConcurrentSumMmap(fileName string, workers int, opts ...Option) (ret int64, err error) {
+	s, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+	if s.Size() == 0 {
+		// Empty mappings are not allowed.
+		return 0, nil
+	}
+
+	f, err := mmap.OpenFileBacked(fileName, int(s.Size()))
+	if err != nil {
+		return 0, err
+	}
+	defer errcapture.Do(&err, f.Close, "close memory mapped file")
+
+	if err := f.Advise(unix.MADV_SEQUENTIAL); err != nil {
+		return 0, err
+	}
+	if o := newOptions(opts); o.overflow != OverflowWrap {
+		return concurrentSumBytes(context.Background(), f.Bytes(), workers, o)
+	}
+	return concurrentSumBytesWrap(f.Bytes(), workers)
+}
@@ -0,0 +1,41 @@
+package micro
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConcurrentSumMmap(t *testing.T) {
+	for _, lines := range []int{0, 100, 1e4, 1e6} {
+		fn, _ := testInput(t, lines)
+		exp, err := Sum(fn)
+		testutil.Ok(t, err)
+
+		for _, workers := range []int{1, 4, 7} {
+			ret, err := ConcurrentSumMmap(fn, workers)
+			testutil.Ok(t, err)
+			testutil.Equals(t, exp, ret, "%v with %v workers", fn, workers)
+		}
+	}
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "no-trailing-newline.txt")
+	testutil.Ok(t, os.WriteFile(fn, []byte("1\n2\n-3\n40"), os.ModePerm))
+	ret, err := ConcurrentSumMmap(fn, 2)
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(40), ret)
+
+	fn = filepath.Join(dir, "malformed.txt")
+	testutil.Ok(t, os.WriteFile(fn, []byte("1\n2\nx3\n40\n"), os.ModePerm))
+	_, err = ConcurrentSumMmap(fn, 2)
+	testutil.NotOk(t, err)
+	_, err = ConcurrentSumMmap(fn, 2, WithOverflowMode(OverflowStrict))
+	testutil.NotOk(t, err)
+	var serr *SumError
+	testutil.Assert(t, errors.As(err, &serr), "expected SumError, got %v", err)
+	testutil.Equals(t, 3, serr.Line)
+	testutil.Equals(t, int64(4), serr.Offset)
+}
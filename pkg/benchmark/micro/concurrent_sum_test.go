@@ -0,0 +1,135 @@
+package micro
+
+import (
+	"bytes"
+	"github.com/efficientgo/core/testutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShardedRangeFromReaderAt(t *testing.T) {
+	for _, tcase := range []struct {
+		name    string
+		input   string
+		workers int
+
+		// expected ranges of each shard.
+		expected [][2]int
+	}{
+		{
+			name:     "empty",
+			input:    "",
+			workers:  1,
+			expected: [][2]int{{0, 0}},
+		},
+		{
+			name:     "short lines",
+			input:    "1\n2\n3\n4\n5\n6\n",
+			workers:  3,
+			expected: [][2]int{{0, 4}, {4, 8}, {8, 12}},
+		},
+		{
+			name:     "newline right before the shard",
+			input:    "123\n456\n",
+			workers:  2,
+			expected: [][2]int{{0, 4}, {4, 8}},
+		},
+		{
+			name:     "shard begins on newline",
+			input:    "1234\n567\n",
+			workers:  2,
+			expected: [][2]int{{0, 4}, {0, 9}},
+		},
+		{
+			name:     "numbers longer than 10 bytes straddle shards",
+			input:    "123456789012345\n-123456789012345\n1\n",
+			workers:  3,
+			expected: [][2]int{{0, 11}, {0, 22}, {16, 35}},
+		},
+		{
+			name:     "zero padded line spans many lookback chunks",
+			input:    "1\n" + strings.Repeat("0", 300) + "7\n2\n",
+			workers:  4,
+			expected: [][2]int{{0, 76}, {2, 152}, {2, 228}, {2, 306}},
+		},
+		{
+			// Shards are found the same way, but sums of such lines fail, see TestSum_SpacePaddedLinesFail.
+			name:     "space padded lines",
+			input:    " 1\n 2\n 3\n",
+			workers:  3,
+			expected: [][2]int{{0, 3}, {3, 6}, {6, 9}},
+		},
+		{
+			name:     "no newline at all",
+			input:    strings.Repeat("0", 199) + "7",
+			workers:  3,
+			expected: [][2]int{{0, 66}, {0, 132}, {0, 200}},
+		},
+		{
+			name:     "last shard without trailing newline takes the remainder",
+			input:    "1\n2\n3\n45",
+			workers:  3,
+			expected: [][2]int{{0, 2}, {2, 4}, {4, 8}},
+		},
+		{
+			name:     "remainder bigger than bytes per worker",
+			input:    "1\n2\n3\n4\n5\n",
+			workers:  4,
+			expected: [][2]int{{0, 2}, {2, 4}, {4, 6}, {6, 10}},
+		},
+		{
+			name:     "empty lines around boundary",
+			input:    "12\n\n\n34\n",
+			workers:  2,
+			expected: [][2]int{{0, 4}, {4, 8}},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			b := []byte(tcase.input)
+			bytesPerWorker := len(b) / tcase.workers
+
+			var got [][2]int
+			for i := 0; i < tcase.workers; i++ {
+				begin, end, err := shardedRangeFromReaderAt(i, tcase.workers, bytesPerWorker, len(b), bytes.NewReader(b))
+				testutil.Ok(t, err)
+				got = append(got, [2]int{begin, end})
+
+				// Must be the same as in-memory sharding.
+				expBegin, expEnd := shardedRange(i, tcase.workers, bytesPerWorker, b)
+				testutil.Equals(t, [2]int{expBegin, expEnd}, [2]int{begin, end}, "shard %v", i)
+			}
+			testutil.Equals(t, tcase.expected, got)
+
+			// All lines are summed exactly once.
+			if tcase.input == "" || strings.Trim(tcase.input, "0123456789-\n") != "" {
+				return
+			}
+			fn := filepath.Join(t.TempDir(), "input.txt")
+			testutil.Ok(t, os.WriteFile(fn, b, os.ModePerm))
+			exp, err := Sum(fn)
+			testutil.Ok(t, err)
+			for _, sum := range []func(string, int, ...Option) (int64, error){ConcurrentSum4, concurrentSum4Strict} {
+				ret, err := sum(fn, tcase.workers)
+				testutil.Ok(t, err)
+				testutil.Equals(t, exp, ret)
+			}
+		})
+	}
+}
+
+func concurrentSum4Strict(fileName string, workers int, opts ...Option) (int64, error) {
+	return ConcurrentSum4(fileName, workers, append(opts, WithOverflowMode(OverflowStrict))...)
+}
+
+func TestShardedRangeFromReaderAt_IOError(t *testing.T) {
+	input := []byte(strings.Repeat("1\n", 100))
+	r := failingReaderAt{r: bytes.NewReader(input), failFrom: 50}
+
+	_, _, err := shardedRangeFromReaderAt(0, 4, 50, len(input), r)
+	testutil.Ok(t, err)
+	_, _, err = shardedRangeFromReaderAt(3, 4, 50, len(input), r)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "find beginning of shard 3 at 86: injected I/O error", err.Error())
+}
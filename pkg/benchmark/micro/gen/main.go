@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"go-advanced/pkg/benchmark/micro"
+	stdlog "log"
+	"os"
+
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+)
+
+// gen deterministically generates input files for Sum variants, e.g.:
+//
+//	go run ./pkg/benchmark/micro/gen -o ./pkg/benchmark/micro/testdata/test.2000000.txt -lines 2000000
+//	go run ./pkg/benchmark/micro/gen -o 10M.txt.zst -lines 10000000 -distribution zipf -negative-ratio 0.3
+//
+// Unless disabled, the expected sum is written to the sidecar file next to the output (see micro.SidecarFileName),
+// or to stderr if output is stdout.
+var (
+	genFlags      = flag.NewFlagSet("gen", flag.ExitOnError)
+	output        = genFlags.String("o", "-", "Output file. Use - for stdout.")
+	seed          = genFlags.Int64("seed", 0, "Seed of the generator. The same flags always generate the same input.")
+	lines         = genFlags.Int("lines", 1000000, "Number of lines.")
+	distribution  = genFlags.String("distribution", string(micro.DistributionUniform), "Distribution of absolute values: "+string(micro.DistributionUniform)+" or "+string(micro.DistributionZipf)+".")
+	maxValue      = genFlags.Int64("max", 30000, "Maximum absolute value.")
+	zipfS         = genFlags.Float64("zipf-s", 1.1, "Exponent of the zipf distribution, greater than 1.")
+	negativeRatio = genFlags.Float64("negative-ratio", 0, "Fraction of negative numbers, from 0 to 1.")
+	width         = genFlags.Int("width", 0, "If not zero, numbers are padded with leading zeros, so every line has exactly this number of bytes, without newline.")
+	codec         = genFlags.String("codec", "", "Compression of the output: none, gzip, zstd or snappy. By default it's detected from the output file suffix: .gz, .zst or .sz.")
+	sidecar       = genFlags.Bool("sidecar", true, "Write expected sum and other stats next to the output.")
+)
+
+func main() {
+	if err := runMain(os.Args[1:]); err != nil {
+		// Use %+v for github.com/efficientgo/core/errors error to print with stack.
+		stdlog.Fatalf("Error: %+v", err)
+	}
+}
+
+func runMain(args []string) (err error) {
+	if err := genFlags.Parse(args); err != nil {
+		return err
+	}
+
+	spec := micro.InputSpec{
+		Seed:          *seed,
+		Lines:         *lines,
+		Distribution:  micro.Distribution(*distribution),
+		Max:           *maxValue,
+		NegativeRatio: *negativeRatio,
+		Width:         *width,
+	}
+	if spec.Distribution == micro.DistributionZipf {
+		spec.ZipfS = *zipfS
+	}
+	if *codec != "" {
+		if spec.Codec, err = micro.ParseCodec(*codec); err != nil {
+			return err
+		}
+	} else if *output != "-" {
+		spec.Codec = micro.CodecFromName(*output)
+	}
+
+	switch {
+	case *output == "-":
+		stats, err := micro.GenerateInput(os.Stdout, spec)
+		if err != nil {
+			return err
+		}
+		if *sidecar {
+			return json.NewEncoder(os.Stderr).Encode(stats)
+		}
+		return nil
+	case *sidecar:
+		_, err := micro.GenerateFile(*output, spec)
+		return err
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return errors.Wrap(err, "create output")
+	}
+	defer errcapture.Do(&err, f.Close, "close output")
+
+	_, err = micro.GenerateInput(f, spec)
+	return err
+}
@@ -0,0 +1,240 @@
+package micro
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Distribution is a distribution of absolute values of generated numbers.
+type Distribution string
+
+const (
+	// DistributionUniform generates values uniformly from [0, Max].
+	DistributionUniform Distribution = "uniform"
+	// DistributionZipf generates values from [0, Max] with Zipf distribution, so small values are much more common,
+	// like in most of the real data.
+	DistributionZipf Distribution = "zipf"
+)
+
+// InputSpec describes input for Sum variants generated by GenerateInput. The same spec always generates the same
+// input.
+type InputSpec struct {
+	Seed  int64 `json:"seed"`
+	Lines int   `json:"lines"`
+
+	// Distribution of absolute values. Empty means DistributionUniform.
+	Distribution Distribution `json:"distribution,omitempty"`
+	// Max is the maximum absolute value.
+	Max int64 `json:"max"`
+	// ZipfS is the exponent of DistributionZipf. It has to be greater than 1.
+	ZipfS float64 `json:"zipfS,omitempty"`
+	// NegativeRatio is a fraction of negative numbers, from 0 to 1.
+	NegativeRatio float64 `json:"negativeRatio,omitempty"`
+
+	// Width pads numbers with leading zeros, so every line has exactly Width bytes, without newline. It has to fit
+	// Max and the sign. Zero means no padding.
+	Width int `json:"width,omitempty"`
+
+	// Codec compresses generated input. Stats are always about the uncompressed input.
+	Codec Codec `json:"codec,omitempty"`
+}
+
+func (s InputSpec) validate() error {
+	if s.Lines < 0 {
+		return errors.Newf("number of lines has to be non-negative, got %v", s.Lines)
+	}
+	if s.Max < 0 {
+		return errors.Newf("max has to be non-negative, got %v", s.Max)
+	}
+	if s.NegativeRatio < 0 || s.NegativeRatio > 1 {
+		return errors.Newf("negative ratio has to be between 0 and 1, got %v", s.NegativeRatio)
+	}
+	switch s.Distribution {
+	case "", DistributionUniform:
+	case DistributionZipf:
+		if s.ZipfS <= 1 {
+			return errors.Newf("zipf exponent has to be greater than 1, got %v", s.ZipfS)
+		}
+	default:
+		return errors.Newf("unknown distribution %q", s.Distribution)
+	}
+	if s.Width > 0 {
+		w := len(strconv.FormatInt(s.Max, 10))
+		if s.NegativeRatio > 0 {
+			w++
+		}
+		if w > s.Width {
+			return errors.Newf("width %v is too small for max %v, it needs at least %v", s.Width, s.Max, w)
+		}
+	}
+	return nil
+}
+
+// InputStats describes generated input. It's what the sidecar file contains.
+type InputStats struct {
+	Spec InputSpec `json:"spec"`
+	// Bytes is the size of the uncompressed input.
+	Bytes int64 `json:"bytes"`
+	// Sum is the expected result of all Sum variants in OverflowWrap mode.
+	Sum int64 `json:"sum"`
+	// ExactSum is the expected result with WithBigResult, in decimal.
+	ExactSum string `json:"exactSum"`
+}
+
+// GenerateInput writes deterministic input for Sum variants to w: spec.Lines newline delimited numbers generated
+// from spec.Seed. It returns stats with the expected sum, so inputs don't need to be checked in along with the
+// expected results.
+func GenerateInput(w io.Writer, spec InputSpec) (_ InputStats, err error) {
+	if err := spec.validate(); err != nil {
+		return InputStats{}, err
+	}
+
+	cw, err := NewCompressor(w, spec.Codec)
+	if err != nil {
+		return InputStats{}, err
+	}
+	defer errcapture.Do(&err, cw.Close, "close compressor")
+	bw := bufio.NewWriterSize(cw, 64*1024)
+
+	var (
+		r     = rand.New(rand.NewSource(spec.Seed))
+		zipf  *rand.Zipf
+		stats = InputStats{Spec: spec}
+		exact = new(big.Int)
+		n     = new(big.Int)
+		line  = make([]byte, 0, 64)
+	)
+	if spec.Distribution == DistributionZipf && spec.Max > 0 {
+		zipf = rand.NewZipf(r, spec.ZipfS, 1, uint64(spec.Max))
+	}
+
+	for i := 0; i < spec.Lines; i++ {
+		var v int64
+		switch {
+		case zipf != nil:
+			v = int64(zipf.Uint64())
+		case spec.Max == math.MaxInt64:
+			v = r.Int63()
+		case spec.Max > 0:
+			v = r.Int63n(spec.Max + 1)
+		}
+		// Always draw, so the sign does not change the sequence of values.
+		if r.Float64() < spec.NegativeRatio {
+			v = -v
+		}
+
+		line = appendPadded(line[:0], v, spec.Width)
+		line = append(line, '\n')
+		if _, err := bw.Write(line); err != nil {
+			return InputStats{}, err
+		}
+
+		stats.Bytes += int64(len(line))
+		stats.Sum += v
+		exact.Add(exact, n.SetInt64(v))
+	}
+	if err := bw.Flush(); err != nil {
+		return InputStats{}, err
+	}
+	stats.ExactSum = exact.String()
+	return stats, nil
+}
+
+// appendPadded appends v in decimal, padded with zeros after the sign to width bytes.
+func appendPadded(b []byte, v int64, width int) []byte {
+	if v < 0 {
+		// Generated values are never math.MinInt64.
+		b = append(b, '-')
+		v = -v
+		width--
+	}
+	var digits [20]byte
+	d := strconv.AppendInt(digits[:0], v, 10)
+	for pad := width - len(d); pad > 0; pad-- {
+		b = append(b, '0')
+	}
+	return append(b, d...)
+}
+
+// SidecarFileName returns name of the file with the InputStats of generated input.
+func SidecarFileName(fileName string) string {
+	return fileName + ".sum.json"
+}
+
+// GenerateFile generates input to fileName and its stats to the sidecar file (see SidecarFileName). Both files are
+// written to a temporary file first and renamed, so concurrent readers never see partial input.
+func GenerateFile(fileName string, spec InputSpec) (InputStats, error) {
+	var stats InputStats
+	if err := writeFileAtomically(fileName, func(w io.Writer) (err error) {
+		stats, err = GenerateInput(w, spec)
+		return err
+	}); err != nil {
+		return InputStats{}, errors.Wrapf(err, "generate %v", fileName)
+	}
+	if err := writeFileAtomically(SidecarFileName(fileName), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}); err != nil {
+		return InputStats{}, errors.Wrapf(err, "write sidecar of %v", fileName)
+	}
+	return stats, nil
+}
+
+// ReadSidecar returns stats of the input generated to fileName by GenerateFile.
+func ReadSidecar(fileName string) (InputStats, error) {
+	b, err := os.ReadFile(SidecarFileName(fileName))
+	if err != nil {
+		return InputStats{}, err
+	}
+	var stats InputStats
+	if err := json.Unmarshal(b, &stats); err != nil {
+		return InputStats{}, errors.Wrapf(err, "parse sidecar of %v", fileName)
+	}
+	return stats, nil
+}
+
+// EnsureFile is like GenerateFile, but it does nothing if fileName was already generated from the same spec, so
+// big inputs are generated only once.
+func EnsureFile(fileName string, spec InputSpec) (InputStats, error) {
+	if stats, err := ReadSidecar(fileName); err == nil && stats.Spec == spec {
+		if s, err := os.Stat(fileName); err == nil && (spec.Codec != CodecNone || s.Size() == stats.Bytes) {
+			return stats, nil
+		}
+	}
+	return GenerateFile(fileName, spec)
+}
+
+func writeFileAtomically(fileName string, write func(w io.Writer) error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if err := write(f); err != nil {
+		return err
+	}
+	// Temporary files are private by default.
+	if err := f.Chmod(0o644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fileName)
+}
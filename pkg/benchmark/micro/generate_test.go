@@ -0,0 +1,155 @@
+package micro
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/efficientgo/core/testutil"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testInputMtx sync.Mutex
+
+// testInput returns file with generated input of the given number of lines and its stats. Inputs are generated to
+// testdata/generated once and reused by next runs, as long as the spec does not change.
+func testInput(tb testing.TB, lines int) (string, InputStats) {
+	tb.Helper()
+
+	testInputMtx.Lock()
+	defer testInputMtx.Unlock()
+
+	fn := filepath.Join("testdata", "generated", fmt.Sprintf("test.%d.txt", lines))
+	testutil.Ok(tb, os.MkdirAll(filepath.Dir(fn), os.ModePerm))
+	stats, err := EnsureFile(fn, InputSpec{Seed: int64(lines), Lines: lines, Max: 30000, NegativeRatio: 0.1})
+	testutil.Ok(tb, err)
+	return fn, stats
+}
+
+func generate(t *testing.T, spec InputSpec) ([]byte, InputStats) {
+	t.Helper()
+
+	b := bytes.Buffer{}
+	stats, err := GenerateInput(&b, spec)
+	testutil.Ok(t, err)
+	return b.Bytes(), stats
+}
+
+func TestGenerateInput(t *testing.T) {
+	t.Run("deterministic", func(t *testing.T) {
+		got, stats := generate(t, InputSpec{Seed: 42, Lines: 6, Max: 999, NegativeRatio: 0.5, Width: 4})
+		testutil.Equals(t, "-675\n-760\n-657\n-247\n0868\n-314\n", string(got))
+		testutil.Equals(t, int64(-1785), stats.Sum)
+		testutil.Equals(t, "-1785", stats.ExactSum)
+		testutil.Equals(t, int64(30), stats.Bytes)
+
+		got, _ = generate(t, InputSpec{Seed: 42, Lines: 6, Max: 1000, Distribution: DistributionZipf, ZipfS: 1.5})
+		testutil.Equals(t, "3\n1\n128\n0\n3\n0\n", string(got))
+
+		again, _ := generate(t, InputSpec{Seed: 42, Lines: 6, Max: 1000, Distribution: DistributionZipf, ZipfS: 1.5})
+		testutil.Equals(t, got, again)
+		other, _ := generate(t, InputSpec{Seed: 43, Lines: 6, Max: 1000, Distribution: DistributionZipf, ZipfS: 1.5})
+		testutil.Assert(t, !bytes.Equal(got, other), "expected different input for different seed")
+	})
+
+	for _, spec := range []InputSpec{
+		{Lines: 0, Max: 10},
+		{Lines: 1000, Max: 0},
+		{Seed: 1, Lines: 10000, Max: 30000},
+		{Seed: 2, Lines: 10000, Max: math.MaxInt64, NegativeRatio: 0.5},
+		{Seed: 3, Lines: 10000, Max: math.MaxInt64, NegativeRatio: 1, Width: 20},
+		{Seed: 4, Lines: 10000, Max: 1e6, Distribution: DistributionZipf, ZipfS: 1.2, NegativeRatio: 0.3, Width: 10},
+	} {
+		t.Run(fmt.Sprintf("%+v", spec), func(t *testing.T) {
+			input, stats := generate(t, spec)
+			testutil.Equals(t, spec, stats.Spec)
+			testutil.Equals(t, int64(len(input)), stats.Bytes)
+			testutil.Equals(t, spec.Lines, bytes.Count(input, []byte("\n")))
+
+			exp := referenceSum(input, false)
+			testutil.Assert(t, exp.invalid == nil, "generated invalid line %v", exp.invalid)
+			testutil.Equals(t, exp.wrapped, stats.Sum)
+			testutil.Equals(t, exp.exact.String(), stats.ExactSum)
+
+			if spec.Width > 0 {
+				for _, line := range strings.Split(strings.TrimSuffix(string(input), "\n"), "\n") {
+					testutil.Equals(t, spec.Width, len(line), "line %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateInput_Compressed(t *testing.T) {
+	spec := InputSpec{Seed: 1, Lines: 10000, Max: 30000, NegativeRatio: 0.1}
+	exp, expStats := generate(t, spec)
+
+	p := &DecompressorPool{}
+	for _, codec := range codecs {
+		spec.Codec = codec
+		compressed, stats := generate(t, spec)
+		testutil.Equals(t, expStats.Sum, stats.Sum, codec.String())
+		testutil.Equals(t, expStats.Bytes, stats.Bytes, codec.String())
+
+		r, err := p.NewReader(bytes.NewReader(compressed), "")
+		testutil.Ok(t, err)
+		got, err := io.ReadAll(r)
+		testutil.Ok(t, err)
+		testutil.Ok(t, r.Close())
+		testutil.Equals(t, exp, got, codec.String())
+	}
+}
+
+func TestGenerateInput_InvalidSpec(t *testing.T) {
+	for _, spec := range []InputSpec{
+		{Lines: -1},
+		{Max: -1},
+		{NegativeRatio: 1.5},
+		{Distribution: "normal"},
+		{Distribution: DistributionZipf, ZipfS: 1},
+		{Max: 1000, Width: 3},
+		{Max: 999, NegativeRatio: 0.1, Width: 3},
+		{Codec: Codec(100)},
+	} {
+		_, err := GenerateInput(io.Discard, spec)
+		testutil.NotOk(t, err, "%+v", spec)
+	}
+}
+
+func TestEnsureFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "input.txt.zst")
+	spec := InputSpec{Seed: 1, Lines: 1000, Max: 30000, Codec: CodecZstd}
+
+	stats, err := EnsureFile(fn, spec)
+	testutil.Ok(t, err)
+	sidecar, err := ReadSidecar(fn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, stats, sidecar)
+
+	ret, err := Sum6(fn, WithDecompression(&DecompressorPool{}))
+	testutil.Ok(t, err)
+	testutil.Equals(t, stats.Sum, ret)
+
+	// The same spec does not generate again.
+	past := time.Now().Add(-1 * time.Hour)
+	testutil.Ok(t, os.Chtimes(fn, past, past))
+	_, err = EnsureFile(fn, spec)
+	testutil.Ok(t, err)
+	s, err := os.Stat(fn)
+	testutil.Ok(t, err)
+	testutil.Assert(t, s.ModTime().Equal(past), "expected input to be reused")
+
+	// Different spec does.
+	spec.Seed = 2
+	stats2, err := EnsureFile(fn, spec)
+	testutil.Ok(t, err)
+	testutil.Assert(t, stats.Sum != stats2.Sum, "expected input to be generated again")
+	ret, err = Sum6(fn, WithDecompression(&DecompressorPool{}))
+	testutil.Ok(t, err)
+	testutil.Equals(t, stats2.Sum, ret)
+}
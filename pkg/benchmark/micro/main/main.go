@@ -1,10 +1,24 @@
 package main
 
-import "go-advanced/pkg/benchmark/micro"
+import (
+	"go-advanced/pkg/benchmark/micro"
+	"log"
+	"os"
+	"path/filepath"
+)
 
 func main() {
-	//_, _ = micro.Sum("./pkg/benchmark/micro/testdata/test.2000000.txt")
-	_, _ = micro.Sum2("./pkg/benchmark/micro/testdata/test.2000000.txt")
+	// The same input as benchmarks use, generated only once.
+	fn := "./pkg/benchmark/micro/testdata/generated/test.2000000.txt"
+	if err := os.MkdirAll(filepath.Dir(fn), os.ModePerm); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := micro.EnsureFile(fn, micro.InputSpec{Seed: 2e6, Lines: 2e6, Max: 30000, NegativeRatio: 0.1}); err != nil {
+		log.Fatal(err)
+	}
+
+	//_, _ = micro.Sum(fn)
+	_, _ = micro.Sum2(fn)
 }
 
 /**
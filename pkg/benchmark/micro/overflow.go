@@ -0,0 +1,371 @@
+package micro
+
+import (
+	"fmt"
+	"github.com/efficientgo/core/errors"
+	"io"
+	"math"
+	"math/big"
+	"sync/atomic"
+)
+
+// OverflowMode decides what Sum variants do when a number or a running sum does not fit into int64.
+type OverflowMode int
+
+const (
+	// OverflowWrap silently wraps around, like book examples do. This is the default and the only mode that
+	// uses original, optimized code of each variant.
+	OverflowWrap OverflowMode = iota
+	// OverflowStrict fails with *SumError wrapping ErrOverflow.
+	OverflowStrict
+	// OverflowSaturate clamps numbers and the sum to math.MinInt64 or math.MaxInt64.
+	OverflowSaturate
+	// OverflowBig accumulates the sum with arbitrary precision. See WithBigResult.
+	OverflowBig
+)
+
+// ErrOverflow is wrapped by *SumError when number or sum does not fit into int64 in OverflowStrict mode.
+var ErrOverflow = errors.New("int64 overflow")
+
+// errStopped is returned by accumulator, when context was cancelled or a worker of a previous shard failed.
+var errStopped = errors.New("stopped")
+
+// SumError is returned by Sum variants configured with options.
+type SumError struct {
+	// Line is 1-based line number, or 0 if it's unknown, because reading failed before the line was found.
+	Line int
+	// Offset is a byte offset of the beginning of the line.
+	Offset int64
+	Err    error
+}
+
+func (e *SumError) Error() string {
+	return fmt.Sprintf("line %d (offset %d): %v", e.Line, e.Offset, e.Err)
+}
+
+func (e *SumError) Unwrap() error { return e.Err }
+
+type options struct {
+	overflow      OverflowMode
+	big           *big.Int
+	decompressors *DecompressorPool
+}
+
+// Option configures Sum...Sum6, Sum6Reader and ConcurrentSum1...ConcurrentSum4. Any overflow mode other than
+// OverflowWrap switches them to the checked implementation, which reports *SumError and, for concurrent variants,
+// stops all workers on the first error.
+type Option func(*options)
+
+// WithOverflowMode sets overflow mode. See OverflowMode for details.
+func WithOverflowMode(m OverflowMode) Option {
+	return func(o *options) {
+		o.overflow = m
+	}
+}
+
+// WithBigResult sets OverflowBig mode and writes exact sum to dst. Returned int64 contains the lower 64 bits
+// of the sum, so the same as in OverflowWrap mode.
+func WithBigResult(dst *big.Int) Option {
+	return func(o *options) {
+		o.overflow = OverflowBig
+		o.big = dst
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.overflow == OverflowBig && o.big == nil {
+		o.big = new(big.Int)
+	}
+	return o
+}
+
+// parseIntChecked is like ParseInt, but it reports if the number does not fit into int64. It does not allocate.
+func parseIntChecked(input []byte) (n int64, overflow bool, ok bool) {
+	k := 0
+	neg := len(input) > 0 && input[0] == '-'
+	if len(input) > 0 && (neg || input[0] == '+') {
+		k++
+	}
+	if k == len(input) {
+		return 0, false, false
+	}
+
+	limit := uint64(math.MaxInt64)
+	if neg {
+		limit++
+	}
+
+	var u uint64
+	for _, c := range input[k:] {
+		if c < '0' || c > '9' {
+			return 0, false, false
+		}
+		d := uint64(c - '0')
+		if !overflow && u > (limit-d)/10 {
+			overflow = true
+		}
+		u = u*10 + d
+	}
+	if overflow {
+		if neg {
+			return math.MinInt64, true, true
+		}
+		return math.MaxInt64, true, true
+	}
+	if neg {
+		return -int64(u-1) - 1, false, true
+	}
+	return int64(u), false, true
+}
+
+// ParseIntChecked is like ParseInt, but returns error wrapping ErrOverflow instead of silently wrapping on
+// numbers that do not fit into int64.
+func ParseIntChecked(input []byte) (int64, error) {
+	n, overflow, ok := parseIntChecked(input)
+	if !ok {
+		return 0, errors.Newf("not a valid integer: %v", input)
+	}
+	if overflow {
+		return 0, errors.Wrapf(ErrOverflow, "%s", input)
+	}
+	return n, nil
+}
+
+// accumulator parses and sums lines according to options. It's shared by all Sum variants when options are used.
+type accumulator struct {
+	o options
+
+	sum int64
+	// spilled is used in OverflowBig mode: sum is accumulated in int64 and spilled here when it would overflow.
+	spilled *big.Int
+	tmp     big.Int
+
+	// lines is the number of lines seen so far.
+	lines int
+	// saturated is true if the sum was clamped in OverflowSaturate mode.
+	saturated bool
+
+	// pos and neg are sums of positive and negative numbers in OverflowStrict and OverflowSaturate modes. If neither
+	// of them overflowed, no running sum could overflow in any order of additions. orderDependent is true otherwise.
+	pos, neg       int64
+	orderDependent bool
+
+	// Concurrent workers use shard, failed and done to fail together. They are checked on every line: accumulator
+	// stops if done is closed or a worker of any previous shard failed (its error is the first one).
+	shard  int64
+	failed *atomic.Int64
+	done   <-chan struct{}
+}
+
+func newAccumulator(o options) *accumulator {
+	a := &accumulator{o: o}
+	if o.overflow == OverflowBig {
+		a.spilled = new(big.Int)
+	}
+	return a
+}
+
+// add adds n to the sum. It returns false if sum overflowed in OverflowStrict mode.
+func (a *accumulator) add(n int64) bool {
+	if a.o.overflow == OverflowStrict || a.o.overflow == OverflowSaturate {
+		a.track(n)
+	}
+	return a.addToSum(n)
+}
+
+// track adds n to pos or neg sum.
+func (a *accumulator) track(n int64) {
+	if n > 0 {
+		if s := a.pos + n; s > a.pos {
+			a.pos = s
+			return
+		}
+	} else {
+		if s := a.neg + n; s <= a.neg {
+			a.neg = s
+			return
+		}
+	}
+	a.orderDependent = true
+}
+
+func (a *accumulator) addToSum(n int64) bool {
+	s := a.sum + n
+	if (n > 0 && s < a.sum) || (n < 0 && s > a.sum) {
+		switch a.o.overflow {
+		case OverflowStrict:
+			return false
+		case OverflowSaturate:
+			a.saturated = true
+			if n > 0 {
+				s = math.MaxInt64
+			} else {
+				s = math.MinInt64
+			}
+		case OverflowBig:
+			a.spilled.Add(a.spilled, a.tmp.SetInt64(a.sum))
+			s = n
+		}
+	}
+	a.sum = s
+	return true
+}
+
+// addLine parses line and adds it to the sum. Offset is a byte offset of the line used for errors.
+// Empty lines are skipped.
+func (a *accumulator) addLine(line []byte, offset int64) error {
+	a.lines++
+	if a.stopped() {
+		return errStopped
+	}
+	if len(line) == 0 {
+		return nil
+	}
+
+	if a.o.overflow == OverflowWrap {
+		n, err := ParseInt(line)
+		if err != nil {
+			return &SumError{Line: a.lines, Offset: offset, Err: err}
+		}
+		a.sum += n
+		return nil
+	}
+
+	n, overflow, ok := parseIntChecked(line)
+	if !ok {
+		return &SumError{Line: a.lines, Offset: offset, Err: errors.Newf("not a valid integer: %v", line)}
+	}
+	if overflow {
+		switch a.o.overflow {
+		case OverflowStrict:
+			return &SumError{Line: a.lines, Offset: offset, Err: ErrOverflow}
+		case OverflowBig:
+			if _, ok := a.tmp.SetString(string(line), 10); !ok {
+				return &SumError{Line: a.lines, Offset: offset, Err: errors.Newf("not a valid integer: %v", line)}
+			}
+			a.spilled.Add(a.spilled, &a.tmp)
+			return nil
+		}
+	}
+	if !a.add(n) {
+		return &SumError{Line: a.lines, Offset: offset, Err: ErrOverflow}
+	}
+	return nil
+}
+
+func (a *accumulator) stopped() bool {
+	if a.failed != nil && a.failed.Load() < a.shard {
+		return true
+	}
+	if a.done != nil {
+		select {
+		case <-a.done:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// merge adds other accumulator sum. It returns false if the result might differ from summing both inputs
+// sequentially, because a running sum overflowed or could have overflowed in OverflowStrict or OverflowSaturate
+// mode. Caller has to sum sequentially in this case.
+func (a *accumulator) merge(other *accumulator) bool {
+	if a.spilled != nil {
+		a.spilled.Add(a.spilled, other.spilled)
+	}
+	if a.o.overflow == OverflowStrict || a.o.overflow == OverflowSaturate {
+		a.track(other.pos)
+		a.track(other.neg)
+		a.orderDependent = a.orderDependent || other.orderDependent
+	}
+	if !a.addToSum(other.sum) {
+		return false
+	}
+	return !a.orderDependent && !a.saturated && !other.saturated
+}
+
+// result returns the sum. In OverflowBig mode it also sets the exact sum to the destination from WithBigResult.
+func (a *accumulator) result() int64 {
+	if a.o.overflow != OverflowBig {
+		return a.sum
+	}
+	a.o.big.Add(a.spilled, a.tmp.SetInt64(a.sum))
+	return a.o.big.Int64()
+}
+
+// sumBytes adds all lines from b. Base is the offset of b in the whole input. If final is false, the
+// last line without trailing newline is ignored, as it belongs to the next shard.
+func (a *accumulator) sumBytes(b []byte, base int64, final bool) error {
+	var last int
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\n' {
+			continue
+		}
+		if err := a.addLine(b[last:i], base+int64(last)); err != nil {
+			return err
+		}
+		last = i + 1
+	}
+	if final && last < len(b) {
+		return a.addLine(b[last:], base+int64(last))
+	}
+	return nil
+}
+
+// sumReader is like sumBytes, but reads lines from r into buf, like Sum6Reader does.
+func (a *accumulator) sumReader(r io.Reader, buf []byte, base int64, final bool) (err error) {
+	var offset, n int
+	var read int64 // Offset of buf[0] relative to base.
+	for err != io.EOF {
+		n, err = r.Read(buf[offset:])
+		if err != nil && err != io.EOF {
+			return &SumError{Line: a.lines + 1, Offset: base + read + int64(offset), Err: err}
+		}
+		n += offset
+
+		var last int
+		for i := range buf[:n] {
+			if buf[i] != '\n' {
+				continue
+			}
+			if err := a.addLine(buf[last:i], base+read+int64(last)); err != nil {
+				return err
+			}
+			last = i + 1
+		}
+
+		offset = n - last
+		if offset == len(buf) {
+			return &SumError{Line: a.lines + 1, Offset: base + read, Err: errors.Newf("line does not fit in the buffer of %v bytes", len(buf))}
+		}
+		if offset > 0 {
+			_ = copy(buf, buf[last:n])
+		}
+		read += int64(last)
+	}
+	if final && offset > 0 {
+		return a.addLine(buf[:offset], base+read)
+	}
+	return nil
+}
+
+func sumBytesChecked(b []byte, o options) (int64, error) {
+	a := newAccumulator(o)
+	if err := a.sumBytes(b, 0, true); err != nil {
+		return 0, err
+	}
+	return a.result(), nil
+}
+
+func sumReaderChecked(r io.Reader, buf []byte, o options) (int64, error) {
+	a := newAccumulator(o)
+	if err := a.sumReader(r, buf, 0, true); err != nil {
+		return 0, err
+	}
+	return a.result(), nil
+}
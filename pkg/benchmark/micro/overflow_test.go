@@ -0,0 +1,239 @@
+package micro
+
+import (
+	"context"
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type sumFunc func(fileName string, opts ...Option) (int64, error)
+
+func sumVariants() map[string]sumFunc {
+	return map[string]sumFunc{
+		"Sum":            Sum,
+		"Sum2":           Sum2,
+		"Sum3":           Sum3,
+		"Sum4":           Sum4,
+		"Sum5":           Sum5,
+		"Sum6":           Sum6,
+		"Sum7":           Sum7,
+		"ConcurrentSum1": ConcurrentSum1,
+		"ConcurrentSum2": func(fileName string, opts ...Option) (int64, error) {
+			return ConcurrentSum2(fileName, 4, opts...)
+		},
+		"ConcurrentSum3": func(fileName string, opts ...Option) (int64, error) {
+			return ConcurrentSum3(fileName, 4, opts...)
+		},
+		"ConcurrentSum4": func(fileName string, opts ...Option) (int64, error) {
+			return ConcurrentSum4(fileName, 4, opts...)
+		},
+		"ConcurrentSumMmap": func(fileName string, opts ...Option) (int64, error) {
+			return ConcurrentSumMmap(fileName, 4, opts...)
+		},
+		"ConcurrentSum2Context": func(fileName string, opts ...Option) (int64, error) {
+			return ConcurrentSum2Context(context.Background(), fileName, 4, opts...)
+		},
+		"ConcurrentSum3Context": func(fileName string, opts ...Option) (int64, error) {
+			return ConcurrentSum3Context(context.Background(), fileName, 4, opts...)
+		},
+		"ConcurrentSum4Context": func(fileName string, opts ...Option) (int64, error) {
+			return ConcurrentSum4Context(context.Background(), fileName, 4, opts...)
+		},
+	}
+}
+
+func TestParseIntChecked(t *testing.T) {
+	for _, tcase := range []struct {
+		input    string
+		expected int64
+		overflow bool
+		err      bool
+	}{
+		{input: "0", expected: 0},
+		{input: "-123", expected: -123},
+		{input: "9223372036854775807", expected: math.MaxInt64},
+		{input: "-9223372036854775808", expected: math.MinInt64},
+		{input: "9223372036854775808", overflow: true},
+		{input: "-9223372036854775809", overflow: true},
+		{input: "99999999999999999999", overflow: true},
+		{input: "", err: true},
+		{input: "-", err: true},
+		{input: "1a", err: true},
+	} {
+		t.Run(tcase.input, func(t *testing.T) {
+			n, err := ParseIntChecked([]byte(tcase.input))
+			switch {
+			case tcase.overflow:
+				testutil.NotOk(t, err)
+				testutil.Assert(t, errors.Is(err, ErrOverflow), "expected overflow, got %v", err)
+			case tcase.err:
+				testutil.NotOk(t, err)
+				testutil.Assert(t, !errors.Is(err, ErrOverflow), "unexpected overflow")
+			default:
+				testutil.Ok(t, err)
+				testutil.Equals(t, tcase.expected, n)
+			}
+		})
+	}
+}
+
+func TestSum_OverflowModes(t *testing.T) {
+	// Prefix of zeros to have enough bytes for each of the concurrent workers.
+	const zeros = 100
+	prefix := strings.Repeat("0\n", zeros)
+
+	for _, tcase := range []struct {
+		name  string
+		input string
+		mode  OverflowMode
+
+		expected    int64
+		expectedBig string
+		errLine     int
+		errOffset   int64
+		errOverflow bool
+	}{
+		{
+			name:        "strict, sum overflow",
+			input:       prefix + "9223372036854775807\n1\n",
+			mode:        OverflowStrict,
+			errLine:     zeros + 2,
+			errOffset:   2*zeros + 20,
+			errOverflow: true,
+		},
+		{
+			name:        "strict, parse overflow",
+			input:       prefix + "1\n99999999999999999999\n",
+			mode:        OverflowStrict,
+			errLine:     zeros + 2,
+			errOffset:   2*zeros + 2,
+			errOverflow: true,
+		},
+		{
+			name:      "strict, invalid number",
+			input:     prefix + "1\n2\nx\n4\n",
+			mode:      OverflowStrict,
+			errLine:   zeros + 3,
+			errOffset: 2*zeros + 4,
+		},
+		{
+			// Lines are not trimmed, so numbers padded with spaces are invalid, like in strconv.ParseInt.
+			name:      "strict, space padded number",
+			input:     prefix + "1\n   42\n",
+			mode:      OverflowStrict,
+			errLine:   zeros + 2,
+			errOffset: 2*zeros + 2,
+		},
+		{
+			name:     "strict, no overflow with intermediate negative numbers",
+			input:    prefix + "9223372036854775807\n-10\n5\n-9223372036854775808\n",
+			mode:     OverflowStrict,
+			expected: -6,
+		},
+		{
+			name:     "saturate",
+			input:    prefix + "9223372036854775807\n1\n-5\n",
+			mode:     OverflowSaturate,
+			expected: math.MaxInt64 - 5,
+		},
+		{
+			name:     "saturate, parse overflow",
+			input:    prefix + "-99999999999999999999\n10\n",
+			mode:     OverflowSaturate,
+			expected: math.MinInt64 + 10,
+		},
+		{
+			name:        "big",
+			input:       prefix + "9223372036854775807\n9223372036854775807\n99999999999999999999\n-1",
+			mode:        OverflowBig,
+			expectedBig: "118446744073709551612",
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "input.txt")
+			testutil.Ok(t, os.WriteFile(fn, []byte(tcase.input), os.ModePerm))
+
+			for name, sum := range sumVariants() {
+				t.Run(name, func(t *testing.T) {
+					opts := []Option{WithOverflowMode(tcase.mode)}
+					b := new(big.Int)
+					if tcase.mode == OverflowBig {
+						opts = []Option{WithBigResult(b)}
+					}
+
+					ret, err := sum(fn, opts...)
+					if tcase.errLine > 0 {
+						testutil.NotOk(t, err)
+
+						var serr *SumError
+						testutil.Assert(t, errors.As(err, &serr), "expected SumError, got %v", err)
+						testutil.Equals(t, tcase.errLine, serr.Line)
+						testutil.Equals(t, tcase.errOffset, serr.Offset)
+						testutil.Equals(t, tcase.errOverflow, errors.Is(err, ErrOverflow))
+						return
+					}
+					testutil.Ok(t, err)
+
+					if tcase.expectedBig != "" {
+						testutil.Equals(t, tcase.expectedBig, b.String())
+						testutil.Equals(t, b.Int64(), ret)
+						return
+					}
+					testutil.Equals(t, tcase.expected, ret)
+				})
+			}
+		})
+	}
+}
+
+func TestSum_OverflowWrapByDefault(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "input.txt")
+	testutil.Ok(t, os.WriteFile(fn, []byte("9223372036854775807\n1\n"), os.ModePerm))
+
+	for _, sum := range []sumFunc{Sum4, Sum6} {
+		ret, err := sum(fn)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(math.MinInt64), ret)
+
+		ret, err = sum(fn, WithOverflowMode(OverflowWrap))
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(math.MinInt64), ret)
+	}
+}
+
+func TestSum_SpacePaddedLinesFail(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "input.txt")
+	testutil.Ok(t, os.WriteFile(fn, []byte(strings.Repeat("1\n", 100)+"   42\n"+strings.Repeat("1\n", 100)), os.ModePerm))
+
+	for name, sum := range sumVariants() {
+		t.Run(name, func(t *testing.T) {
+			_, err := sum(fn)
+			testutil.NotOk(t, err)
+		})
+	}
+}
+
+func TestConcurrentSum_StrictFailsWithFirstError(t *testing.T) {
+	// Errors in multiple shards, the first one has to be reported.
+	input := strings.Repeat("1\n", 1000) + "a\n" + strings.Repeat("1\n", 1000) + "b\n" + strings.Repeat("1\n", 1000)
+	fn := filepath.Join(t.TempDir(), "input.txt")
+	testutil.Ok(t, os.WriteFile(fn, []byte(input), os.ModePerm))
+
+	for name, sum := range sumVariants() {
+		t.Run(name, func(t *testing.T) {
+			_, err := sum(fn, WithOverflowMode(OverflowStrict))
+			testutil.NotOk(t, err)
+
+			var serr *SumError
+			testutil.Assert(t, errors.As(err, &serr), "expected SumError, got %v", err)
+			testutil.Equals(t, 1001, serr.Line)
+			testutil.Equals(t, int64(2000), serr.Offset)
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package micro
+
+import (
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Exact powers of 10 representable in float64.
+var float64pow10 = [...]float64{
+	1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9,
+	1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19,
+	1e20, 1e21, 1e22,
+}
+
+// readFloat parses `[+-]digits[.digits][(e|E)[+-]digits]` without allocating. It returns up to 19 significant
+// digits as mantissa and decimal exponent. trunc is true if some non-zero digits did not fit in mantissa.
+func readFloat(input []byte) (mantissa uint64, exp int, neg, trunc, ok bool) {
+	i := 0
+	if i < len(input) && (input[i] == '+' || input[i] == '-') {
+		neg = input[i] == '-'
+		i++
+	}
+
+	const maxMantDigits = 19
+	var sawDot, sawDigits bool
+	var nd, dp int // Number of significant digits and position of decimal point.
+	for ; i < len(input); i++ {
+		c := input[i]
+		if c == '.' {
+			if sawDot {
+				return 0, 0, false, false, false
+			}
+			sawDot = true
+			dp = nd
+			continue
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+		sawDigits = true
+		if c == '0' && nd == 0 {
+			// Ignore leading zeros.
+			dp--
+			continue
+		}
+		nd++
+		if nd <= maxMantDigits {
+			mantissa = mantissa*10 + uint64(c-'0')
+		} else if c != '0' {
+			trunc = true
+		}
+	}
+	if !sawDigits {
+		return 0, 0, false, false, false
+	}
+	if !sawDot {
+		dp = nd
+	}
+
+	if i < len(input) && (input[i] == 'e' || input[i] == 'E') {
+		i++
+		esign := 1
+		if i < len(input) && (input[i] == '+' || input[i] == '-') {
+			if input[i] == '-' {
+				esign = -1
+			}
+			i++
+		}
+		if i >= len(input) {
+			return 0, 0, false, false, false
+		}
+		e := 0
+		for ; i < len(input) && input[i] >= '0' && input[i] <= '9'; i++ {
+			if e < 10000 {
+				e = e*10 + int(input[i]-'0')
+			}
+		}
+		dp += e * esign
+	}
+	if i != len(input) {
+		return 0, 0, false, false, false
+	}
+
+	if mantissa != 0 {
+		if nd > maxMantDigits {
+			nd = maxMantDigits
+		}
+		exp = dp - nd
+	}
+	return mantissa, exp, neg, trunc, true
+}
+
+// ParseFloat is a companion of ParseInt for float64 values like `12.5`, `+7` or `1e3`.
+// Results are exactly rounded (same as strconv.ParseFloat). It uses exact float64 arithmetic when mantissa and
+// exponent are small enough (most of the inputs in practice) and falls back to strconv.ParseFloat with zero-copy
+// string otherwise. It does not allocate on success.
+func ParseFloat(input []byte) (float64, error) {
+	mantissa, exp, neg, trunc, ok := readFloat(input)
+	if !ok {
+		return 0, errors.Newf("not a valid float: %v", input)
+	}
+
+	if !trunc && mantissa>>53 == 0 {
+		f := float64(mantissa)
+		if neg {
+			f = -f
+		}
+		switch {
+		case exp == 0 || mantissa == 0:
+			return f, nil
+		case exp > 0 && exp <= 15+22:
+			// If exponent is big but number of digits is not, we can move a few zeros into the integer part.
+			if exp > 22 {
+				f *= float64pow10[exp-22]
+				exp = 22
+			}
+			if f <= 1e15 && f >= -1e15 {
+				return f * float64pow10[exp], nil
+			}
+		case exp < 0 && exp >= -22:
+			return f / float64pow10[-exp], nil
+		}
+	}
+
+	// Slow path. Syntax was already validated, so strconv only does rounding for us.
+	f, err := strconv.ParseFloat(zeroCopyToString(input), 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "not a valid float: %v", input)
+	}
+	return f, nil
+}
+
+// ParseDecimal parses `[+-]digits[.digits]` as fixed-point decimal with the given scale (number of fractional
+// digits), e.g. `12.5` with scale 2 returns 1250. It fails if value has more non-zero fractional digits than scale
+// or does not fit into int64. It does not allocate on success.
+func ParseDecimal(input []byte, scale int) (int64, error) {
+	if scale < 0 || scale > 18 {
+		return 0, errors.Newf("scale has to be between 0 and 18, got %v", scale)
+	}
+
+	i := 0
+	neg := false
+	if i < len(input) && (input[i] == '+' || input[i] == '-') {
+		neg = input[i] == '-'
+		i++
+	}
+
+	limit := uint64(math.MaxInt64)
+	if neg {
+		limit++
+	}
+
+	var (
+		n                uint64
+		sawDot, sawDigit bool
+		frac             int
+	)
+	for ; i < len(input); i++ {
+		c := input[i]
+		if c == '.' && !sawDot {
+			sawDot = true
+			continue
+		}
+		if c < '0' || c > '9' {
+			return 0, errors.Newf("not a valid decimal: %v", input)
+		}
+		sawDigit = true
+		if sawDot {
+			if frac == scale {
+				if c != '0' {
+					return 0, errors.Newf("decimal %v has more than %v fractional digits", input, scale)
+				}
+				continue
+			}
+			frac++
+		}
+		if n > (limit-uint64(c-'0'))/10 {
+			return 0, errors.Newf("decimal %v overflows int64 with scale %v", input, scale)
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	if !sawDigit {
+		return 0, errors.Newf("not a valid decimal: %v", input)
+	}
+
+	for ; frac < scale; frac++ {
+		if n > limit/10 {
+			return 0, errors.Newf("decimal %v overflows int64 with scale %v", input, scale)
+		}
+		n *= 10
+	}
+	if neg {
+		return -int64(n-1) - 1, nil
+	}
+	return int64(n), nil
+}
+
+// SumFloat is like Sum6, but for float values (see ParseFloat).
+func SumFloat(fileName string) (ret float64, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer errcapture.Do(&err, f.Close, "close file")
+
+	buf := make([]byte, 8*1024)
+	return SumFloatReader(f, buf)
+}
+
+// SumFloatReader is like Sum6Reader, but for float values (see ParseFloat). Empty lines are skipped and the last
+// line does not need trailing newline.
+func SumFloatReader(r io.Reader, buf []byte) (ret float64, err error) {
+	var offset, n int
+	for err != io.EOF {
+		n, err = r.Read(buf[offset:])
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		n += offset
+
+		var last int
+		for i := range buf[:n] {
+			if buf[i] != '\n' {
+				continue
+			}
+			if i > last {
+				num, err := ParseFloat(buf[last:i])
+				if err != nil {
+					return 0, err
+				}
+				ret += num
+			}
+			last = i + 1
+		}
+
+		offset = n - last
+		if offset == len(buf) {
+			return 0, errors.Newf("line does not fit in the buffer of %v bytes", len(buf))
+		}
+		if offset > 0 {
+			_ = copy(buf, buf[last:n])
+		}
+	}
+
+	if offset > 0 {
+		num, err := ParseFloat(buf[:offset])
+		if err != nil {
+			return 0, err
+		}
+		ret += num
+	}
+	return ret, nil
+}
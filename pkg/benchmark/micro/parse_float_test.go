@@ -0,0 +1,179 @@
+package micro
+
+import (
+	"bytes"
+	"github.com/efficientgo/core/testutil"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testParseFloatAgainstStrconv(t *testing.T, input string) {
+	t.Helper()
+
+	exp, expErr := strconv.ParseFloat(input, 64)
+	got, err := ParseFloat([]byte(input))
+	if expErr != nil {
+		testutil.NotOk(t, err, "input %q", input)
+		return
+	}
+	testutil.Ok(t, err, "input %q", input)
+	testutil.Equals(t, math.Float64bits(exp), math.Float64bits(got), "input %q: expected %v, got %v", input, exp, got)
+}
+
+func TestParseFloat(t *testing.T) {
+	for _, input := range []string{
+		"0", "-0", "+0", "12.5", "+7", "-7", "1e3", "1E3", "1e+3", "1e-3", ".5", "5.", "-.5", "007", "0.005",
+		"123456789", "9007199254740992", "9007199254740993", "18446744073709551615", "123456789012345678901234567890",
+		"0.1", "0.2", "0.3", "1.7976931348623157e308", "4.9e-324", "2.2250738585072014e-308", "1e22", "1e23", "1e37",
+		"123456.789e-20", "1.00000000000000011102230246251565404236316680908203125", "1e400", "-1e400", "1e-400",
+		"1e99999999999",
+	} {
+		testParseFloatAgainstStrconv(t, input)
+	}
+
+	for _, input := range []string{
+		"", "-", "+", ".", "e3", "1e", "1e+", "1.2.3", "abc", "1a", "inf", "NaN", "0x10", "1_000", " 1", "1 ", "--1",
+	} {
+		_, err := ParseFloat([]byte(input))
+		testutil.NotOk(t, err, "input %q", input)
+	}
+}
+
+// TestParseFloat_ExactRounding compares ParseFloat with strconv.ParseFloat on random inputs, including
+// hard-to-round ones, to ensure results are bit to bit the same.
+func TestParseFloat_ExactRounding(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 100000; i++ {
+		// Shortest representation of random float64 and its variations.
+		f := math.Float64frombits(r.Uint64())
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			continue
+		}
+		testParseFloatAgainstStrconv(t, strconv.FormatFloat(f, 'e', -1, 64))
+		testParseFloatAgainstStrconv(t, strconv.FormatFloat(f, 'g', r.Intn(25)+1, 64))
+		testParseFloatAgainstStrconv(t, strconv.FormatFloat(f, 'e', r.Intn(30), 64))
+
+		// Random decimal digits with random point and exponent.
+		var sb strings.Builder
+		if r.Intn(2) == 0 {
+			sb.WriteByte('-')
+		}
+		digits := r.Intn(25) + 1
+		dot := r.Intn(digits + 1)
+		for d := 0; d < digits; d++ {
+			if d == dot {
+				sb.WriteByte('.')
+			}
+			sb.WriteByte(byte('0' + r.Intn(10)))
+		}
+		if r.Intn(2) == 0 {
+			sb.WriteString("e")
+			sb.WriteString(strconv.Itoa(r.Intn(700) - 350))
+		}
+		testParseFloatAgainstStrconv(t, sb.String())
+	}
+}
+
+func TestParseFloat_NoAllocs(t *testing.T) {
+	for _, input := range [][]byte{
+		[]byte("12.5"), // Fast path.
+		[]byte("123456789012345678901234567890.1234e-5"), // Slow path.
+	} {
+		testutil.Equals(t, float64(0), testing.AllocsPerRun(100, func() {
+			if _, err := ParseFloat(input); err != nil {
+				t.Fatal(err)
+			}
+		}), "input %q", input)
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	for _, tcase := range []struct {
+		input    string
+		scale    int
+		expected int64
+		err      bool
+	}{
+		{input: "12.5", scale: 2, expected: 1250},
+		{input: "-12.5", scale: 1, expected: -125},
+		{input: "+7", scale: 3, expected: 7000},
+		{input: "0.001", scale: 3, expected: 1},
+		{input: ".5", scale: 1, expected: 5},
+		{input: "5.", scale: 0, expected: 5},
+		{input: "1.2300", scale: 2, expected: 123},
+		{input: "9223372036854775807", scale: 0, expected: math.MaxInt64},
+		{input: "-9223372036854775808", scale: 0, expected: math.MinInt64},
+		{input: "-922337203685477580.8", scale: 1, expected: math.MinInt64},
+		{input: "9223372036854775808", scale: 0, err: true},
+		{input: "922337203685477580.8", scale: 1, err: true},
+		{input: "922337203685477581", scale: 1, err: true},
+		{input: "1.25", scale: 1, err: true},
+		{input: "1e3", scale: 0, err: true},
+		{input: "1.2.3", scale: 3, err: true},
+		{input: "", scale: 0, err: true},
+		{input: "-", scale: 0, err: true},
+		{input: ".", scale: 0, err: true},
+		{input: "1", scale: 19, err: true},
+	} {
+		t.Run(tcase.input, func(t *testing.T) {
+			got, err := ParseDecimal([]byte(tcase.input), tcase.scale)
+			if tcase.err {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expected, got)
+		})
+	}
+}
+
+func TestSumFloatReader(t *testing.T) {
+	for _, tcase := range []struct {
+		input    string
+		expected float64
+		err      bool
+	}{
+		{input: "", expected: 0},
+		{input: "12.5\n+7\n1e3\n-0.5\n", expected: 1019},
+		{input: "1.5\n\n2.5", expected: 4},
+		{input: "1.5\nabc\n", err: true},
+	} {
+		got, err := SumFloatReader(bytes.NewReader([]byte(tcase.input)), make([]byte, 8))
+		if tcase.err {
+			testutil.NotOk(t, err)
+			continue
+		}
+		testutil.Ok(t, err)
+		testutil.Equals(t, tcase.expected, got)
+	}
+
+	// Integers are valid floats too, so we should get the same results as Sum for existing test inputs.
+	for _, lines := range []int{100, 1e4, 1e6} {
+		fn, _ := testInput(t, lines)
+		exp, err := Sum(fn)
+		testutil.Ok(t, err)
+		got, err := SumFloat(fn)
+		testutil.Ok(t, err)
+		testutil.Equals(t, float64(exp), got, fn)
+	}
+}
+
+func BenchmarkParseFloat(b *testing.B) {
+	input := []byte("-1234.5678")
+	b.Run("strconv", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = strconv.ParseFloat(zeroCopyToString(input), 64)
+		}
+	})
+	b.Run("ParseFloat", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = ParseFloat(input)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package micro
+
+import (
+	"encoding/binary"
+	"github.com/efficientgo/core/errcapture"
+	"github.com/efficientgo/core/errors"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// SWAR (SIMD within a register) constants.
+const (
+	swarOnes   = 0x0101010101010101
+	swarHighs  = 0x8080808080808080
+	swarNLs    = 0x0a0a0a0a0a0a0a0a
+	swarZeroes = 0x3030303030303030
+)
+
+// indexNewlineSWAR returns index of the first '\n' in b or -1, checking eight bytes at a time.
+func indexNewlineSWAR(b []byte) int {
+	i := 0
+	for ; len(b)-i >= 8; i += 8 {
+		x := binary.LittleEndian.Uint64(b[i:]) ^ swarNLs
+		// Highest bit of a byte is set if the byte was zero (so '\n'). Bytes after the first zero might be false
+		// positives, but the lowest one is always correct.
+		if t := (x - swarOnes) & ^x & swarHighs; t != 0 {
+			return i + bits.TrailingZeros64(t)/8
+		}
+	}
+	for ; i < len(b); i++ {
+		if b[i] == '\n' {
+			return i
+		}
+	}
+	return -1
+}
+
+// isEightDigits returns true if all eight bytes (loaded in little endian order) are ASCII digits.
+func isEightDigits(v uint64) bool {
+	return (v&0xf0f0f0f0f0f0f0f0)|(((v+0x0606060606060606)&0xf0f0f0f0f0f0f0f0)>>4) == 0x3333333333333333
+}
+
+// parseEightDigits parses eight ASCII digits (loaded in little endian order, so the first digit is the lowest
+// byte) in three multiplications instead of eight.
+func parseEightDigits(v uint64) uint64 {
+	v -= swarZeroes
+	// Combine pairs of digits, then pairs of pairs, then the two halves.
+	v = (v * 10) + (v >> 8)
+	return (((v & 0x000000ff000000ff) * (100 + (1000000 << 32))) + (((v >> 16) & 0x000000ff000000ff) * (1 + (10000 << 32)))) >> 32
+}
+
+// ParseIntSWAR is like ParseInt, but it parses up to eight digits per step and accepts leading '+', like
+// strconv.ParseInt. Like ParseInt, it silently wraps on numbers that do not fit into int64.
+func ParseIntSWAR(input []byte) (int64, error) {
+	i := 0
+	neg := false
+	if len(input) > 0 && (input[0] == '-' || input[0] == '+') {
+		neg = input[0] == '-'
+		i++
+	}
+	if i == len(input) {
+		return 0, errors.Newf("not a valid integer: %v", input)
+	}
+
+	var n uint64
+	for ; len(input)-i >= 8; i += 8 {
+		v := binary.LittleEndian.Uint64(input[i:])
+		if !isEightDigits(v) {
+			return 0, errors.Newf("not a valid integer: %v", input)
+		}
+		n = n*100000000 + parseEightDigits(v)
+	}
+	for ; i < len(input); i++ {
+		if input[i] < '0' || input[i] > '9' {
+			return 0, errors.Newf("not a valid integer: %v", input)
+		}
+		n = n*10 + uint64(input[i]-'0')
+	}
+	if neg {
+		return -int64(n), nil
+	}
+	return int64(n), nil
+}
+
+// Sum7 is like Sum6, but the hot loop finds newlines and parses digits eight bytes at a time (SWAR).
+// Empty lines are skipped and the last line does not need trailing newline.
+func Sum7(fileName string, opts ...Option) (ret int64, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer errcapture.Do(&err, f.Close, "close file")
+
+	buf := make([]byte, 8*1024)
+	return Sum7Reader(f, buf, opts...)
+}
+
+func Sum7Reader(r io.Reader, buf []byte, opts ...Option) (ret int64, err error) {
+	if o := newOptions(opts); o.overflow != OverflowWrap {
+		return sumReaderChecked(r, buf, o)
+	}
+
+	var offset, n int
+	for err != io.EOF {
+		n, err = r.Read(buf[offset:])
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		n += offset
+
+		var last int
+		for {
+			i := indexNewline(buf[last:n])
+			if i < 0 {
+				break
+			}
+			if i > 0 {
+				num, err := ParseIntSWAR(buf[last : last+i])
+				if err != nil {
+					return 0, err
+				}
+				ret += num
+			}
+			last += i + 1
+		}
+
+		offset = n - last
+		if offset == len(buf) {
+			return 0, errors.Newf("line does not fit in the buffer of %v bytes", len(buf))
+		}
+		if offset > 0 {
+			_ = copy(buf, buf[last:n])
+		}
+	}
+
+	if offset > 0 {
+		num, err := ParseIntSWAR(buf[:offset])
+		if err != nil {
+			return 0, err
+		}
+		ret += num
+	}
+	return ret, nil
+}
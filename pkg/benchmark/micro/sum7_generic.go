@@ -0,0 +1,7 @@
+//go:build !sumsimd
+
+package micro
+
+// indexNewline is implemented in pure Go with SWAR. Build with `-tags sumsimd` to use assembly (SSE/AVX2) version
+// from the standard library instead.
+func indexNewline(b []byte) int { return indexNewlineSWAR(b) }
@@ -0,0 +1,9 @@
+//go:build sumsimd
+
+package micro
+
+import "bytes"
+
+// indexNewline uses bytes.IndexByte, which has assembly kernels (e.g. SSE2/AVX2 on amd64) scanning 16-32 bytes
+// at a time.
+func indexNewline(b []byte) int { return bytes.IndexByte(b, '\n') }
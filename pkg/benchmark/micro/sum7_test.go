@@ -0,0 +1,135 @@
+package micro
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestIndexNewlineSWAR(t *testing.T) {
+	for _, input := range []string{"", "\n", "1", "1234567\n", "12345678\n", "123456789\n", "1234567812345678", "\x8a\n", "\x0b\x0a", "abcdefgh\x0a\x0a"} {
+		testutil.Equals(t, bytes.IndexByte([]byte(input), '\n'), indexNewlineSWAR([]byte(input)), "input %q", input)
+	}
+}
+
+func TestParseEightDigits(t *testing.T) {
+	for _, input := range []string{"00000000", "12345678", "99999999", "00000001", "10000000"} {
+		v := binary.LittleEndian.Uint64([]byte(input))
+		testutil.Assert(t, isEightDigits(v), "input %q", input)
+
+		exp, err := strconv.ParseUint(input, 10, 64)
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, parseEightDigits(v), "input %q", input)
+	}
+	for _, input := range []string{"1234567a", "/2345678", ":2345678", "1234 678", "\x001234567"} {
+		testutil.Assert(t, !isEightDigits(binary.LittleEndian.Uint64([]byte(input))), "input %q", input)
+	}
+}
+
+func TestParseIntSWAR(t *testing.T) {
+	for _, input := range []string{"0", "-0", "+7", "-1", "12345678", "-123456789", "9223372036854775807", "-9223372036854775808", "1234567812345678"} {
+		exp, err := strconv.ParseInt(input, 10, 64)
+		testutil.Ok(t, err)
+		got, err := ParseIntSWAR([]byte(input))
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, got, "input %q", input)
+	}
+	for _, input := range []string{"", "-", "+", "1a", "1234567a", "12345678a", "1 2", "--1"} {
+		_, err := ParseIntSWAR([]byte(input))
+		testutil.NotOk(t, err, "input %q", input)
+	}
+}
+
+func TestSum7(t *testing.T) {
+	for _, lines := range []int{0, 100, 1e4, 1e6} {
+		fn, _ := testInput(t, lines)
+		exp, err := Sum(fn)
+		testutil.Ok(t, err)
+		got, err := Sum7(fn)
+		testutil.Ok(t, err)
+		testutil.Equals(t, exp, got, fn)
+	}
+}
+
+// FuzzSum7 compares Sum7 with Sum, which uses strconv.ParseInt.
+// Run it with `go test -run '^$' -fuzz '^FuzzSum7$' -fuzztime 1m`.
+func FuzzSum7(f *testing.F) {
+	for _, seed := range []string{"", "1\n2\n3\n", "-12345678\n+87654321\n", "123456789012\n\n-5", "12345678\n1234567\n", "1a\n", "-\n"} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		fn := filepath.Join(t.TempDir(), "input.txt")
+		testutil.Ok(t, os.WriteFile(fn, input, os.ModePerm))
+
+		exp, expErr := Sum(fn)
+		if errors.Is(expErr, strconv.ErrRange) {
+			// Sum fails on numbers that do not fit into int64, Sum7 wraps like other optimized variants.
+			t.Skip()
+		}
+
+		// Buffer bigger than any line and small one that requires moving leftovers.
+		for _, bufSize := range []int{len(input) + 1, 64} {
+			if maxLineLen(input) >= bufSize {
+				continue
+			}
+			got, err := Sum7Reader(bytes.NewReader(input), make([]byte, bufSize))
+			if expErr != nil {
+				testutil.NotOk(t, err, "input %q, buffer %v", input, bufSize)
+				continue
+			}
+			testutil.Ok(t, err, "input %q, buffer %v", input, bufSize)
+			testutil.Equals(t, exp, got, "input %q, buffer %v", input, bufSize)
+		}
+	})
+}
+
+func maxLineLen(input []byte) (max int) {
+	for _, line := range bytes.Split(input, []byte("\n")) {
+		if len(line) > max {
+			max = len(line)
+		}
+	}
+	return max
+}
+
+/**
+export ver=v7 && \
+	go test -run '^$' -bench '^BenchmarkSum7' -benchtime 10s -count 6 \
+		-cpu 4 \
+		-benchmem \
+		-memprofile=./benchmarkresult/${ver}.mem.pprof -cpuprofile=./benchmarkresult/${ver}.cpu.pprof \
+	| tee ./benchmarkresult/${ver}.txt
+*/
+// Use `-tags sumsimd` to benchmark assembly newline search.
+/**
+using benchstat for visualization:
+$ gvm use go1.24.1
+$ benchstat ./pkg/benchmark/micro/benchmarkresult/v6.txt ./pkg/benchmark/micro/benchmarkresult/v7.txt
+*/
+func BenchmarkSum7(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = Sum7(fn)
+	}
+}
+
+func BenchmarkParseIntSWAR(b *testing.B) {
+	input := []byte("-1234567890123")
+	b.Run("ParseInt", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = ParseInt(input)
+		}
+	})
+	b.Run("ParseIntSWAR", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = ParseIntSWAR(input)
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package micro
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"io"
+	"math"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// referencePos is a position of the first failing line in the input.
+type referencePos struct {
+	line   int
+	offset int64
+	// overflow is true if the line failed because of int64 overflow, not invalid syntax.
+	overflow bool
+}
+
+// referenceResult is what every Sum variant should return for the given input.
+type referenceResult struct {
+	// wrapped is the sum in OverflowWrap mode: numbers and the sum wrap around.
+	wrapped int64
+	// saturated is the sum in OverflowSaturate mode.
+	saturated int64
+	// exact is the sum in OverflowBig mode.
+	exact *big.Int
+
+	// invalid is the first line which is not a valid integer.
+	invalid *referencePos
+	// outOfRange is the first line with number that does not fit into int64.
+	outOfRange *referencePos
+	// strict is the first error in OverflowStrict mode.
+	strict *referencePos
+}
+
+// referenceSum is the oracle for all Sum variants. It is deliberately simple and slow: lines are separated by '\n',
+// empty lines are skipped, the last line does not need trailing newline and every other line has to be
+// `[+-]digits`. If dropCR is true, a trailing '\r' is removed from each line first, like bufio.ScanLines does.
+func referenceSum(input []byte, dropCR bool) referenceResult {
+	res := referenceResult{exact: new(big.Int)}
+
+	var (
+		offset  int64
+		n       = new(big.Int)
+		maxInt  = big.NewInt(math.MaxInt64)
+		minInt  = big.NewInt(math.MinInt64)
+		running = new(big.Int)
+	)
+	lines := bytes.Split(input, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		// Newline at the end of the input does not start a new line.
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		pos := &referencePos{line: i + 1, offset: offset}
+		offset += int64(len(line)) + 1
+
+		if dropCR {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		digits := bytes.TrimLeft(line, "+-")
+		if len(line)-len(digits) > 1 || len(digits) == 0 || len(bytes.Trim(digits, "0123456789")) > 0 {
+			if res.invalid == nil {
+				res.invalid = pos
+			}
+			if res.strict == nil {
+				res.strict = pos
+			}
+			continue
+		}
+
+		n.SetString(strings.TrimPrefix(string(line), "+"), 10)
+		res.exact.Add(res.exact, n)
+		res.wrapped += int64(new(big.Int).And(n, new(big.Int).SetUint64(math.MaxUint64)).Uint64())
+
+		var s int64
+		if n.Cmp(maxInt) > 0 {
+			s = math.MaxInt64
+		} else if n.Cmp(minInt) < 0 {
+			s = math.MinInt64
+		} else {
+			s = n.Int64()
+		}
+		res.saturated = saturatingAdd(res.saturated, s)
+
+		if !n.IsInt64() {
+			if res.outOfRange == nil {
+				res.outOfRange = &referencePos{line: pos.line, offset: pos.offset, overflow: true}
+			}
+			if res.strict == nil {
+				res.strict = &referencePos{line: pos.line, offset: pos.offset, overflow: true}
+			}
+			continue
+		}
+		if running.Add(running, n); !running.IsInt64() && res.strict == nil {
+			res.strict = &referencePos{line: pos.line, offset: pos.offset, overflow: true}
+		}
+	}
+	return res
+}
+
+func saturatingAdd(a, b int64) int64 {
+	s := a + b
+	switch {
+	case b > 0 && s < a:
+		return math.MaxInt64
+	case b < 0 && s > a:
+		return math.MinInt64
+	}
+	return s
+}
+
+// sumVariantQuirks describes well-known, documented differences of a variant from referenceSum.
+type sumVariantQuirks struct {
+	// strconv is true for variants using strconv.ParseInt, which fail on numbers that do not fit into int64
+	// in OverflowWrap mode instead of wrapping them.
+	strconv bool
+	// dropCR is true for variants using bufio.Scanner, which removes '\r' before '\n' in OverflowWrap mode.
+	dropCR bool
+}
+
+var sumQuirks = map[string]sumVariantQuirks{
+	"Sum":  {strconv: true},
+	"Sum2": {strconv: true},
+	"Sum3": {strconv: true},
+	"Sum5": {dropCR: true},
+}
+
+// testSumVariantsAgainstReference checks that all Sum variants return the same result or the same class of error
+// as referenceSum in all overflow modes.
+func testSumVariantsAgainstReference(t *testing.T, input []byte) {
+	t.Helper()
+
+	if maxLineLen(input) >= 8*1024 {
+		// Readers use 8 KB buffers, longer lines are never valid numbers anyway.
+		t.Skip()
+	}
+
+	fn := filepath.Join(t.TempDir(), "input.txt")
+	testutil.Ok(t, os.WriteFile(fn, input, os.ModePerm))
+
+	ref := referenceSum(input, false)
+	refDropCR := referenceSum(input, true)
+
+	variants := sumVariants()
+	names := make([]string, 0, len(variants))
+	for name := range variants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sum, quirks := variants[name], sumQuirks[name]
+		desc := fmt.Sprintf("%v: input %q", name, input)
+
+		// OverflowWrap mode: the original code of each variant, errors are not typed.
+		{
+			r := ref
+			if quirks.dropCR {
+				r = refDropCR
+			}
+			expErr := r.invalid != nil || (quirks.strconv && r.outOfRange != nil)
+
+			got, err := sum(fn)
+			if expErr {
+				testutil.NotOk(t, err, desc)
+			} else {
+				testutil.Ok(t, err, desc)
+				testutil.Equals(t, r.wrapped, got, desc)
+			}
+		}
+
+		// OverflowStrict mode: exact position of the first error is expected.
+		{
+			got, err := sum(fn, WithOverflowMode(OverflowStrict))
+			if ref.strict != nil {
+				testSumErrorAt(t, *ref.strict, err, desc+": strict")
+			} else {
+				testutil.Ok(t, err, desc+": strict")
+				testutil.Equals(t, ref.exact.Int64(), got, desc+": strict")
+			}
+		}
+
+		// OverflowSaturate and OverflowBig modes fail only on invalid numbers.
+		{
+			got, err := sum(fn, WithOverflowMode(OverflowSaturate))
+			if ref.invalid != nil {
+				testSumErrorAt(t, *ref.invalid, err, desc+": saturate")
+			} else {
+				testutil.Ok(t, err, desc+": saturate")
+				testutil.Equals(t, ref.saturated, got, desc+": saturate")
+			}
+
+			b := new(big.Int)
+			got, err = sum(fn, WithBigResult(b))
+			if ref.invalid != nil {
+				testSumErrorAt(t, *ref.invalid, err, desc+": big")
+			} else {
+				testutil.Ok(t, err, desc+": big")
+				testutil.Equals(t, ref.exact.String(), b.String(), desc+": big")
+				testutil.Equals(t, b.Int64(), got, desc+": big")
+			}
+		}
+	}
+}
+
+func testSumErrorAt(t *testing.T, exp referencePos, err error, desc string) {
+	t.Helper()
+
+	testutil.NotOk(t, err, desc)
+	var serr *SumError
+	testutil.Assert(t, errors.As(err, &serr), "%v: expected SumError, got %v", desc, err)
+	testutil.Equals(t, exp.line, serr.Line, desc)
+	testutil.Equals(t, exp.offset, serr.Offset, desc)
+	testutil.Equals(t, exp.overflow, errors.Is(err, ErrOverflow), desc)
+}
+
+// TestSum6Reader_LineLongerThanBuffer covers lines skipped by testSumVariantsAgainstReference. Sum6Reader used to
+// read into empty buffer forever on them.
+func TestSum6Reader_LineLongerThanBuffer(t *testing.T) {
+	for _, sum := range []func(r io.Reader, buf []byte, opts ...Option) (int64, error){Sum6Reader, Sum7Reader} {
+		_, err := sum(bytes.NewReader([]byte("1\n123456789\n2\n")), make([]byte, 8))
+		testutil.NotOk(t, err)
+	}
+}
+
+// FuzzSum compares all Sum variants with referenceSum on arbitrary inputs. Inputs that found bugs are kept in
+// testdata/fuzz/FuzzSum.
+// Run it with `go test -run '^$' -fuzz '^FuzzSum$' -fuzztime 5m`.
+func FuzzSum(f *testing.F) {
+	for _, seed := range []string{
+		"", "\n", "1", "1\n", "1\n2\n3\n", "-1\n+2\n", "12\n\n3", "x\n", "-\n", "1\r\n2\r\n",
+		"9223372036854775807\n1\n", "-9223372036854775808\n-1", "99999999999999999999\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(testSumVariantsAgainstReference)
+}
+
+// generateSumInput generates input which is valid for most of the variants, but exercises edge cases: random line
+// lengths, negative numbers, empty lines, missing trailing newline and numbers straddling 8 KB read buffers.
+func generateSumInput(r *rand.Rand, lines int) []byte {
+	b := bytes.Buffer{}
+	for i := 0; i < lines; i++ {
+		switch p := r.Intn(100); {
+		case p < 5:
+			// Empty line.
+		case p < 7:
+			// Numbers around int64 boundaries.
+			b.WriteString([]string{"9223372036854775807", "-9223372036854775808", "9223372036854775808", "-9223372036854775809"}[r.Intn(4)])
+		case p < 8:
+			// Leading zeros and sign.
+			b.WriteString("+000" + strconv.Itoa(r.Intn(1000)))
+		case p < 10:
+			// Pad, so the next number straddles buffer boundary.
+			if pad := 8*1024 - b.Len()%(8*1024) - 2; pad > 0 && pad < 8*1024-20 {
+				b.WriteString(strings.Repeat("0", pad))
+			}
+		default:
+			n := r.Int63n(int64(math.Pow10(r.Intn(19))))
+			if r.Intn(3) == 0 {
+				n = -n
+			}
+			b.WriteString(strconv.FormatInt(n, 10))
+		}
+		if i < lines-1 || r.Intn(2) == 0 {
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes()
+}
+
+// FuzzSum_Generated is like FuzzSum, but with inputs generated from the seed, so the fuzzer can explore
+// bigger, mostly valid inputs.
+// Run it with `go test -run '^$' -fuzz '^FuzzSum_Generated$' -fuzztime 5m`.
+func FuzzSum_Generated(f *testing.F) {
+	for _, seed := range []struct {
+		seed  int64
+		lines uint16
+	}{{0, 0}, {1, 1}, {2, 10}, {3, 1000}, {4, 5000}} {
+		f.Add(seed.seed, seed.lines)
+	}
+	f.Fuzz(func(t *testing.T, seed int64, lines uint16) {
+		testSumVariantsAgainstReference(t, generateSumInput(rand.New(rand.NewSource(seed)), int(lines)%5000))
+	})
+}
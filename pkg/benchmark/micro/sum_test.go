@@ -28,8 +28,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/benchmarkresult/v1.txt
 */
 func BenchmarkSum(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = Sum("testdata/test.2000000.txt")
+		_, _ = Sum(fn)
 	}
 }
 
@@ -48,8 +50,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/benchmarkresult/v1.txt ./pkg/benchmark/micro/benchmarkresult/v2.txt
 */
 func BenchmarkSum2(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = Sum2("testdata/test.2000000.txt")
+		_, _ = Sum2(fn)
 	}
 }
 
@@ -68,8 +72,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/benchmarkresult/v1.txt ./pkg/benchmark/micro/benchmarkresult/v3.txt
 */
 func BenchmarkSum3(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = Sum3("testdata/test.2000000.txt")
+		_, _ = Sum3(fn)
 	}
 }
 
@@ -88,8 +94,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/benchmarkresult/v1.txt ./pkg/benchmark/micro/benchmarkresult/v4.txt
 */
 func BenchmarkSum4(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = Sum4("testdata/test.2000000.txt")
+		_, _ = Sum4(fn)
 	}
 }
 
@@ -108,8 +116,10 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/benchmarkresult/v1.txt ./pkg/benchmark/micro/benchmarkresult/v5.txt
 */
 func BenchmarkSum5(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = Sum5("testdata/test.2000000.txt")
+		_, _ = Sum5(fn)
 	}
 }
 
@@ -128,8 +138,32 @@ $ gvm use go1.24.1
 $ benchstat ./pkg/benchmark/micro/benchmarkresult/v1.txt ./pkg/benchmark/micro/benchmarkresult/v6.txt
 */
 func BenchmarkSum6(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = Sum6(fn)
+	}
+}
+
+/**
+export ver=vfloat && \
+	go test -run '^$' -bench '^BenchmarkSumFloat' -benchtime 10s -count 6 \
+		-cpu 4 \
+		-benchmem \
+		-memprofile=./benchmarkresult/${ver}.mem.pprof -cpuprofile=./benchmarkresult/${ver}.cpu.pprof \
+	| tee ./benchmarkresult/${ver}.txt
+*/
+// after benchmark, for running benchstat, go into vfloat.txt and rename the BenchmarkSumFloat -> BenchmarkSum
+/**
+using benchstat for visualization:
+$ gvm use go1.24.1
+$ benchstat ./pkg/benchmark/micro/benchmarkresult/v6.txt ./pkg/benchmark/micro/benchmarkresult/vfloat.txt
+*/
+func BenchmarkSumFloat(b *testing.B) {
+	fn, _ := testInput(b, 2e6)
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = Sum6("testdata/test.2000000.txt")
+		_, _ = SumFloat(fn)
 	}
 }
 
@@ -145,12 +179,14 @@ func BenchmarkSum_benchmark(b *testing.B) {
 }
 
 func benchmarkSum(tb testutil.TB) {
+	fn, stats := testInput(tb, 2e6)
+	tb.ResetTimer()
 	for i := 0; i < tb.N(); i++ {
-		ret, err := Sum("testdata/test.2000000.txt")
+		ret, err := Sum(fn)
 		testutil.Ok(tb, err)
 		if !tb.IsBenchmark() {
 			// More expensive result checks can be here.
-			testutil.Equals(tb, int64(6221600000), ret)
+			testutil.Equals(tb, stats.Sum, ret)
 		}
 	}
 }
@@ -170,8 +206,8 @@ export ver=v1 && go test \
 | tee ${ver}.txt
 */
 func BenchmarkSum_well_document(b *testing.B) {
-	// Create 7.55 MB file with 2 million lines.
-	fn := "testdata/test.2000000.txt"
+	// Generate 11.5 MB file with 2 million lines.
+	fn, _ := testInput(b, 2e6)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		_, err := Sum(fn)
@@ -192,10 +228,10 @@ func BenchmarkSum_table_test(b *testing.B) {
 	} {
 		b.Run(fmt.Sprintf("lines-%d", tcase.numLines), func(b *testing.B) {
 			b.ReportAllocs() // go test ignores any benchmark methods outside b.Run => remember to repeat them here
-			//fn := lazyCreateTestInput(tb, tcase.numLines)
+			fn, _ := testInput(b, tcase.numLines)
 			b.ResetTimer()
 			for i := 0; i < b.N; i++ {
-				_, err := Sum("fn")
+				_, err := Sum(fn)
 				testutil.Ok(b, err)
 			}
 		})
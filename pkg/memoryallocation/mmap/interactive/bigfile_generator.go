@@ -1,75 +1,41 @@
 package main
 
 import (
-	"crypto/rand"
 	"fmt"
+	"go-advanced/pkg/benchmark/micro"
 	"os"
 )
 
-// generate test686mbfile.out file with 686MB of random data.
-func main_1() {
+const bigFileName = "test686mbfile.out"
+
+// ensureBigFile generates test686mbfile.out with 686MB of newline delimited numbers, unless it was already generated
+// before. Input is deterministic, so there is no need to upload so big file to GitHub. Use
+// `go run ./pkg/benchmark/micro/gen` for other inputs.
+func ensureBigFile() error {
 	const (
-		filename   = "test686mbfile.out"
-		fileSize   = 686 * 1024 * 1024 // 686 MB in bytes
-		bufferSize = 1024 * 1024       // 1 MB buffer
+		fileSize = 686 * 1024 * 1024 // 686 MB in bytes
+		// Every number is padded to 15 digits, so the file has exactly fileSize bytes.
+		lineSize = 16
 	)
 
-	fmt.Printf("Generating %s with %d MB of random data...\n", filename, fileSize/(1024*1024))
-
-	// Create the output file
-	file, err := os.Create(filename)
+	fmt.Printf("Generating %s with %d MB of numbers, unless it exists...\n", bigFileName, fileSize/(1024*1024))
+	stats, err := micro.EnsureFile(bigFileName, micro.InputSpec{
+		Seed:  686,
+		Lines: fileSize / lineSize,
+		Max:   1e15 - 1,
+		Width: lineSize - 1,
+	})
 	if err != nil {
-		fmt.Printf("Error creating file: %v\n", err)
-		os.Exit(1)
-	}
-	defer func() {
-		if closeErr := file.Close(); closeErr != nil {
-			fmt.Printf("Error closing file: %v\n", closeErr)
-		}
-	}()
-
-	// Create a buffer for writing random data
-	buffer := make([]byte, bufferSize)
-	bytesWritten := int64(0)
-
-	for bytesWritten < fileSize {
-		// Calculate how much to write in this iteration
-		remaining := fileSize - bytesWritten
-		writeSize := bufferSize
-		if remaining < int64(bufferSize) {
-			writeSize = int(remaining)
-			buffer = buffer[:writeSize]
-		}
-
-		// Fill buffer with random data
-		_, err := rand.Read(buffer)
-		if err != nil {
-			fmt.Printf("Error generating random data: %v\n", err)
-			os.Exit(1)
-		}
-
-		// Write buffer to file
-		n, err := file.Write(buffer)
-		if err != nil {
-			fmt.Printf("Error writing to file: %v\n", err)
-			os.Exit(1)
-		}
-
-		bytesWritten += int64(n)
-
-		// Show progress every 50MB
-		if bytesWritten%(50*1024*1024) == 0 || bytesWritten == fileSize {
-			progress := float64(bytesWritten) / float64(fileSize) * 100
-			fmt.Printf("Progress: %.1f%% (%d MB written)\n", progress, bytesWritten/(1024*1024))
-		}
+		return err
 	}
+	fmt.Printf("Generated %s (%d bytes)\n", bigFileName, stats.Bytes)
+	return nil
+}
 
-	// Ensure all data is written to disk
-	err = file.Sync()
-	if err != nil {
-		fmt.Printf("Error syncing file: %v\n", err)
+// generate test686mbfile.out file with 686MB of numbers.
+func main_1() {
+	if err := ensureBigFile(); err != nil {
+		fmt.Printf("Error generating file: %v\n", err)
 		os.Exit(1)
 	}
-
-	fmt.Printf("Successfully generated %s (%d bytes)\n", filename, bytesWritten)
 }
@@ -17,10 +17,12 @@ import (
 func runMmap() {
 	fmt.Println("PID", os.Getpid())
 
-	// TODO(bwplotka): Create big file here, so we can play with it - there is no need to upload so big file to GitHub.
+	if err := ensureBigFile(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Mmap 600 MB of 686MB file.
-	f, err := mmap.OpenFileBacked("test686mbfile.out", 600*1024*1024)
+	f, err := mmap.OpenFileBacked(bigFileName, 600*1024*1024)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -59,8 +61,12 @@ func runMmap() {
 }
 
 func bookExample1() error {
+	if err := ensureBigFile(); err != nil {
+		return err
+	}
+
 	// Mmap 600MB of 686MB file.
-	f, err := mmap.OpenFileBacked("test686mbfile.out", 600*1024*1024)
+	f, err := mmap.OpenFileBacked(bigFileName, 600*1024*1024)
 	if err != nil {
 		return err
 	}
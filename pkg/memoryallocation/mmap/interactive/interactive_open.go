@@ -97,10 +97,12 @@ import (
 func runOpen() {
 	fmt.Println("PID", os.Getpid())
 
-	// TODO(bwplotka): Create big file here, so we can play with it - there is no need to upload so big file to GitHub.
+	if err := ensureBigFile(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Open 686MB file and read 600 MB from it.
-	f, err := os.Open("test686mbfile.out")
+	f, err := os.Open(bigFileName)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -178,8 +180,12 @@ func runOpen() {
 }
 
 func bookExample2() error {
+	if err := ensureBigFile(); err != nil {
+		return err
+	}
+
 	// Open 686MB file and read 600 MB from it.
-	f, err := os.Open("test686mbfile.out")
+	f, err := os.Open(bigFileName)
 	if err != nil {
 		log.Fatal(err)
 	}
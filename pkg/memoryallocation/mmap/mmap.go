@@ -54,10 +54,20 @@ func (f *MemoryMap) Bytes() []byte { return f.b }
 
 func (f *MemoryMap) File() *os.File { return f.f }
 
+// fileBackedAdvice lists madvise calls that work in SHARED, file-backed mode. Those are only hints about the access
+// pattern (or dropping of clean pages, which are read from the file again on access). Others, e.g. MADV_FREE,
+// works ony on MAP_ANON mappings.
+var fileBackedAdvice = map[int]bool{
+	unix.MADV_NORMAL:     true,
+	unix.MADV_RANDOM:     true,
+	unix.MADV_SEQUENTIAL: true,
+	unix.MADV_WILLNEED:   true,
+	unix.MADV_DONTNEED:   true,
+}
+
 func (f *MemoryMap) Advise(advise int) error {
-	if f.f != nil {
-		// TODO(bwplotka): Provide table what works in SHARED mode.
-		return errors.New("Most of madvise calls works ony on MAP_ANON mappings.")
+	if f.f != nil && !fileBackedAdvice[advise] {
+		return errors.Newf("madvise %v works ony on MAP_ANON mappings.", advise)
 	}
 	if err := unix.Madvise(f.b, advise); err != nil {
 		return err
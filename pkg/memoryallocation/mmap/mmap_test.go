@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/efficientgo/core/testutil"
+	"golang.org/x/sys/unix"
 )
 
 func TestMemoryMappedFile(t *testing.T) {
@@ -55,3 +56,17 @@ func TestMemoryMappedAnnonymous(t *testing.T) {
 
 	fmt.Println(len(b), cap(b))
 }
+
+func TestMemoryMappedFileAdvise(t *testing.T) {
+	f, err := OpenFileBacked("./test_file.txt", 20)
+	testutil.Ok(t, err)
+
+	t.Cleanup(func() {
+		testutil.Ok(t, f.Close())
+	})
+
+	testutil.Ok(t, f.Advise(unix.MADV_SEQUENTIAL))
+	testutil.Ok(t, f.Advise(unix.MADV_WILLNEED))
+	testutil.NotOk(t, f.Advise(unix.MADV_FREE))
+	testutil.Equals(t, "is is a test stri", string(f.Bytes()[2:19]))
+}